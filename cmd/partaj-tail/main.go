@@ -9,11 +9,9 @@ import (
 	"github.com/underscorenygren/partaj/internal/logging"
 	"github.com/underscorenygren/partaj/internal/timeutil"
 	"github.com/underscorenygren/partaj/pkg/cloudwatch"
-	"github.com/underscorenygren/partaj/pkg/errfilter"
-	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/underscorenygren/partaj/pkg/merge"
 	"github.com/underscorenygren/partaj/pkg/pipe"
 	"github.com/underscorenygren/partaj/pkg/stream"
-	"github.com/underscorenygren/partaj/pkg/transformer"
 	"github.com/underscorenygren/partaj/pkg/types"
 	"go.uber.org/zap"
 	"log"
@@ -26,31 +24,41 @@ var errMissingLogGroup = "ResourceNotFoundException"
 //Used with compile flags
 var version = "0.0.0"
 
-//Stream one log stream
-type Stream struct {
-	name  string
-	stage types.Stage
-}
-
 //Streamer struct for all streams
 type Streamer struct {
 	client       *cloudwatchlogs.CloudWatchLogs
 	nextToken    *string
-	logStreams   map[string]*Stream
+	logStreams   map[string]bool
+	source       *merge.Source
+	stage        types.Stage
 	logger       *zap.Logger
 	logGroupName string
 }
 
-//creates the top level streamer that holds many streamers to many log groups+streams
+//creates the top level streamer that merges all streams of a log group to stdout
 func newStreamer(logGroupName string) (*Streamer, error) {
 	if logGroupName == "" {
 		return nil, fmt.Errorf("logGroupName must be set")
 	}
 
+	//one source and sink for all streams, so lines aren't interleaved.
+	//Streams that fail are removed, and added again when listing, so tailing continues
+	source, err := merge.NewSource(merge.Config{Mode: merge.EndWhenClosed, Tag: merge.TagPrefix(":")}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	stage, err := pipe.NewStage(source, stream.NewSink(os.Stdout))
+	if err != nil {
+		return nil, err
+	}
+
 	streamer := &Streamer{
 		logGroupName: logGroupName,
 		client:       cloudwatch.NewClient(false),
-		logStreams:   map[string]*Stream{},
+		logStreams:   map[string]bool{},
+		source:       source,
+		stage:        stage,
 		logger:       logging.Logger(),
 	}
 
@@ -59,60 +67,14 @@ func newStreamer(logGroupName string) (*Streamer, error) {
 	return streamer, nil
 }
 
-//newStream creates a new source/sink for a log group name and stream
-func newStream(logGroupName, logStreamName string) (*Stream, error) {
-	cloudwatchSource, err := cloudwatch.NewSource(cloudwatch.SourceConfig{
+//newStream creates a source for a log group name and stream
+func newStream(logGroupName, logStreamName string) (types.Source, error) {
+	return cloudwatch.NewSource(cloudwatch.SourceConfig{
 		LogGroupName:  logGroupName,
 		LogStreamName: logStreamName,
 		StartTime:     aws.Int64(timeutil.UnixMillis()),
+		Follow:        true,
 	})
-	if err != nil {
-		return nil, err
-	}
-
-	mapper := func(evt *types.Event) (*types.Event, error) {
-		return evt.NewBytes([]byte(fmt.Sprintf("%s:%b", logStreamName, evt.Bytes()))), nil
-	}
-
-	transformer, err := transformer.NewSource(cloudwatchSource, mapper)
-	if err != nil {
-		return nil, err
-	}
-	//TODO Test
-	if transformer != nil {
-		transformer = nil
-	}
-
-	streamSink := stream.NewSink(os.Stdout)
-
-	pipe, err := pipe.NewStage(cloudwatchSource, streamSink)
-	if err != nil {
-		return nil, err
-	}
-
-	stage, err := errfilter.NewStage(pipe, []error{errors.ErrCloudwatchEnd}, 1500*time.Millisecond)
-	if err != nil {
-		return nil, err
-	}
-
-	return &Stream{
-		name:  logStreamName,
-		stage: stage,
-	}, nil
-}
-
-//runs one stream
-func (s *Stream) run() {
-	logger := logging.Logger()
-	err := s.stage.Flow()
-	if err != nil {
-		logger.Error("Stream Errored",
-			zap.String("name", s.name),
-			zap.Error(err))
-	} else {
-		logger.Info("Stream Ended with nil",
-			zap.String("name", s.name))
-	}
 }
 
 //calls the cloudwatchlogs list command once
@@ -156,15 +118,22 @@ func (streamer *Streamer) doList() error {
 	} else if err != nil {
 		streamer.logger.Error("couldn't list streams", zap.Error(err))
 	} else {
+		//streams whose sources ended were removed from the merged source, and are added again
+		streamer.logStreams = map[string]bool{}
+		for _, name := range streamer.source.Names() {
+			streamer.logStreams[name] = true
+		}
 		for _, streamName := range streams {
-			if _, ok := streamer.logStreams[streamName]; !ok {
+			if !streamer.logStreams[streamName] {
 				streamer.logger.Debug("creating stream", zap.String("streamName", streamName))
 				s, err := newStream(streamer.logGroupName, streamName)
+				if err == nil {
+					err = streamer.source.Add(streamName, s)
+				}
 				if err != nil {
 					streamer.logger.Error("couldn't create stream", zap.Error(err))
 				} else {
-					streamer.logStreams[streamName] = s
-					go s.run()
+					streamer.logStreams[streamName] = true
 				}
 			} else {
 				streamer.logger.Debug("stream pre-existing", zap.String("streamName", streamName))
@@ -177,19 +146,27 @@ func (streamer *Streamer) doList() error {
 
 //Run streams forever
 func (streamer *Streamer) Run() error {
-	//Checks for new streams every second
+	flowed := make(chan error, 1)
+	go func() {
+		flowed <- streamer.stage.Flow()
+	}()
+
+	//Checks for new streams every few seconds
 	err := streamer.doList()
 	if err != nil {
 		return err
 	}
-	for range time.Tick(3 * time.Second) {
-		err = streamer.doList()
-		if err != nil {
+	tick := time.Tick(3 * time.Second)
+	for {
+		select {
+		case err = <-flowed:
 			return err
+		case <-tick:
+			if err = streamer.doList(); err != nil {
+				return err
+			}
 		}
 	}
-
-	return nil
 }
 
 //command entry point
@@ -6,9 +6,11 @@ require (
 	github.com/aws/aws-sdk-go v1.26.1
 	github.com/fgrosse/zaptest v1.1.0
 	github.com/gorilla/mux v1.7.3
+	github.com/klauspost/compress v1.10.10
 	github.com/mattn/go-sqlite3 v2.0.2+incompatible
 	github.com/onsi/ginkgo v1.9.0
 	github.com/onsi/gomega v1.6.0
 	github.com/valyala/fastjson v1.4.1
 	go.uber.org/zap v1.13.0
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,129 @@
+/*
+Package awsconfig provides the options all AWS backed sources and sinks
+use to create their clients.
+
+	sink, err := firehose.NewSink(firehose.Config{
+		Name: "my-firehose",
+		AWS: &awsconfig.Options{
+			Profile:    "analytics",
+			Region:     "eu-west-1",
+			MaxRetries: aws.Int(5),
+		},
+	})
+
+Roles are assumed by supplying credentials from stscreds:
+
+	sess := session.Must(session.NewSession())
+	opts := &awsconfig.Options{
+		Session:     sess,
+		Credentials: stscreds.NewCredentials(sess, "arn:aws:iam::123456789012:role/writer"),
+	}
+*/
+package awsconfig
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	//DefaultRegion is used when no region is configured.
+	DefaultRegion = endpoints.UsEast1RegionID
+	//RegionEnvVar is the environment variable read for the region, before the session's region.
+	RegionEnvVar = "AWS_DEFAULT_REGION"
+)
+
+//Options configure the AWS session that clients are created with.
+//All fields are optional, and a nil Options uses the defaults.
+type Options struct {
+	Session     *session.Session         //session to create clients from, instead of creating a new one. The other fields are applied on top of it
+	Profile     string                   //shared config profile to load, when creating a new session
+	Region      string                   //overrides the region of the environment and session
+	Endpoint    string                   //overrides the service endpoint, including the local endpoint
+	Credentials *credentials.Credentials //overrides the credentials of the session, e.g. to assume roles
+	MaxRetries  *int                     //max retries of failed requests, defaults to the sdk default
+	HTTPTimeout time.Duration            //timeout of http requests, defaults to no timeout
+}
+
+//DefaultConfig returns an aws config with region filled in
+//and localEndpoint set if localEndpoint != ""
+func DefaultConfig(localEndpoint string) *aws.Config {
+	region := os.Getenv(RegionEnvVar)
+	if region == "" {
+		region = DefaultRegion
+	}
+	awsCfg := aws.NewConfig().WithRegion(region)
+	if localEndpoint != "" {
+		awsCfg.Endpoint = aws.String(localEndpoint)
+	}
+
+	return awsCfg
+}
+
+/*
+NewSession returns the session clients are created from, with options applied.
+
+localEndpoint is the endpoint of the service when running locally, and is
+empty otherwise. Endpoint takes precedence over it.
+A nil Options returns a new session configured by DefaultConfig, and never fails.
+*/
+func (opts *Options) NewSession(localEndpoint string) (*session.Session, error) {
+	if opts == nil {
+		return session.New(DefaultConfig(localEndpoint)), nil
+	}
+
+	sess := opts.Session
+	if sess == nil {
+		var err error
+		sess, err = session.NewSessionWithOptions(session.Options{
+			Profile:           opts.Profile,
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	awsCfg := aws.NewConfig()
+
+	region := opts.Region
+	if region == "" {
+		region = os.Getenv(RegionEnvVar)
+	}
+	if region == "" && aws.StringValue(sess.Config.Region) == "" {
+		region = DefaultRegion
+	}
+	if region != "" {
+		awsCfg.Region = aws.String(region)
+	}
+
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = localEndpoint
+	}
+	if endpoint != "" {
+		awsCfg.Endpoint = aws.String(endpoint)
+	}
+
+	if opts.Credentials != nil {
+		awsCfg.Credentials = opts.Credentials
+	}
+	if opts.MaxRetries != nil {
+		awsCfg.MaxRetries = opts.MaxRetries
+	}
+	if opts.HTTPTimeout > 0 {
+		httpClient := http.Client{}
+		if sess.Config.HTTPClient != nil {
+			httpClient = *sess.Config.HTTPClient
+		}
+		httpClient.Timeout = opts.HTTPTimeout
+		awsCfg.HTTPClient = &httpClient
+	}
+
+	return sess.Copy(awsCfg), nil
+}
@@ -0,0 +1,13 @@
+package awsconfig_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestAWSConfig(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "AWSConfig Suite")
+}
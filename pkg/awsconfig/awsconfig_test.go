@@ -0,0 +1,72 @@
+package awsconfig_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/underscorenygren/partaj/pkg/awsconfig"
+	"os"
+	"time"
+)
+
+var _ = Describe("AWS Options", func() {
+
+	var region string
+
+	BeforeEach(func() {
+		region = os.Getenv(awsconfig.RegionEnvVar)
+		os.Unsetenv(awsconfig.RegionEnvVar)
+	})
+
+	AfterEach(func() {
+		if region != "" {
+			os.Setenv(awsconfig.RegionEnvVar, region)
+		}
+	})
+
+	It("uses defaults for nil options", func() {
+		var opts *awsconfig.Options
+		sess, err := opts.NewSession("http://localhost:1234")
+		Expect(err).To(BeNil())
+		Expect(aws.StringValue(sess.Config.Region)).To(Equal(awsconfig.DefaultRegion))
+		Expect(aws.StringValue(sess.Config.Endpoint)).To(Equal("http://localhost:1234"))
+	})
+
+	It("applies options on top of injected sessions", func() {
+		creds := credentials.NewStaticCredentials("id", "secret", "")
+		injected := session.Must(session.NewSession(aws.NewConfig().WithRegion("eu-west-1")))
+
+		sess, err := (&awsconfig.Options{
+			Session:     injected,
+			Endpoint:    "http://endpoint",
+			Credentials: creds,
+			MaxRetries:  aws.Int(7),
+			HTTPTimeout: time.Second,
+		}).NewSession("http://localhost:1234")
+		Expect(err).To(BeNil())
+
+		Expect(aws.StringValue(sess.Config.Region)).To(Equal("eu-west-1"))
+		Expect(aws.StringValue(sess.Config.Endpoint)).To(Equal("http://endpoint"))
+		Expect(sess.Config.Credentials).To(Equal(creds))
+		Expect(aws.IntValue(sess.Config.MaxRetries)).To(Equal(7))
+		Expect(sess.Config.HTTPClient.Timeout).To(Equal(time.Second))
+
+		//injected session is unchanged
+		Expect(injected.Config.Endpoint).To(BeNil())
+	})
+
+	It("prefers option region over environment", func() {
+		os.Setenv(awsconfig.RegionEnvVar, "us-west-2")
+
+		sess, err := (&awsconfig.Options{}).NewSession("")
+		Expect(err).To(BeNil())
+		Expect(aws.StringValue(sess.Config.Region)).To(Equal("us-west-2"))
+
+		sess, err = (&awsconfig.Options{Region: "ap-south-1"}).NewSession("")
+		Expect(err).To(BeNil())
+		Expect(aws.StringValue(sess.Config.Region)).To(Equal("ap-south-1"))
+	})
+})
@@ -3,19 +3,37 @@ package cloudwatch
 import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
-	"github.com/underscorenygren/partaj/internal/awsutil"
 	"github.com/underscorenygren/partaj/internal/logging"
-	"github.com/underscorenygren/partaj/internal/timeutil"
+	"github.com/underscorenygren/partaj/pkg/awsconfig"
 	"github.com/underscorenygren/partaj/pkg/errors"
 	"github.com/underscorenygren/partaj/pkg/types"
 	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
 )
 
 const (
 	//LocalEndpoint is the address of the cloudwatch service when using localstack for testing.
 	LocalEndpoint = "http://localhost:4586"
+	//MaxBatchEvents is the max number of events in one PutLogEvents call.
+	MaxBatchEvents = 10000
+	//MaxBatchBytes is the max size of one PutLogEvents call, counting EventOverheadBytes per event.
+	MaxBatchBytes = 1024 * 1024
+	//MaxBatchSpan is the max time between first and last event in one PutLogEvents call.
+	MaxBatchSpan = 24 * time.Hour
+	//MaxEventBytes is the max size of one event, counting EventOverheadBytes.
+	MaxEventBytes = 256 * 1024
+	//EventOverheadBytes is added to the message size of each event when counting batch size.
+	EventOverheadBytes = 26
+	//DefaultMinPollInterval is the shortest wait between polls of a followed stream.
+	DefaultMinPollInterval = 500 * time.Millisecond
+	//DefaultMaxPollInterval is the longest wait between polls of a followed stream.
+	DefaultMaxPollInterval = 10 * time.Second
+	//maxPutAttempts is how many times a batch is put when refreshing tokens or creating streams
+	maxPutAttempts = 3
 )
 
 //Source implements Source interface for cloudwatch logs
@@ -25,6 +43,11 @@ type Source struct {
 	nextToken         *string
 	initial           bool
 	bufferedEvents    []*cloudwatchlogs.OutputLogEvent
+	follow            bool
+	minPollInterval   time.Duration
+	maxPollInterval   time.Duration
+	pollInterval      time.Duration //current adaptive poll interval
+	done              chan struct{}
 }
 
 //Sink implements Sink interface for cloudwatch logs
@@ -32,6 +55,19 @@ type Sink struct {
 	LogGroupName   string
 	LogStreamName  string
 	cloudwatchlogs *cloudwatchlogs.CloudWatchLogs //client for interacting with API
+	timestampFn    TimestampFn
+	createMissing  bool
+	sequenceToken  *string
+	mu             sync.Mutex
+}
+
+//TimestampFn is the function signature for reading the timestamp of an event.
+type TimestampFn func(*types.Event) (time.Time, error)
+
+//logEntry is a log event with the index of the event it was made from
+type logEntry struct {
+	index int
+	event *cloudwatchlogs.InputLogEvent
 }
 
 //SourceConfig the input arguments for a new Source
@@ -39,28 +75,49 @@ type SourceConfig struct {
 	LogGroupName  string
 	LogStreamName string
 	Limit         *int64
-	StartTime     *int64
-	Local         bool //when set to true, will configure client to make requests to the local endpoint.
+	StartTime     *int64             //unix millis to start reading from, inclusive
+	EndTime       *int64             //unix millis to stop reading at, exclusive. Can't be combined with Follow.
+	Local         bool               //when set to true, will configure client to make requests to the local endpoint.
+	AWS           *awsconfig.Options //aws session options, e.g. region, credentials and retries. Defaults to the environment
+	//Follow when true keeps polling for new events at the end of the stream,
+	//instead of returning ErrCloudwatchEnd.
+	Follow bool
+	//MinPollInterval is the follow mode poll interval when the stream is busy, defaults to DefaultMinPollInterval.
+	MinPollInterval time.Duration
+	//MaxPollInterval is the follow mode poll interval when the stream is idle, defaults to DefaultMaxPollInterval.
+	MaxPollInterval time.Duration
 }
 
 //SinkConfig the input arguments for a new Sink
 type SinkConfig struct {
 	LogGroupName  string
 	LogStreamName string
-	Local         bool //when set to true, will configure client to make requests to the local endpoint.
+	Local         bool               //when set to true, will configure client to make requests to the local endpoint.
+	AWS           *awsconfig.Options //aws session options, e.g. region, credentials and retries. Defaults to the environment
+	TimestampFn   TimestampFn        //timestamp of events, defaults to the time they are drained
+	CreateMissing bool               //when set to true, creates log group and stream if they don't exist
 }
 
 // ** Constructors ** //
 
-//NewClient makes a cloudwatchlogs client with aws sdk
+//NewClient makes a cloudwatchlogs client with aws sdk, using default options
 func NewClient(local bool) *cloudwatchlogs.CloudWatchLogs {
+	//default options never fail
+	client, _ := NewClientWithOptions(nil, local)
+	return client
+}
+
+//NewClientWithOptions makes a cloudwatchlogs client with aws sdk, configured by opts
+func NewClientWithOptions(opts *awsconfig.Options, local bool) (*cloudwatchlogs.CloudWatchLogs, error) {
 	endpoint := ""
 	if local {
 		endpoint = LocalEndpoint
 	}
-	awsCfg := awsutil.GetDefaultConfig(endpoint)
-
-	return cloudwatchlogs.New(session.New(), awsCfg)
+	sess, err := opts.NewSession(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return cloudwatchlogs.New(sess), nil
 }
 
 //NewSource constructs a cloudwatch Source
@@ -71,14 +128,34 @@ func NewSource(cfg SourceConfig) (*Source, error) {
 	if cfg.LogStreamName == "" {
 		return nil, fmt.Errorf("No log stream name provided")
 	}
+	if cfg.Follow && cfg.EndTime != nil {
+		return nil, fmt.Errorf("can't follow a stream with an end time")
+	}
+	if cfg.MinPollInterval <= 0 {
+		cfg.MinPollInterval = DefaultMinPollInterval
+	}
+	if cfg.MaxPollInterval <= 0 {
+		cfg.MaxPollInterval = DefaultMaxPollInterval
+	}
+	if cfg.MaxPollInterval < cfg.MinPollInterval {
+		return nil, fmt.Errorf("max poll interval less than min poll interval")
+	}
 
-	client := NewClient(cfg.Local)
+	client, err := NewClientWithOptions(cfg.AWS, cfg.Local)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Source{
-		cloudwatchlogs: client,
-		initial:        true,
+		cloudwatchlogs:  client,
+		initial:         true,
+		follow:          cfg.Follow,
+		minPollInterval: cfg.MinPollInterval,
+		maxPollInterval: cfg.MaxPollInterval,
+		pollInterval:    cfg.MinPollInterval,
+		done:            make(chan struct{}),
 		GetLogEventsInput: cloudwatchlogs.GetLogEventsInput{
-			EndTime:       nil,
+			EndTime:       cfg.EndTime,
 			Limit:         cfg.Limit,
 			LogGroupName:  aws.String(cfg.LogGroupName),
 			LogStreamName: aws.String(cfg.LogStreamName),
@@ -96,17 +173,17 @@ func NewSink(cfg SinkConfig) (*Sink, error) {
 	if cfg.LogStreamName == "" {
 		return nil, fmt.Errorf("log stream name cannot be empty")
 	}
-	endpoint := ""
-	if cfg.Local {
-		endpoint = LocalEndpoint
+	cloudwatchlogs, err := NewClientWithOptions(cfg.AWS, cfg.Local)
+	if err != nil {
+		return nil, err
 	}
-	awsCfg := awsutil.GetDefaultConfig(endpoint)
-	cloudwatchlogs := cloudwatchlogs.New(session.New(), awsCfg)
 
 	return &Sink{
 		LogGroupName:   cfg.LogGroupName,
 		LogStreamName:  cfg.LogStreamName,
 		cloudwatchlogs: cloudwatchlogs,
+		timestampFn:    cfg.TimestampFn,
+		createMissing:  cfg.CreateMissing,
 	}, nil
 }
 
@@ -159,20 +236,50 @@ func (source *Source) hasBufferedEvents() bool {
 	return source.bufferedEvents != nil && len(source.bufferedEvents) > 0
 }
 
-//DrawOne draws one event from the source
+/*
+DrawOne draws one event from the source.
+
+The end of the stream is reached when GetLogEvents returns the same
+NextForwardToken it was called with. At the end, returns ErrCloudwatchEnd,
+or in follow mode waits and polls again. The wait backs off towards
+MaxPollInterval while the stream is idle, and shortens towards
+MinPollInterval while it is busy.
+*/
 func (source *Source) DrawOne() (*types.Event, error) {
 	logger := logging.Logger()
 
-	if !source.hasBufferedEvents() {
+	for !source.hasBufferedEvents() {
+		initial := source.initial
+		prevToken := source.nextToken
+
 		if err := source.fetchFromClient(); err != nil {
 			return nil, err
 		}
 		logger.Debug("cloudwatch.DrawOne: fetched successfully")
-	}
 
-	if !source.hasBufferedEvents() {
-		logger.Debug("cloudwatch.DrawOne: no buffered events after fetch")
-		return nil, errors.ErrCloudwatchEnd
+		if source.hasBufferedEvents() {
+			source.adjustPollInterval(true)
+			break
+		}
+
+		//empty pages with a new token can be followed by more events
+		atEnd := !initial && aws.StringValue(prevToken) == aws.StringValue(source.nextToken)
+		if !atEnd {
+			continue
+		}
+
+		if !source.follow {
+			logger.Debug("cloudwatch.DrawOne: end of stream")
+			return nil, errors.ErrCloudwatchEnd
+		}
+
+		logger.Debug("cloudwatch.DrawOne: waiting at end of stream", zap.Duration("interval", source.pollInterval))
+		select {
+		case <-source.done:
+			return nil, errors.ErrSourceClosed
+		case <-time.After(source.pollInterval):
+		}
+		source.adjustPollInterval(false)
 	}
 
 	awsEvt := source.advance()
@@ -180,8 +287,28 @@ func (source *Source) DrawOne() (*types.Event, error) {
 	return &evt, nil
 }
 
-//Close does nothing but implements interface
+//adjustPollInterval halves poll interval when busy, and doubles it when idle
+func (source *Source) adjustPollInterval(busy bool) {
+	if busy {
+		source.pollInterval /= 2
+		if source.pollInterval < source.minPollInterval {
+			source.pollInterval = source.minPollInterval
+		}
+	} else {
+		source.pollInterval *= 2
+		if source.pollInterval > source.maxPollInterval {
+			source.pollInterval = source.maxPollInterval
+		}
+	}
+}
+
+//Close stops the source. In follow mode, a DrawOne waiting to poll returns ErrSourceClosed.
 func (source *Source) Close() error {
+	select {
+	case <-source.done:
+	default:
+		close(source.done)
+	}
 	return nil
 }
 
@@ -192,42 +319,241 @@ func (source *Source) Client() *cloudwatchlogs.CloudWatchLogs {
 
 //* SINK **/
 
-//Drain sends events to sink
+/*
+Drain sends events to the log stream using PutLogEvents.
+
+Events are sorted by timestamp, and split into as many calls as
+PutLogEvents limits require. Sequence tokens are tracked between calls,
+and refreshed when the stream reports they are invalid.
+
+Events rejected for being too old, too new or expired have errors at
+their index.
+*/
 func (sink *Sink) Drain(events []types.Event) []error {
-	inputLogEvents := []*cloudwatchlogs.InputLogEvent{}
 	logger := logging.Logger()
-	errs := []error{}
-	nEvents := 0
-
-	for _, evt := range events {
-		nEvents++
-		inputLogEvents = append(inputLogEvents, &cloudwatchlogs.InputLogEvent{
-			Message:   aws.String(evt.String()),
-			Timestamp: aws.Int64(timeutil.UnixMillis()),
+	errs := make([]error, len(events))
+	failed := false
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	entries := []logEntry{}
+	now := time.Now()
+	for i := range events {
+		ts := now
+		if sink.timestampFn != nil {
+			var err error
+			if ts, err = sink.timestampFn(&events[i]); err != nil {
+				errs[i] = err
+				failed = true
+				continue
+			}
+		}
+		msg := events[i].String()
+		if len(msg)+EventOverheadBytes > MaxEventBytes {
+			errs[i] = fmt.Errorf("event of %d bytes exceeds max of %d", len(msg), MaxEventBytes-EventOverheadBytes)
+			failed = true
+			continue
+		}
+		entries = append(entries, logEntry{
+			index: i,
+			event: &cloudwatchlogs.InputLogEvent{
+				Message:   aws.String(msg),
+				Timestamp: aws.Int64(ts.UnixNano() / int64(time.Millisecond)),
+			},
 		})
 	}
 
-	input := cloudwatchlogs.PutLogEventsInput{
-		LogEvents:     inputLogEvents,
+	//PutLogEvents requires events in chronological order
+	sort.SliceStable(entries, func(i, j int) bool {
+		return *entries[i].event.Timestamp < *entries[j].event.Timestamp
+	})
+
+	for _, batch := range split(entries) {
+		logger.Debug("cloudwatch.Drain: draining",
+			zap.String("logGroupName", sink.LogGroupName),
+			zap.String("logStreamName", sink.LogStreamName),
+			zap.Int("nEvents", len(batch)))
+
+		for j, err := range sink.put(batch) {
+			if err != nil {
+				errs[batch[j].index] = err
+				failed = true
+			}
+		}
+	}
+
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+//split splits sorted entries into batches that fit PutLogEvents limits
+func split(entries []logEntry) [][]logEntry {
+	batches := [][]logEntry{}
+	batch := []logEntry{}
+	size := 0
+
+	for _, entry := range entries {
+		n := len(*entry.event.Message) + EventOverheadBytes
+		if len(batch) > 0 &&
+			(len(batch) == MaxBatchEvents ||
+				size+n > MaxBatchBytes ||
+				*entry.event.Timestamp-*batch[0].event.Timestamp > int64(MaxBatchSpan/time.Millisecond)) {
+			batches = append(batches, batch)
+			batch = []logEntry{}
+			size = 0
+		}
+		batch = append(batch, entry)
+		size += n
+	}
+
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+//put puts one batch of events, returns errors at batch indices
+func (sink *Sink) put(batch []logEntry) []error {
+	logger := logging.Logger()
+	errs := make([]error, len(batch))
+
+	inputLogEvents := []*cloudwatchlogs.InputLogEvent{}
+	for _, entry := range batch {
+		inputLogEvents = append(inputLogEvents, entry.event)
+	}
+
+	var err error
+	for attempt := 0; attempt < maxPutAttempts; attempt++ {
+		var output *cloudwatchlogs.PutLogEventsOutput
+		output, err = sink.cloudwatchlogs.PutLogEvents(&cloudwatchlogs.PutLogEventsInput{
+			LogEvents:     inputLogEvents,
+			LogGroupName:  aws.String(sink.LogGroupName),
+			LogStreamName: aws.String(sink.LogStreamName),
+			SequenceToken: sink.sequenceToken,
+		})
+
+		if err == nil {
+			sink.sequenceToken = output.NextSequenceToken
+			rejected(output.RejectedLogEventsInfo, errs)
+			return errs
+		}
+
+		awsErr, ok := err.(awserr.Error)
+		if !ok {
+			break
+		}
+
+		switch awsErr.Code() {
+		case cloudwatchlogs.ErrCodeInvalidSequenceTokenException:
+			logger.Debug("cloudwatch.Drain: invalid sequence token, refreshing")
+			if err = sink.refreshSequenceToken(); err != nil {
+				return fill(errs, err)
+			}
+		case cloudwatchlogs.ErrCodeDataAlreadyAcceptedException:
+			//batch was accepted by an earlier attempt, so it's not an error
+			logger.Debug("cloudwatch.Drain: data already accepted")
+			if err = sink.refreshSequenceToken(); err != nil {
+				logger.Debug("cloudwatch.Drain: couldn't refresh sequence token", zap.Error(err))
+			}
+			return errs
+		case cloudwatchlogs.ErrCodeResourceNotFoundException:
+			if !sink.createMissing {
+				return fill(errs, err)
+			}
+			logger.Debug("cloudwatch.Drain: creating missing log group and stream")
+			if err = sink.create(); err != nil {
+				return fill(errs, err)
+			}
+			sink.sequenceToken = nil
+		default:
+			return fill(errs, err)
+		}
+	}
+
+	logger.Debug("cloudwatch.Drain: error when putting events", zap.Error(err))
+	return fill(errs, err)
+}
+
+//refreshSequenceToken reads upload sequence token of the log stream
+func (sink *Sink) refreshSequenceToken() error {
+	input := &cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        aws.String(sink.LogGroupName),
+		LogStreamNamePrefix: aws.String(sink.LogStreamName),
+	}
+
+	var token *string
+	found := false
+	err := sink.cloudwatchlogs.DescribeLogStreamsPages(input, func(out *cloudwatchlogs.DescribeLogStreamsOutput, last bool) bool {
+		for _, stream := range out.LogStreams {
+			if aws.StringValue(stream.LogStreamName) == sink.LogStreamName {
+				token = stream.UploadSequenceToken
+				found = true
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("log stream %s not found", sink.LogStreamName)
+	}
+
+	sink.sequenceToken = token
+	return nil
+}
+
+//create creates log group and stream, ignoring if they already exist
+func (sink *Sink) create() error {
+	_, err := sink.cloudwatchlogs.CreateLogGroup(&cloudwatchlogs.CreateLogGroupInput{
+		LogGroupName: aws.String(sink.LogGroupName),
+	})
+	if err != nil && !isAlreadyExists(err) {
+		return err
+	}
+
+	_, err = sink.cloudwatchlogs.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
 		LogGroupName:  aws.String(sink.LogGroupName),
 		LogStreamName: aws.String(sink.LogStreamName),
+	})
+	if err != nil && !isAlreadyExists(err) {
+		return err
 	}
 
-	logger.Debug("cloudwatch.Drain: draining",
-		zap.String("logGroupName", sink.LogGroupName),
-		zap.String("logStreamName", sink.LogStreamName),
-		zap.Int("nEvents", nEvents))
+	return nil
+}
 
-	_, err := sink.cloudwatchlogs.PutLogEvents(&input)
+//isAlreadyExists true iff error is because resource exists
+func isAlreadyExists(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == cloudwatchlogs.ErrCodeResourceAlreadyExistsException
+}
 
-	if err != nil {
-		logger.Debug("cloudwatch.Drain: error when putting events", zap.Error(err))
-		for i := 0; i < nEvents; i++ {
-			errs = append(errs, err)
+//rejected sets errors for events rejected by PutLogEvents
+func rejected(info *cloudwatchlogs.RejectedLogEventsInfo, errs []error) {
+	if info == nil {
+		return
+	}
+	for i := range errs {
+		switch {
+		case info.TooOldLogEventEndIndex != nil && int64(i) < *info.TooOldLogEventEndIndex:
+			errs[i] = errors.ErrCloudwatchTooOld
+		case info.ExpiredLogEventEndIndex != nil && int64(i) < *info.ExpiredLogEventEndIndex:
+			errs[i] = errors.ErrCloudwatchExpired
+		case info.TooNewLogEventStartIndex != nil && int64(i) >= *info.TooNewLogEventStartIndex:
+			errs[i] = errors.ErrCloudwatchTooNew
 		}
-	} else {
-		errs = nil
 	}
+}
 
+//fill sets all errors to err
+func fill(errs []error, err error) []error {
+	for i := range errs {
+		errs[i] = err
+	}
 	return errs
 }
@@ -4,12 +4,16 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"encoding/json"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/underscorenygren/partaj/internal"
 	"github.com/underscorenygren/partaj/internal/logging"
 	"github.com/underscorenygren/partaj/pkg/cloudwatch"
+	"github.com/underscorenygren/partaj/pkg/errors"
 	"github.com/underscorenygren/partaj/pkg/types"
 	"net/http"
+	"time"
 )
 
 //examples on how to use cloudwatch
@@ -132,4 +136,166 @@ var _ = Describe("Cloudwatch", func() {
 		//evt, err = source.DrawOne()
 		//Expect(err).ToNot(BeNil())
 	})
+
+	It("sorts events by timestamp", func() {
+		now := time.Now()
+		offsets := map[string]time.Duration{"one": 0, "two": time.Second, "three": 2 * time.Second}
+		sorted, err := cloudwatch.NewSink(cloudwatch.SinkConfig{
+			LogGroupName:  logGroupName,
+			LogStreamName: logStreamName,
+			Local:         true,
+			TimestampFn: func(e *types.Event) (time.Time, error) {
+				return now.Add(offsets[e.String()]), nil
+			},
+		})
+		Expect(err).To(BeNil())
+
+		events := internal.StringsToEvents([]string{"three", "one", "two"})
+		Expect(sorted.Drain(events)).To(BeNil())
+
+		for _, ref := range internal.StringsToEvents([]string{"one", "two", "three"}) {
+			evt, err := source.DrawOne()
+			Expect(err).To(BeNil())
+			Expect(evt.IsEqual(&ref)).To(BeTrue())
+		}
+	})
+
+	It("creates missing log group and stream", func() {
+		missingGroup := "test-missing-group"
+		created, err := cloudwatch.NewSink(cloudwatch.SinkConfig{
+			LogGroupName:  missingGroup,
+			LogStreamName: logStreamName,
+			Local:         true,
+			CreateMissing: true,
+		})
+		Expect(err).To(BeNil())
+
+		Expect(created.Drain(internal.StringsToEvents([]string{"one"}))).To(BeNil())
+
+		_, err = source.Client().DeleteLogGroup(&cloudwatchlogs.DeleteLogGroupInput{
+			LogGroupName: aws.String(missingGroup),
+		})
+		Expect(err).To(BeNil())
+	})
+
+	It("reads all streams of a log group", func() {
+		otherStreamName := "test-other-stream"
+		other, err := cloudwatch.NewSink(cloudwatch.SinkConfig{
+			LogGroupName:  logGroupName,
+			LogStreamName: otherStreamName,
+			Local:         true,
+			CreateMissing: true,
+		})
+		Expect(err).To(BeNil())
+
+		Expect(sink.Drain(internal.StringsToEvents([]string{"one"}))).To(BeNil())
+		Expect(other.Drain(internal.StringsToEvents([]string{"two"}))).To(BeNil())
+
+		group, err := cloudwatch.NewGroupSource(cloudwatch.GroupSourceConfig{
+			LogGroupName:        logGroupName,
+			LogStreamNamePrefix: "test-",
+			Local:               true,
+		})
+		Expect(err).To(BeNil())
+
+		streams := map[string]string{}
+		for i := 0; i < 2; i++ {
+			evt, err := group.DrawOne()
+			Expect(err).To(BeNil())
+			read := struct {
+				LogStreamName string `json:"logStreamName"`
+				EventID       string `json:"eventId"`
+				Message       string `json:"message"`
+			}{}
+			Expect(json.Unmarshal(evt.Bytes(), &read)).To(BeNil())
+			Expect(read.EventID).ToNot(Equal(""))
+			streams[read.LogStreamName] = read.Message
+		}
+		Expect(streams).To(Equal(map[string]string{
+			logStreamName:   "one",
+			otherStreamName: "two",
+		}))
+		Expect(group.Close()).To(BeNil())
+
+		_, err = source.Client().DeleteLogStream(&cloudwatchlogs.DeleteLogStreamInput{
+			LogGroupName:  aws.String(logGroupName),
+			LogStreamName: aws.String(otherStreamName),
+		})
+		Expect(err).To(BeNil())
+	})
+
+	It("reads a bounded time range and stops", func() {
+		now := time.Now()
+		offsets := map[string]time.Duration{"one": 0, "two": time.Second, "three": 2 * time.Second}
+		timed, err := cloudwatch.NewSink(cloudwatch.SinkConfig{
+			LogGroupName:  logGroupName,
+			LogStreamName: logStreamName,
+			Local:         true,
+			TimestampFn: func(e *types.Event) (time.Time, error) {
+				return now.Add(offsets[e.String()]), nil
+			},
+		})
+		Expect(err).To(BeNil())
+		Expect(timed.Drain(internal.StringsToEvents([]string{"one", "two", "three"}))).To(BeNil())
+
+		millis := func(t time.Time) *int64 {
+			return aws.Int64(t.UnixNano() / int64(time.Millisecond))
+		}
+		bounded, err := cloudwatch.NewSource(cloudwatch.SourceConfig{
+			LogGroupName:  logGroupName,
+			LogStreamName: logStreamName,
+			StartTime:     millis(now.Add(offsets["two"])),
+			EndTime:       millis(now.Add(offsets["three"])),
+			Local:         true,
+		})
+		Expect(err).To(BeNil())
+
+		evt, err := bounded.DrawOne()
+		Expect(err).To(BeNil())
+		Expect(evt.String()).To(Equal("two"))
+
+		_, err = bounded.DrawOne()
+		Expect(err).To(Equal(errors.ErrCloudwatchEnd))
+	})
+
+	It("follows a stream until closed", func(done Done) {
+		follower, err := cloudwatch.NewSource(cloudwatch.SourceConfig{
+			LogGroupName:    logGroupName,
+			LogStreamName:   logStreamName,
+			Follow:          true,
+			MinPollInterval: 10 * time.Millisecond,
+			MaxPollInterval: 50 * time.Millisecond,
+			Local:           true,
+		})
+		Expect(err).To(BeNil())
+
+		go func() {
+			defer GinkgoRecover()
+			time.Sleep(100 * time.Millisecond)
+			Expect(sink.Drain(internal.StringsToEvents([]string{"one"}))).To(BeNil())
+		}()
+
+		evt, err := follower.DrawOne()
+		Expect(err).To(BeNil())
+		Expect(evt.String()).To(Equal("one"))
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			follower.Close()
+		}()
+		_, err = follower.DrawOne()
+		Expect(err).To(Equal(errors.ErrSourceClosed))
+
+		close(done)
+	}, 5)
+
+	It("can't follow with an end time", func() {
+		_, err := cloudwatch.NewSource(cloudwatch.SourceConfig{
+			LogGroupName:  logGroupName,
+			LogStreamName: logStreamName,
+			EndTime:       aws.Int64(0),
+			Follow:        true,
+		})
+		Expect(err).ToNot(BeNil())
+	})
 })
@@ -0,0 +1,245 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/awsconfig"
+	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"github.com/valyala/fastjson"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+const (
+	//DefaultPollInterval is how long GroupSource waits after a polling window with no new events.
+	DefaultPollInterval = 1 * time.Second
+)
+
+//GroupEventMakerFn is the function signature for making an event from a filtered log event.
+type GroupEventMakerFn func(*cloudwatchlogs.FilteredLogEvent) (*types.Event, error)
+
+/*
+GroupSource implements Source interface for all streams of a cloudwatch log group,
+using FilterLogEvents.
+
+Follows the log group, by polling for events newer than the latest seen event.
+Events seen in earlier polling windows are not drawn again.
+*/
+type GroupSource struct {
+	cfg            GroupSourceConfig
+	cloudwatchlogs *cloudwatchlogs.CloudWatchLogs //client for interacting with API
+	startTime      *int64                         //start of current polling window
+	latest         int64                          //timestamp of latest seen event
+	seen           map[string]int64               //timestamps of seen events, by event id
+	nextToken      *string
+	inWindow       bool //true while paging through a polling window
+	polled         bool //true after first polling window
+	nNew           int  //new events in current polling window
+	bufferedEvents []*cloudwatchlogs.FilteredLogEvent
+	done           chan struct{}
+}
+
+//GroupSourceConfig the input arguments for a new GroupSource
+type GroupSourceConfig struct {
+	LogGroupName        string
+	LogStreamNamePrefix string             //only read streams with this prefix
+	LogStreamNames      []string           //only read these streams, can't be combined with LogStreamNamePrefix
+	FilterPattern       string             //server side filter, see cloudwatch filter and pattern syntax
+	StartTime           *int64             //unix millis to start reading from, defaults to the start of the log group
+	Limit               *int64             //max events per FilterLogEvents call
+	PollInterval        time.Duration      //wait after a polling window with no new events, defaults to DefaultPollInterval
+	Lookback            time.Duration      //overlap between polling windows, to catch events ingested late
+	EventMaker          GroupEventMakerFn  //how to make events, defaults to DefaultGroupEventMaker
+	Local               bool               //when set to true, will configure client to make requests to the local endpoint.
+	AWS                 *awsconfig.Options //aws session options, e.g. region, credentials and retries. Defaults to the environment
+}
+
+//implements interfaces
+var _ types.Source = &GroupSource{}
+
+/*
+DefaultGroupEventMaker implements GroupEventMakerFn, and makes a json
+event with the log stream name and event id attached to the message:
+
+	{"logStreamName":"...","eventId":"...","timestamp":1571300000000,"message":"..."}
+*/
+func DefaultGroupEventMaker(e *cloudwatchlogs.FilteredLogEvent) (*types.Event, error) {
+	arena := &fastjson.Arena{}
+	obj := arena.NewObject()
+	obj.Set("logStreamName", arena.NewString(aws.StringValue(e.LogStreamName)))
+	obj.Set("eventId", arena.NewString(aws.StringValue(e.EventId)))
+	obj.Set("timestamp", arena.NewNumberString(strconv.FormatInt(aws.Int64Value(e.Timestamp), 10)))
+	obj.Set("message", arena.NewString(aws.StringValue(e.Message)))
+
+	evt := types.NewEventFromBytes(obj.MarshalTo(nil))
+	return &evt, nil
+}
+
+//MessageEventMaker implements GroupEventMakerFn, and makes an event of just the log message.
+func MessageEventMaker(e *cloudwatchlogs.FilteredLogEvent) (*types.Event, error) {
+	evt := types.NewEventFromBytes([]byte(aws.StringValue(e.Message)))
+	return &evt, nil
+}
+
+//NewGroupSource constructs a cloudwatch GroupSource
+func NewGroupSource(cfg GroupSourceConfig) (*GroupSource, error) {
+	if cfg.LogGroupName == "" {
+		return nil, fmt.Errorf("No log group name provided")
+	}
+	if cfg.LogStreamNamePrefix != "" && len(cfg.LogStreamNames) > 0 {
+		return nil, fmt.Errorf("can't use both log stream name prefix and names")
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+	if cfg.EventMaker == nil {
+		cfg.EventMaker = DefaultGroupEventMaker
+	}
+
+	client, err := NewClientWithOptions(cfg.AWS, cfg.Local)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GroupSource{
+		cfg:            cfg,
+		cloudwatchlogs: client,
+		startTime:      cfg.StartTime,
+		seen:           map[string]int64{},
+		done:           make(chan struct{}),
+	}, nil
+}
+
+//Client returns underlying cloudwatchlogs client
+func (source *GroupSource) Client() *cloudwatchlogs.CloudWatchLogs {
+	return source.cloudwatchlogs
+}
+
+//DrawOne draws one event from the log group, blocking until one is available.
+func (source *GroupSource) DrawOne() (*types.Event, error) {
+	logger := logging.Logger()
+
+	for {
+		for len(source.bufferedEvents) > 0 {
+			e := source.bufferedEvents[0]
+			source.bufferedEvents = source.bufferedEvents[1:]
+
+			id := aws.StringValue(e.EventId)
+			if _, ok := source.seen[id]; ok {
+				logger.Debug("cloudwatch.GroupSource: duplicate event", zap.String("eventId", id))
+				continue
+			}
+			ts := aws.Int64Value(e.Timestamp)
+			source.seen[id] = ts
+			if ts > source.latest {
+				source.latest = ts
+			}
+			source.nNew++
+
+			return source.cfg.EventMaker(e)
+		}
+
+		if !source.inWindow {
+			if err := source.nextWindow(); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := source.fetch(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+//Close stops the source. Any DrawOne waiting to poll returns ErrSourceClosed.
+func (source *GroupSource) Close() error {
+	select {
+	case <-source.done:
+	default:
+		close(source.done)
+	}
+	return nil
+}
+
+//nextWindow starts a new polling window from the latest seen event,
+//waiting first if the last window had no new events
+func (source *GroupSource) nextWindow() error {
+	logger := logging.Logger()
+
+	if source.polled {
+		if source.nNew == 0 {
+			logger.Debug("cloudwatch.GroupSource: no new events, waiting", zap.Duration("interval", source.cfg.PollInterval))
+			select {
+			case <-source.done:
+				return errors.ErrSourceClosed
+			case <-time.After(source.cfg.PollInterval):
+			}
+		}
+
+		if source.latest > 0 {
+			start := source.latest - int64(source.cfg.Lookback/time.Millisecond)
+			if source.startTime == nil || start > *source.startTime {
+				source.startTime = aws.Int64(start)
+			}
+		}
+
+		//events before the window can't be returned again
+		if source.startTime != nil {
+			for id, ts := range source.seen {
+				if ts < *source.startTime {
+					delete(source.seen, id)
+				}
+			}
+		}
+	}
+
+	logger.Debug("cloudwatch.GroupSource: new window", zap.Int64p("startTime", source.startTime))
+	source.polled = true
+	source.inWindow = true
+	source.nNew = 0
+	source.nextToken = nil
+	return nil
+}
+
+//fetch buffers one page of the current polling window
+func (source *GroupSource) fetch() error {
+	logger := logging.Logger()
+
+	input := &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName: aws.String(source.cfg.LogGroupName),
+		StartTime:    source.startTime,
+		Limit:        source.cfg.Limit,
+		NextToken:    source.nextToken,
+	}
+	if source.cfg.LogStreamNamePrefix != "" {
+		input.LogStreamNamePrefix = aws.String(source.cfg.LogStreamNamePrefix)
+	}
+	if len(source.cfg.LogStreamNames) > 0 {
+		input.LogStreamNames = aws.StringSlice(source.cfg.LogStreamNames)
+	}
+	if source.cfg.FilterPattern != "" {
+		input.FilterPattern = aws.String(source.cfg.FilterPattern)
+	}
+
+	output, err := source.cloudwatchlogs.FilterLogEvents(input)
+	if err != nil {
+		logger.Debug("cloudwatch.GroupSource: filter events failed", zap.Error(err))
+		return err
+	}
+
+	source.bufferedEvents = output.Events
+	source.nextToken = output.NextToken
+	if source.nextToken == nil {
+		source.inWindow = false
+	}
+
+	logger.Debug("cloudwatch.GroupSource: fetched",
+		zap.Int("n", len(output.Events)),
+		zap.Stringp("nextToken", output.NextToken))
+
+	return nil
+}
@@ -10,6 +10,9 @@ import (
 //ErrSourceClosed is returned when you try to put to a closed programmatic Source.
 var ErrSourceClosed = fmt.Errorf("SourceClosed")
 
+//ErrSinkClosed is returned for events drained to a closed Sink.
+var ErrSinkClosed = fmt.Errorf("SinkClosed")
+
 //ErrChannelBroken is returned when a programmatic Source can't send to its internal channel.
 var ErrChannelBroken = fmt.Errorf("ChannelBroken")
 
@@ -22,9 +25,27 @@ var ErrPutFailure = fmt.Errorf("ErrPutFailure")
 //ErrCloudwatchEnd is returned when no more entries are available from cloudwatch source
 var ErrCloudwatchEnd = fmt.Errorf("ErrCloudwatchEnd")
 
+//ErrCloudwatchTooOld is returned for events rejected by cloudwatch sink for being too old
+var ErrCloudwatchTooOld = fmt.Errorf("ErrCloudwatchTooOld")
+
+//ErrCloudwatchTooNew is returned for events rejected by cloudwatch sink for being too new
+var ErrCloudwatchTooNew = fmt.Errorf("ErrCloudwatchTooNew")
+
+//ErrCloudwatchExpired is returned for events rejected by cloudwatch sink for being older than retention
+var ErrCloudwatchExpired = fmt.Errorf("ErrCloudwatchExpired")
+
 //ErrSQLEnd is returned when no more entries are available from cloudwatch source
 var ErrSQLEnd = fmt.Errorf("ErrSQLEnd")
 
+//ErrKinesisEnd is returned when all shards of a kinesis stream have been closed and read
+var ErrKinesisEnd = fmt.Errorf("ErrKinesisEnd")
+
+//ErrS3End is returned when all objects of an s3 source have been read
+var ErrS3End = fmt.Errorf("ErrS3End")
+
+//ErrJSONPathNotFound is returned when there's no value at a json path
+var ErrJSONPathNotFound = fmt.Errorf("ErrJSONPathNotFound")
+
 //ErrNilSource error when passing nil source to constructors requiring them
 var ErrNilSource = fmt.Errorf("source cannot be nil")
 
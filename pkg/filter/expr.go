@@ -0,0 +1,871 @@
+package filter
+
+import (
+	"fmt"
+	pkgjson "github.com/underscorenygren/partaj/pkg/json"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"github.com/valyala/fastjson"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+Expr is a compiled filter expression, that tests json events.
+
+	level != "debug" && latency_ms > 200 && has(user.id)
+	method in ["GET", "HEAD"] || path =~ "^/admin/"
+	!startsWith(lower(user.name), "bot")
+
+Fields are paths into the event, as parsed by json.ParsePath.
+Literals are strings, numbers, true, false, null and [lists].
+
+Operators, from lowest precedence:
+
+	||
+	&&
+	!
+	== != < <= > >= =~ !~ in, not in
+
+=~ and !~ match strings against regular expressions, which must be string literals.
+
+Functions:
+
+	has(field)              true if the event has a value at field
+	len(x)                  length of a string, list or object
+	lower(s), upper(s), trim(s)
+	contains(s, sub), startsWith(s, prefix), endsWith(s, suffix)
+
+Types of literals are checked when compiling, e.g. "a" > 1 fails.
+Fields can have any type, and comparisons of values with mismatched
+types are false. Fields used as conditions must be true.
+*/
+type Expr struct {
+	src  string
+	root node
+}
+
+//Compile compiles a filter expression.
+func Compile(src string) (*Expr, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{src: src, tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	if k := root.kind(); k != kindBool && k != kindAny {
+		return nil, fmt.Errorf("expression %q is %s, not a condition", src, k)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+//NewExprFn compiles a filter expression into an EventFilterFn, that
+//keeps events the expression is true for.
+func NewExprFn(src string) (EventFilterFn, error) {
+	expr, err := Compile(src)
+	if err != nil {
+		return nil, err
+	}
+	return expr.Filter, nil
+}
+
+//String returns the source of the expression.
+func (expr *Expr) String() string {
+	return expr.src
+}
+
+//Match returns true if the expression is true for a json event.
+func (expr *Expr) Match(e *types.Event) (bool, error) {
+	v, err := fastjson.ParseBytes(e.Bytes())
+	if err != nil {
+		return false, err
+	}
+	return expr.MatchValue(v), nil
+}
+
+//MatchValue returns true if the expression is true for a parsed json value.
+func (expr *Expr) MatchValue(v *fastjson.Value) bool {
+	return truthy(expr.root.eval(v))
+}
+
+//Filter implements EventFilterFn, keeping events the expression is true for.
+//Events that aren't json are errors.
+func (expr *Expr) Filter(e *types.Event) (*types.Event, error) {
+	ok, err := expr.Match(e)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ** TYPES ** //
+
+//kind is the type of a value
+type kind int
+
+const (
+	kindAny kind = iota //static type of fields
+	kindMissing
+	kindNull
+	kindBool
+	kindNumber
+	kindString
+	kindList
+	kindObject
+)
+
+//String names kinds in errors
+func (k kind) String() string {
+	return [...]string{"any", "missing", "null", "bool", "number", "string", "list", "object"}[k]
+}
+
+//value is a runtime value
+type value struct {
+	kind kind
+	b    bool
+	n    float64
+	s    string
+	list []value
+	json *fastjson.Value //original json of lists and objects from events
+}
+
+//fromJSON converts a json value
+func fromJSON(v *fastjson.Value) value {
+	if v == nil {
+		return value{kind: kindMissing}
+	}
+	switch v.Type() {
+	case fastjson.TypeNull:
+		return value{kind: kindNull}
+	case fastjson.TypeTrue:
+		return value{kind: kindBool, b: true}
+	case fastjson.TypeFalse:
+		return value{kind: kindBool}
+	case fastjson.TypeNumber:
+		return value{kind: kindNumber, n: v.GetFloat64()}
+	case fastjson.TypeString:
+		return value{kind: kindString, s: string(v.GetStringBytes())}
+	case fastjson.TypeArray:
+		arr := v.GetArray()
+		list := make([]value, len(arr))
+		for i, item := range arr {
+			list[i] = fromJSON(item)
+		}
+		return value{kind: kindList, list: list, json: v}
+	}
+	return value{kind: kindObject, json: v}
+}
+
+//truthy true iff v is the bool true
+func truthy(v value) bool {
+	return v.kind == kindBool && v.b
+}
+
+//equal true iff values are the same kind and equal
+func equal(a value, b value) bool {
+	if a.kind != b.kind {
+		return false
+	}
+	switch a.kind {
+	case kindBool:
+		return a.b == b.b
+	case kindNumber:
+		return a.n == b.n
+	case kindString:
+		return a.s == b.s
+	case kindList:
+		if len(a.list) != len(b.list) {
+			return false
+		}
+		for i := range a.list {
+			if !equal(a.list[i], b.list[i]) {
+				return false
+			}
+		}
+		return true
+	case kindObject:
+		return string(a.json.MarshalTo(nil)) == string(b.json.MarshalTo(nil))
+	}
+	return true
+}
+
+// ** NODES ** //
+
+//node is a compiled expression
+type node interface {
+	kind() kind //static type, kindAny when only known at runtime
+	eval(v *fastjson.Value) value
+}
+
+type literal struct{ v value }
+
+func (n literal) kind() kind                 { return n.v.kind }
+func (n literal) eval(*fastjson.Value) value { return n.v }
+
+type field struct{ path pkgjson.Path }
+
+func (n field) kind() kind { return kindAny }
+func (n field) eval(v *fastjson.Value) value {
+	found, _ := n.path.Get(v)
+	return fromJSON(found)
+}
+
+type list struct{ items []node }
+
+func (n list) kind() kind { return kindList }
+func (n list) eval(v *fastjson.Value) value {
+	items := make([]value, len(n.items))
+	for i, item := range n.items {
+		items[i] = item.eval(v)
+	}
+	return value{kind: kindList, list: items}
+}
+
+type logical struct {
+	and         bool
+	left, right node
+}
+
+func (n logical) kind() kind { return kindBool }
+func (n logical) eval(v *fastjson.Value) value {
+	left := truthy(n.left.eval(v))
+	if n.and != left {
+		return value{kind: kindBool, b: left}
+	}
+	return value{kind: kindBool, b: truthy(n.right.eval(v))}
+}
+
+type not struct{ operand node }
+
+func (n not) kind() kind { return kindBool }
+func (n not) eval(v *fastjson.Value) value {
+	return value{kind: kindBool, b: !truthy(n.operand.eval(v))}
+}
+
+type compare struct {
+	op          string
+	left, right node
+}
+
+func (n compare) kind() kind { return kindBool }
+func (n compare) eval(v *fastjson.Value) value {
+	left, right := n.left.eval(v), n.right.eval(v)
+	res := false
+	switch n.op {
+	case "==":
+		res = equal(left, right)
+	case "!=":
+		res = !equal(left, right)
+	default:
+		if left.kind == kindNumber && right.kind == kindNumber {
+			res = ordered(n.op, compareFloats(left.n, right.n))
+		} else if left.kind == kindString && right.kind == kindString {
+			res = ordered(n.op, strings.Compare(left.s, right.s))
+		}
+	}
+	return value{kind: kindBool, b: res}
+}
+
+//ordered applies an ordering operator to a comparison result
+func ordered(op string, c int) bool {
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+//compareFloats compares a and b like strings.Compare
+func compareFloats(a float64, b float64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+type match struct {
+	negate  bool
+	operand node
+	re      *regexp.Regexp
+}
+
+func (n match) kind() kind { return kindBool }
+func (n match) eval(v *fastjson.Value) value {
+	operand := n.operand.eval(v)
+	if operand.kind != kindString {
+		return value{kind: kindBool}
+	}
+	return value{kind: kindBool, b: n.re.MatchString(operand.s) != n.negate}
+}
+
+type in struct {
+	negate      bool
+	left, right node
+}
+
+func (n in) kind() kind { return kindBool }
+func (n in) eval(v *fastjson.Value) value {
+	left, right := n.left.eval(v), n.right.eval(v)
+	if right.kind != kindList || left.kind == kindMissing {
+		return value{kind: kindBool}
+	}
+	for _, item := range right.list {
+		if equal(left, item) {
+			return value{kind: kindBool, b: !n.negate}
+		}
+	}
+	return value{kind: kindBool, b: n.negate}
+}
+
+type call struct {
+	fn   *function
+	args []node
+}
+
+func (n call) kind() kind { return n.fn.result }
+func (n call) eval(v *fastjson.Value) value {
+	args := make([]value, len(n.args))
+	for i, arg := range n.args {
+		args[i] = arg.eval(v)
+	}
+	return n.fn.eval(args)
+}
+
+//has is a call of has(), which needs the field path instead of its value
+type has struct{ path pkgjson.Path }
+
+func (n has) kind() kind { return kindBool }
+func (n has) eval(v *fastjson.Value) value {
+	_, err := n.path.Get(v)
+	return value{kind: kindBool, b: err == nil}
+}
+
+// ** FUNCTIONS ** //
+
+//function is a builtin function. Results are null when arguments have the wrong type at runtime.
+type function struct {
+	args   []kind
+	result kind
+	eval   func(args []value) value
+}
+
+//stringFn makes a function of one string
+func stringFn(fn func(string) string) *function {
+	return &function{
+		args:   []kind{kindString},
+		result: kindString,
+		eval: func(args []value) value {
+			if args[0].kind != kindString {
+				return value{kind: kindNull}
+			}
+			return value{kind: kindString, s: fn(args[0].s)}
+		},
+	}
+}
+
+//predicateFn makes a function of two strings
+func predicateFn(fn func(string, string) bool) *function {
+	return &function{
+		args:   []kind{kindString, kindString},
+		result: kindBool,
+		eval: func(args []value) value {
+			if args[0].kind != kindString || args[1].kind != kindString {
+				return value{kind: kindBool}
+			}
+			return value{kind: kindBool, b: fn(args[0].s, args[1].s)}
+		},
+	}
+}
+
+var functions = map[string]*function{
+	"lower":      stringFn(strings.ToLower),
+	"upper":      stringFn(strings.ToUpper),
+	"trim":       stringFn(strings.TrimSpace),
+	"contains":   predicateFn(strings.Contains),
+	"startsWith": predicateFn(strings.HasPrefix),
+	"endsWith":   predicateFn(strings.HasSuffix),
+	"len": {
+		args:   []kind{kindAny},
+		result: kindNumber,
+		eval: func(args []value) value {
+			switch args[0].kind {
+			case kindString:
+				return value{kind: kindNumber, n: float64(utf8.RuneCountInString(args[0].s))}
+			case kindList:
+				return value{kind: kindNumber, n: float64(len(args[0].list))}
+			case kindObject:
+				return value{kind: kindNumber, n: float64(args[0].json.GetObject().Len())}
+			}
+			return value{kind: kindNull}
+		},
+	},
+}
+
+// ** LEXER ** //
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokOp
+	tokString
+	tokNumber
+	tokPath
+)
+
+type token struct {
+	kind tokenKind
+	text string  //operator or path text
+	s    string  //unquoted string
+	n    float64 //parsed number
+	pos  int
+}
+
+//String describes tokens in errors
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+//operators, longest first
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "(", ")", "[", "]", ",", "-"}
+
+//lex splits an expression into tokens
+func lex(src string) ([]token, error) {
+	tokens := []token{}
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			s, end, err := lexString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokString, text: src[i:end], s: s, pos: i})
+			i = end
+		case c >= '0' && c <= '9':
+			end := i
+			for end < len(src) && strings.IndexByte("0123456789.eE", src[end]) >= 0 {
+				if (src[end] == 'e' || src[end] == 'E') && end+1 < len(src) && (src[end+1] == '-' || src[end+1] == '+') {
+					end++
+				}
+				end++
+			}
+			n, err := strconv.ParseFloat(src[i:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("expression %q: invalid number %q at %d", src, src[i:end], i)
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[i:end], n: n, pos: i})
+			i = end
+		case isIdentStart(c):
+			end, err := lexPath(src, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokPath, text: src[i:end], pos: i})
+			i = end
+		default:
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("expression %q: unexpected %q at %d", src, c, i)
+			}
+			tokens = append(tokens, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+//lexString reads a quoted string starting at start
+func lexString(src string, start int) (string, int, error) {
+	quote := src[start]
+	var b strings.Builder
+	for i := start + 1; i < len(src); i++ {
+		switch src[i] {
+		case quote:
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i >= len(src) {
+				break
+			}
+			switch src[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(src[i])
+			}
+		default:
+			b.WriteByte(src[i])
+		}
+	}
+	return "", 0, fmt.Errorf("expression %q: unterminated string at %d", src, start)
+}
+
+//lexPath reads a field path, including bracketed indices and keys
+func lexPath(src string, start int) (int, error) {
+	i := start
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case isIdentStart(c) || (c >= '0' && c <= '9') || c == '.':
+			i++
+		case c == '[':
+			//bracket keys may contain anything, including ]
+			if i+1 < len(src) && (src[i+1] == '"' || src[i+1] == '\'') {
+				_, end, err := lexString(src, i+1)
+				if err != nil {
+					return 0, err
+				}
+				i = end
+			} else {
+				i++
+				for i < len(src) && src[i] != ']' {
+					i++
+				}
+			}
+			if i >= len(src) || src[i] != ']' {
+				return 0, fmt.Errorf("expression %q: unterminated [ in field at %d", src, start)
+			}
+			i++
+		default:
+			return i, nil
+		}
+	}
+	return i, nil
+}
+
+//isIdentStart true iff c can start a field name
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '@' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// ** PARSER ** //
+
+type parser struct {
+	src    string
+	tokens []token
+	i      int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+//isOp true iff t is operator or keyword op
+func (t token) isOp(op string) bool {
+	return (t.kind == tokOp || t.kind == tokPath) && t.text == op
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("expression %q: %s at %d", p.src, fmt.Sprintf(format, args...), t.pos)
+}
+
+//expect consumes op, or fails
+func (p *parser) expect(op string) error {
+	if t := p.next(); !t.isOp(op) {
+		return p.errorf(t, "expected %q, got %s", op, t)
+	}
+	return nil
+}
+
+//checkCondition fails if n can't be used as a condition
+func (p *parser) checkCondition(t token, n node) error {
+	if k := n.kind(); k != kindBool && k != kindAny {
+		return p.errorf(t, "%s used as condition", k)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	return p.parseLogical("||", false, p.parseAnd)
+}
+
+func (p *parser) parseAnd() (node, error) {
+	return p.parseLogical("&&", true, p.parseNot)
+}
+
+//parseLogical parses operands joined by op
+func (p *parser) parseLogical(op string, and bool, operand func() (node, error)) (node, error) {
+	t := p.peek()
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().isOp(op) {
+		if err = p.checkCondition(t, left); err != nil {
+			return nil, err
+		}
+		p.next()
+		t = p.peek()
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.checkCondition(t, right); err != nil {
+			return nil, err
+		}
+		left = logical{and: and, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if t := p.peek(); t.isOp("!") {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.checkCondition(t, operand); err != nil {
+			return nil, err
+		}
+		return not{operand: operand}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (node, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	switch {
+	case t.isOp("==") || t.isOp("!=") || t.isOp("<") || t.isOp("<=") || t.isOp(">") || t.isOp(">="):
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.checkComparable(t, left, right); err != nil {
+			return nil, err
+		}
+		return compare{op: t.text, left: left, right: right}, nil
+
+	case t.isOp("=~") || t.isOp("!~"):
+		p.next()
+		if err = p.checkKind(t, left, kindString); err != nil {
+			return nil, err
+		}
+		pattern := p.next()
+		if pattern.kind != tokString {
+			return nil, p.errorf(pattern, "%s needs a string literal pattern", t.text)
+		}
+		re, err := regexp.Compile(pattern.s)
+		if err != nil {
+			return nil, p.errorf(pattern, "invalid pattern: %s", err)
+		}
+		return match{negate: t.text == "!~", operand: left, re: re}, nil
+
+	case t.isOp("in") || t.isOp("not"):
+		p.next()
+		negate := t.text == "not"
+		if negate {
+			if err = p.expect("in"); err != nil {
+				return nil, err
+			}
+		}
+		rt := p.peek()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.checkKind(rt, right, kindList); err != nil {
+			return nil, err
+		}
+		return in{negate: negate, left: left, right: right}, nil
+	}
+
+	return left, nil
+}
+
+//checkKind fails if n's static type isn't k or any
+func (p *parser) checkKind(t token, n node, k kind) error {
+	if nk := n.kind(); nk != k && nk != kindAny {
+		return p.errorf(t, "expected %s, got %s", k, nk)
+	}
+	return nil
+}
+
+//checkComparable fails if comparison operands can never be compared
+func (p *parser) checkComparable(t token, left node, right node) error {
+	lk, rk := left.kind(), right.kind()
+	if t.text != "==" && t.text != "!=" {
+		for _, k := range []kind{lk, rk} {
+			if k != kindAny && k != kindNumber && k != kindString {
+				return p.errorf(t, "can't order %s", k)
+			}
+		}
+	}
+	if lk != kindAny && rk != kindAny && lk != rk {
+		return p.errorf(t, "can't compare %s %s %s", lk, t.text, rk)
+	}
+	return nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return literal{value{kind: kindString, s: t.s}}, nil
+	case tokNumber:
+		return literal{value{kind: kindNumber, n: t.n}}, nil
+	case tokPath:
+		return p.parsePath(t)
+	case tokOp:
+		switch t.text {
+		case "-":
+			num := p.next()
+			if num.kind != tokNumber {
+				return nil, p.errorf(num, "expected number after -")
+			}
+			return literal{value{kind: kindNumber, n: -num.n}}, nil
+		case "(":
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		case "[":
+			return p.parseList()
+		}
+	}
+	return nil, p.errorf(t, "unexpected %s", t)
+}
+
+//parseList parses a list literal after [
+func (p *parser) parseList() (node, error) {
+	items := []node{}
+	if p.peek().isOp("]") {
+		p.next()
+		return list{items: items}, nil
+	}
+	for {
+		item, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		t := p.next()
+		if t.isOp("]") {
+			return list{items: items}, nil
+		}
+		if !t.isOp(",") {
+			return nil, p.errorf(t, "expected \",\" or \"]\", got %s", t)
+		}
+	}
+}
+
+//parsePath parses keywords, fields and function calls
+func (p *parser) parsePath(t token) (node, error) {
+	switch t.text {
+	case "true":
+		return literal{value{kind: kindBool, b: true}}, nil
+	case "false":
+		return literal{value{kind: kindBool}}, nil
+	case "null":
+		return literal{value{kind: kindNull}}, nil
+	case "in", "not":
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+
+	if p.peek().isOp("(") {
+		return p.parseCall(t)
+	}
+
+	path, err := pkgjson.ParsePath(t.text)
+	if err != nil {
+		return nil, p.errorf(t, "invalid field: %s", err)
+	}
+	return field{path: path}, nil
+}
+
+//parseCall parses a function call
+func (p *parser) parseCall(name token) (node, error) {
+	p.next()
+	args := []node{}
+	argTokens := []token{}
+	if p.peek().isOp(")") {
+		p.next()
+	} else {
+		for {
+			argTokens = append(argTokens, p.peek())
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			t := p.next()
+			if t.isOp(")") {
+				break
+			}
+			if !t.isOp(",") {
+				return nil, p.errorf(t, "expected \",\" or \")\", got %s", t)
+			}
+		}
+	}
+
+	if name.text == "has" {
+		if len(args) != 1 {
+			return nil, p.errorf(name, "has takes 1 argument, got %d", len(args))
+		}
+		f, ok := args[0].(field)
+		if !ok {
+			return nil, p.errorf(argTokens[0], "has needs a field")
+		}
+		return has{path: f.path}, nil
+	}
+
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, p.errorf(name, "unknown function %s", name.text)
+	}
+	if len(args) != len(fn.args) {
+		return nil, p.errorf(name, "%s takes %d arguments, got %d", name.text, len(fn.args), len(args))
+	}
+	for i, arg := range args {
+		if fn.args[i] != kindAny {
+			if err := p.checkKind(argTokens[i], arg, fn.args[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return call{fn: fn, args: args}, nil
+}
@@ -75,3 +75,73 @@ var _ = Describe("Filter", func() {
 		close(done)
 	})
 })
+
+var _ = Describe("Expr", func() {
+
+	event := types.NewEventFromBytes([]byte(`{"level": "info", "latency_ms": 250, "method": "GET", "path": "/admin/users", "user": {"id": 1, "name": "Bot-7"}, "tags": ["a", "b"]}`))
+
+	match := func(src string) bool {
+		expr, err := filter.Compile(src)
+		Expect(err).To(BeNil())
+		ok, err := expr.Match(&event)
+		Expect(err).To(BeNil())
+		return ok
+	}
+
+	It("evaluates comparisons and boolean logic", func() {
+		Expect(match(`level != "debug" && latency_ms > 200 && has(user.id)`)).To(BeTrue())
+		Expect(match(`level == "debug" || latency_ms <= 200`)).To(BeFalse())
+		Expect(match(`!has(user.email)`)).To(BeTrue())
+		Expect(match(`missing == 1`)).To(BeFalse())
+	})
+
+	It("matches regexes, lists and functions", func() {
+		Expect(match(`path =~ "^/admin/"`)).To(BeTrue())
+		Expect(match(`path !~ "^/admin/"`)).To(BeFalse())
+		Expect(match(`method in ["GET", "HEAD"]`)).To(BeTrue())
+		Expect(match(`method not in ["GET", "HEAD"]`)).To(BeFalse())
+		Expect(match(`startsWith(lower(user.name), "bot") && len(tags) == 2`)).To(BeTrue())
+	})
+
+	It("fails to compile invalid expressions", func() {
+		for _, src := range []string{
+			`"a" > 1`,
+			`level == `,
+			`latency_ms + 1`,
+			`path =~ level`,
+			`path =~ "("`,
+			`method in "GET"`,
+			`unknown(level)`,
+			`has("level")`,
+			`1 && true`,
+			`"level"`,
+		} {
+			_, err := filter.Compile(src)
+			Expect(err).NotTo(BeNil(), src)
+		}
+	})
+
+	It("filters events in a sink", func(done Done) {
+		fn, err := filter.NewExprFn(`level != "debug"`)
+		Expect(err).To(BeNil())
+
+		src := programmatic.NewSource()
+		sink := buffer.NewSink()
+		debug := types.NewEventFromBytes([]byte(`{"level": "debug"}`))
+		info := types.NewEventFromBytes([]byte(`{"level": "info"}`))
+		for _, e := range []types.Event{debug, info, debug} {
+			src.Put(e)
+		}
+		src.Close()
+
+		filtered, err := filter.NewSink(sink, fn)
+		Expect(err).To(BeNil())
+		p, err := pipe.NewStage(src, filtered)
+		Expect(err).To(BeNil())
+
+		Expect(p.Flow()).To(Equal(errors.ErrSourceClosed))
+		Expect(sink.Events).To(Equal([]types.Event{info}))
+
+		close(done)
+	})
+})
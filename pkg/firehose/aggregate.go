@@ -0,0 +1,207 @@
+package firehose
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"go.uber.org/zap"
+	"io/ioutil"
+)
+
+//separator delimits events in aggregated records
+var separator = []byte("\n")
+
+//gzipMagic are the leading bytes of gzip data
+var gzipMagic = []byte{0x1f, 0x8b}
+
+//AggregateConfig configures packing of many events into one firehose record.
+type AggregateConfig struct {
+	MaxBytes int  //max size of a record before compression, defaults to MaxRecordBytes
+	Compress bool //when true, each record is gzip compressed
+}
+
+/*
+DeaggregateSource fulfills the Source interface. It wraps a source of
+records written by an aggregating Sink, and draws the events packed into them.
+
+Compressed records are detected and decompressed automatically.
+*/
+type DeaggregateSource struct {
+	source   types.Source
+	buffered [][]byte
+}
+
+//record is a firehose record, with the indices of the events it was made from
+type record struct {
+	data    []byte
+	indices []int
+}
+
+//implements interfaces
+var _ types.Source = &DeaggregateSource{}
+
+/*
+Aggregate packs events into newline delimited records of up to cfg.MaxBytes,
+compressing them if configured. This is what Sink does when configured with
+Aggregate, and can be used to produce records for tests and replays.
+
+Events that can't be aggregated, e.g. because they are empty or contain newlines,
+are left out and have an error at their index in the returned errors.
+Errors are nil if all events were aggregated.
+*/
+func Aggregate(events []types.Event, cfg AggregateConfig) ([]types.Event, []error) {
+	records, errs := aggregate(events, cfg)
+	res := []types.Event{}
+	for _, rec := range records {
+		res = append(res, types.NewEventFromBytes(rec.data))
+	}
+	return res, errs
+}
+
+//aggregate packs events into records
+func aggregate(events []types.Event, cfg AggregateConfig) ([]record, []error) {
+	logger := logging.Logger()
+	maxBytes := cfg.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = MaxRecordBytes
+	}
+
+	records := []record{}
+	errs := make([]error, len(events))
+	failed := false
+	current := record{data: []byte{}, indices: []int{}}
+
+	flush := func() error {
+		if len(current.indices) == 0 {
+			return nil
+		}
+		if cfg.Compress {
+			compressed, err := compress(current.data)
+			if err != nil {
+				return err
+			}
+			current.data = compressed
+		}
+		records = append(records, current)
+		current = record{data: []byte{}, indices: []int{}}
+		return nil
+	}
+
+	for i, evt := range events {
+		b := evt.Bytes()
+		if bytes.Contains(b, separator) {
+			logger.Debug("firehose.aggregate: event contains separator", zap.Int("index", i))
+			errs[i] = fmt.Errorf("event contains newline, can't be aggregated")
+			failed = true
+			continue
+		}
+		//empty events are indistinguishable from blank lines, which are skipped when read
+		if len(b) == 0 {
+			logger.Debug("firehose.aggregate: event is empty", zap.Int("index", i))
+			errs[i] = fmt.Errorf("event is empty, can't be aggregated")
+			failed = true
+			continue
+		}
+		if len(current.data)+len(b)+len(separator) > maxBytes {
+			if err := flush(); err != nil {
+				for _, j := range current.indices {
+					errs[j] = err
+				}
+				failed = true
+				current = record{data: []byte{}, indices: []int{}}
+			}
+		}
+		current.data = append(current.data, b...)
+		current.data = append(current.data, separator...)
+		current.indices = append(current.indices, i)
+	}
+	if err := flush(); err != nil {
+		for _, j := range current.indices {
+			errs[j] = err
+		}
+		failed = true
+	}
+
+	logger.Debug("firehose.aggregate: aggregated",
+		zap.Int("nEvents", len(events)),
+		zap.Int("nRecords", len(records)))
+
+	if failed {
+		return records, errs
+	}
+	return records, nil
+}
+
+//compress gzips bytes
+func compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//NewDeaggregateSource creates a source that draws the events
+//packed into records drawn from the supplied source.
+func NewDeaggregateSource(source types.Source) (*DeaggregateSource, error) {
+	if source == nil {
+		return nil, errors.ErrNilSource
+	}
+
+	return &DeaggregateSource{
+		source:   source,
+		buffered: [][]byte{},
+	}, nil
+}
+
+//DrawOne draws one event, drawing and unpacking a new record from the underlying source when needed.
+func (source *DeaggregateSource) DrawOne() (*types.Event, error) {
+	if len(source.buffered) == 0 {
+		e, err := source.source.DrawOne()
+		if err != nil || e == nil {
+			return nil, err
+		}
+
+		data := e.Bytes()
+		if bytes.HasPrefix(data, gzipMagic) {
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			if data, err = ioutil.ReadAll(r); err != nil {
+				return nil, err
+			}
+		} else {
+			//copies so events don't share memory with the underlying source
+			data = append([]byte{}, data...)
+		}
+
+		for _, line := range bytes.Split(data, separator) {
+			if len(line) > 0 {
+				source.buffered = append(source.buffered, line)
+			}
+		}
+		logging.Logger().Debug("firehose.DrawOne: deaggregated record", zap.Int("n", len(source.buffered)))
+
+		//empty records don't stop the flow
+		if len(source.buffered) == 0 {
+			return nil, nil
+		}
+	}
+
+	evt := types.NewEventFromBytes(source.buffered[0])
+	source.buffered = source.buffered[1:]
+	return &evt, nil
+}
+
+//Close closes the underlying source.
+func (source *DeaggregateSource) Close() error {
+	return source.source.Close()
+}
@@ -1,35 +1,58 @@
 /*
 Package firehose provides a sink that sends events to an AWS Firehose.
+
+The sink can aggregate many small events into each record to reduce cost,
+and DeaggregateSource reads aggregated records back as events.
 */
 package firehose
 
 import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/firehose"
-	"github.com/underscorenygren/partaj/internal/awsutil"
 	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/awsconfig"
 	"github.com/underscorenygren/partaj/pkg/errors"
 	"github.com/underscorenygren/partaj/pkg/types"
 	"go.uber.org/zap"
+	"time"
 )
 
 const (
 	//LocalEndpoint is the address of the firehose service when using localstack for testing.
 	LocalEndpoint = "http://localhost:4573"
+	//MaxBatchRecords is the max number of records in one PutRecordBatch call.
+	MaxBatchRecords = 500
+	//MaxBatchBytes is the max size of one PutRecordBatch call.
+	MaxBatchBytes = 4 * 1024 * 1024
+	//MaxRecordBytes is the max size of one record.
+	MaxRecordBytes = 1000 * 1024
+	//DefaultMaxRetries is the number of times throttled records are retried.
+	DefaultMaxRetries = 3
+	//DefaultRetryBackoff is the wait before the first retry, doubled on each retry.
+	DefaultRetryBackoff = 100 * time.Millisecond
 )
 
 //Sink implements Sink interface for pushing events to a Firehose.
 type Sink struct {
-	Name     string //the name of the firehose
-	firehose *firehose.Firehose
+	Name         string //the name of the firehose
+	firehose     *firehose.Firehose
+	maxRetries   int
+	retryBackoff time.Duration
+	aggregate    *AggregateConfig
 }
 
 //Config is the input arguments to NewSink.
 type Config struct {
-	Name  string //name of the firehose as defined by AWS.
-	Local bool   //when set to true, will configure firehose client to make requests to the local endpoint.
+	Name         string             //name of the firehose as defined by AWS.
+	Local        bool               //when set to true, will configure firehose client to make requests to the local endpoint.
+	AWS          *awsconfig.Options //aws session options, e.g. region, credentials and retries. Defaults to the environment
+	MaxRetries   *int               //times throttled records are retried, defaults to DefaultMaxRetries
+	RetryBackoff *time.Duration     //wait before first retry, defaults to DefaultRetryBackoff
+	//Aggregate when set packs many newline delimited events into each record.
+	//Use DeaggregateSource to read them back.
+	Aggregate *AggregateConfig
 }
 
 //NewSink constructs a firehose Sink.
@@ -42,12 +65,27 @@ func NewSink(cfg Config) (*Sink, error) {
 	if cfg.Local {
 		endpoint = LocalEndpoint
 	}
-	awsCfg := awsutil.GetDefaultConfig(endpoint)
-	firehose := firehose.New(session.New(), awsCfg)
+	sess, err := cfg.AWS.NewSession(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	firehose := firehose.New(sess)
+
+	maxRetries := DefaultMaxRetries
+	if cfg.MaxRetries != nil {
+		maxRetries = *cfg.MaxRetries
+	}
+	retryBackoff := DefaultRetryBackoff
+	if cfg.RetryBackoff != nil {
+		retryBackoff = *cfg.RetryBackoff
+	}
 
 	return &Sink{
-		Name:     cfg.Name,
-		firehose: firehose,
+		Name:         cfg.Name,
+		firehose:     firehose,
+		maxRetries:   maxRetries,
+		retryBackoff: retryBackoff,
+		aggregate:    cfg.Aggregate,
 	}, nil
 }
 
@@ -57,63 +95,164 @@ func (fh *Sink) Client() *firehose.Firehose {
 }
 
 //Drain sends the supplied events to the firehose using
-//PutRecordBatch.
+//PutRecordBatch, split into as many calls as PutRecordBatch limits require.
+//
+//Records over MaxRecordBytes fail without being sent. Throttled records
+//are retried with exponential backoff, up to MaxRetries times.
+//
+//When configured to aggregate, events are packed into records first,
+//and all events in a failed record get the error of that record.
 func (fh *Sink) Drain(events []types.Event) []error {
-	firehoseRecords := []*firehose.Record{}
-	errs := []error{}
 	logger := logging.Logger()
+	errs := make([]error, len(events))
+	failed := false
+
+	records := []record{}
+	if fh.aggregate != nil {
+		var aggregateErrs []error
+		records, aggregateErrs = aggregate(events, *fh.aggregate)
+		for i, err := range aggregateErrs {
+			if err != nil {
+				errs[i] = err
+				failed = true
+			}
+		}
+	} else {
+		for i, evt := range events {
+			records = append(records, record{data: evt.Bytes(), indices: []int{i}})
+		}
+	}
 
-	//convert to firehose records
-	for _, evt := range events {
-		firehoseRecords = append(firehoseRecords, toRecord(evt.Bytes()))
+	firehoseRecords := []*firehose.Record{}
+	batch := []record{}
+	size := 0
+
+	fail := func(rec record, err error) {
+		for _, i := range rec.indices {
+			errs[i] = err
+		}
+		failed = true
 	}
 
-	//put batch to firehose
-	logger.Debug("firehose.Drain: putting batch",
-		zap.Int("n", len(firehoseRecords)),
-		zap.String("name", fh.Name),
-	)
-	res, err := fh.firehose.PutRecordBatch(&firehose.PutRecordBatchInput{
-		DeliveryStreamName: aws.String(fh.Name),
-		Records:            firehoseRecords,
-	})
-	logger.Debug("firehose.Drain: finished batch")
-
-	//Put error means all failed (permission error or whatnot)
-	if err != nil {
-		logger.Debug("firehose.Drain: put error", zap.Error(err))
-		for range firehoseRecords {
-			errs = append(errs, errors.ErrPutFailure)
+	put := func() {
+		if len(firehoseRecords) == 0 {
+			return
+		}
+		for j, err := range fh.putBatch(firehoseRecords) {
+			if err != nil {
+				fail(batch[j], err)
+			}
 		}
+		firehoseRecords = []*firehose.Record{}
+		batch = []record{}
+		size = 0
+	}
+
+	//convert to firehose records, in batches that fit limits
+	for j, rec := range records {
+		n := len(rec.data)
+		if n > MaxRecordBytes {
+			logger.Debug("firehose.Drain: record too large", zap.Int("index", j), zap.Int("size", n))
+			fail(rec, fmt.Errorf("record of %d bytes exceeds max of %d", n, MaxRecordBytes))
+			continue
+		}
+		if len(firehoseRecords) == MaxBatchRecords || size+n > MaxBatchBytes {
+			put()
+		}
+		firehoseRecords = append(firehoseRecords, toRecord(rec.data))
+		batch = append(batch, rec)
+		size += n
+	}
+	put()
+
+	if failed {
 		return errs
 	}
+	return nil
+}
+
+//putBatch puts one batch of records, retrying throttled records,
+//and returns errors at record indices
+func (fh *Sink) putBatch(firehoseRecords []*firehose.Record) []error {
+	logger := logging.Logger()
+	errs := make([]error, len(firehoseRecords))
+	pending := []int{}
+	for i := range firehoseRecords {
+		pending = append(pending, i)
+	}
+	backoff := fh.retryBackoff
 
-	//handle any failures
-	nFailed := res.FailedPutCount
-	failure := nFailed != nil && *nFailed > 0
-	if failure {
-		logger.Debug("firehose.Drain: failed some records", zap.Int64("n", *nFailed))
-		for index, resp := range res.RequestResponses {
-			code := *resp.ErrorCode
-			msg := *resp.ErrorMessage
-			if resp.ErrorCode != nil {
+	for attempt := 0; ; attempt++ {
+		batch := []*firehose.Record{}
+		for _, i := range pending {
+			batch = append(batch, firehoseRecords[i])
+		}
+		retry := []int{}
+
+		//put batch to firehose
+		logger.Debug("firehose.Drain: putting batch",
+			zap.Int("n", len(batch)),
+			zap.Int("attempt", attempt),
+			zap.String("name", fh.Name),
+		)
+		res, err := fh.firehose.PutRecordBatch(&firehose.PutRecordBatchInput{
+			DeliveryStreamName: aws.String(fh.Name),
+			Records:            batch,
+		})
+		logger.Debug("firehose.Drain: finished batch")
+
+		if err != nil {
+			logger.Debug("firehose.Drain: put error", zap.Error(err))
+			awsErr, ok := err.(awserr.Error)
+			throttled := ok && awsErr.Code() == firehose.ErrCodeServiceUnavailableException
+			for _, i := range pending {
+				if throttled {
+					errs[i] = err
+				} else {
+					//Put error means all failed (permission error or whatnot)
+					errs[i] = errors.ErrPutFailure
+				}
+			}
+			if !throttled {
+				return errs
+			}
+			retry = pending
+		} else {
+			//map responses back to records, responses are in request order
+			for j, i := range pending {
+				if j >= len(res.RequestResponses) {
+					errs[i] = errors.ErrPutFailure
+					continue
+				}
+				resp := res.RequestResponses[j]
+				if resp.ErrorCode == nil {
+					errs[i] = nil
+					continue
+				}
+				code := aws.StringValue(resp.ErrorCode)
+				msg := aws.StringValue(resp.ErrorMessage)
 				logger.Debug("firehose.Drain: record error",
-					zap.Int("index", index),
+					zap.Int("index", i),
 					zap.String("code", code),
-					zap.String("msg", msg),
-					zap.String("recordId", *resp.RecordId))
-				errs = append(errs, fmt.Errorf("[%s]:%s", code, msg))
-			} else {
-				logger.Debug("firehose.Drain: record succeeded",
-					zap.Int("index", index))
-				errs = append(errs, nil)
+					zap.String("msg", msg))
+				errs[i] = fmt.Errorf("[%s]:%s", code, msg)
+				if code == firehose.ErrCodeServiceUnavailableException {
+					retry = append(retry, i)
+				}
 			}
 		}
 
-		return errs
-	}
+		if len(retry) == 0 || attempt >= fh.maxRetries {
+			return errs
+		}
 
-	return nil
+		logger.Debug("firehose.Drain: retrying throttled records",
+			zap.Int("n", len(retry)),
+			zap.Duration("backoff", backoff))
+		time.Sleep(backoff)
+		backoff *= 2
+		pending = retry
+	}
 }
 
 //toRecord creates a firehose firehose record from bytes
@@ -8,12 +8,14 @@ import (
 	awsfirehose "github.com/aws/aws-sdk-go/service/firehose"
 	"github.com/underscorenygren/partaj/internal/logging"
 	"github.com/underscorenygren/partaj/pkg/buffer"
+	"github.com/underscorenygren/partaj/pkg/errors"
 	"github.com/underscorenygren/partaj/pkg/failsink"
 	"github.com/underscorenygren/partaj/pkg/firehose"
 	"github.com/underscorenygren/partaj/pkg/pipe"
 	"github.com/underscorenygren/partaj/pkg/programmatic"
 	"github.com/underscorenygren/partaj/pkg/types"
 	"net/http"
+	"strings"
 )
 
 //examples on how to use firehose
@@ -76,4 +78,96 @@ var _ = Describe("Firehose", func() {
 		//Nothing should have failed
 		Expect(buf.Events).To(Equal([]types.Event{}))
 	})
+
+	It("splits batches over the record limit", func() {
+		events := []types.Event{}
+		for i := 0; i <= firehose.MaxBatchRecords; i++ {
+			events = append(events, types.NewEventFromBytes([]byte("a")))
+		}
+
+		Expect(sink.Drain(events)).To(BeNil())
+	})
+})
+
+var _ = Describe("Firehose limits", func() {
+
+	logging.ConfigureDevelopment(GinkgoWriter)
+
+	It("rejects records that are too large", func() {
+		sink, err := firehose.NewSink(firehose.Config{
+			Name:  "test",
+			Local: true,
+		})
+		Expect(err).To(BeNil())
+
+		big := types.NewEventFromBytes([]byte(strings.Repeat("a", firehose.MaxRecordBytes+1)))
+		errs := sink.Drain([]types.Event{big})
+		Expect(len(errs)).To(Equal(1))
+		Expect(errs[0]).ToNot(BeNil())
+	})
+})
+
+var _ = Describe("Firehose aggregation", func() {
+
+	logging.ConfigureDevelopment(GinkgoWriter)
+
+	events := []types.Event{
+		types.NewEventFromBytes([]byte(`{"id":1}`)),
+		types.NewEventFromBytes([]byte(`{"id":2}`)),
+		types.NewEventFromBytes([]byte(`{"id":3}`)),
+	}
+
+	readBack := func(records []types.Event) []types.Event {
+		src := programmatic.NewSource()
+		for _, r := range records {
+			src.Put(r)
+		}
+		src.Close()
+
+		deaggregated, err := firehose.NewDeaggregateSource(src)
+		Expect(err).To(BeNil())
+		buf := buffer.NewSink()
+		p, err := pipe.NewStage(deaggregated, buf)
+		Expect(err).To(BeNil())
+		Expect(p.Flow()).To(Equal(errors.ErrSourceClosed))
+		return buf.Events
+	}
+
+	It("packs events into records up to a size limit", func() {
+		records, errs := firehose.Aggregate(events, firehose.AggregateConfig{MaxBytes: 20})
+		Expect(errs).To(BeNil())
+		Expect(len(records)).To(Equal(2))
+		Expect(records[0].String()).To(Equal("{\"id\":1}\n{\"id\":2}\n"))
+
+		Expect(readBack(records)).To(Equal(events))
+	})
+
+	It("compresses records", func() {
+		records, errs := firehose.Aggregate(events, firehose.AggregateConfig{Compress: true})
+		Expect(errs).To(BeNil())
+		Expect(len(records)).To(Equal(1))
+		Expect(records[0].Bytes()[:2]).To(Equal([]byte{0x1f, 0x8b}))
+
+		Expect(readBack(records)).To(Equal(events))
+	})
+
+	It("rejects events with newlines", func() {
+		withNewline := append([]types.Event{types.NewEventFromBytes([]byte("a\nb"))}, events...)
+		records, errs := firehose.Aggregate(withNewline, firehose.AggregateConfig{})
+		Expect(len(errs)).To(Equal(len(withNewline)))
+		Expect(errs[0]).ToNot(BeNil())
+		Expect(errs[1:]).To(Equal([]error{nil, nil, nil}))
+
+		Expect(readBack(records)).To(Equal(events))
+	})
+
+	It("rejects empty events", func() {
+		withEmpty := append(append([]types.Event{}, events...), types.NewEventFromBytes([]byte{}))
+		records, errs := firehose.Aggregate(withEmpty, firehose.AggregateConfig{})
+		Expect(len(errs)).To(Equal(len(withEmpty)))
+		Expect(errs[:3]).To(Equal([]error{nil, nil, nil}))
+		Expect(errs[3]).ToNot(BeNil())
+
+		Expect(readBack(records)).To(Equal(events))
+	})
 })
@@ -9,10 +9,12 @@ import (
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/underscorenygren/partaj/internal/logging"
+	pkgjson "github.com/underscorenygren/partaj/pkg/json"
 	"github.com/underscorenygren/partaj/pkg/pipe"
 	"github.com/underscorenygren/partaj/pkg/pipeline"
 	"github.com/underscorenygren/partaj/pkg/programmatic"
 	"github.com/underscorenygren/partaj/pkg/types"
+	"github.com/valyala/fastjson"
 	"go.uber.org/zap"
 	"io/ioutil"
 	"net/http"
@@ -45,6 +47,9 @@ type EventMakerFn func(body []byte, req *http.Request) (*types.Event, error)
 //SuccessWriterFn is the function signature for writing a successful response.
 type SuccessWriterFn func(w http.ResponseWriter)
 
+//ErrorWriterFn is the function signature for writing the response to a request that failed.
+type ErrorWriterFn func(err error, w http.ResponseWriter)
+
 //DefaultEventMaker implements EventMakerFn type,  writes request body bytes as the event bytes.
 func DefaultEventMaker(body []byte, req *http.Request) (*types.Event, error) {
 	evt := types.NewEventFromBytes(body)
@@ -56,6 +61,52 @@ func DefaultSuccessFn(w http.ResponseWriter) {
 	w.WriteHeader(DefaultSuccessCode)
 }
 
+//DefaultErrorFn implements ErrorWriterFn type, writes bad request and no content.
+func DefaultErrorFn(err error, w http.ResponseWriter) {
+	w.WriteHeader(http.StatusBadRequest)
+}
+
+/*
+ValidatingEventMaker wraps an EventMakerFn, and validates the events it makes
+with validator. Invalid events are returned as errors, which fail the request.
+*/
+func ValidatingEventMaker(validator *pkgjson.Validator, maker EventMakerFn) EventMakerFn {
+	return func(body []byte, req *http.Request) (*types.Event, error) {
+		e, err := maker(body, req)
+		if err != nil || e == nil {
+			return e, err
+		}
+		if err = validator.Validate(e); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+}
+
+/*
+ValidationErrorWriter implements ErrorWriterFn type, writes json validation
+errors as a json body of a bad request:
+
+	{"errors":[{"path":"id","message":"expected integer, got string"}]}
+
+Other errors are written by DefaultErrorFn.
+*/
+func ValidationErrorWriter(err error, w http.ResponseWriter) {
+	errs, ok := err.(pkgjson.ValidationErrors)
+	if !ok {
+		DefaultErrorFn(err, w)
+		return
+	}
+
+	arena := &fastjson.Arena{}
+	obj := arena.NewObject()
+	obj.Set("errors", errs.Value(arena))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(obj.MarshalTo(nil))
+}
+
 /*
 Server accepts web request and turns them into events.
 
@@ -63,7 +114,6 @@ Call ListenAndServe like a regular net/http server to start it.
 
 	server, _ := NewServer(Config{})
 	log.Fatal(server.ListenAndServe())
-
 */
 type Server struct {
 	eventServer *eventServer
@@ -91,6 +141,7 @@ type Config struct {
 	WriteTimeout      *time.Duration  //passed to net/http
 	EventMaker        EventMakerFn    //How to make events from requests
 	SuccessWriter     SuccessWriterFn //what to write on event success
+	ErrorWriter       ErrorWriterFn   //what to write when making or putting events fails
 	Sink              types.Sink      //sink to handle received events
 }
 
@@ -103,6 +154,7 @@ by the http module
 type eventServer struct {
 	EventMaker    EventMakerFn
 	SuccessWriter SuccessWriterFn
+	ErrorWriter   ErrorWriterFn
 	stages        []types.Stage
 	sources       []types.Source
 }
@@ -116,6 +168,7 @@ func NewServer(cfg Config) (*Server, error) {
 	writeTimeout := DefaultWriteTimeout
 	eventMaker := DefaultEventMaker
 	successWriter := DefaultSuccessFn
+	errorWriter := DefaultErrorFn
 	router := mux.NewRouter()
 
 	if cfg.Host != nil {
@@ -139,10 +192,14 @@ func NewServer(cfg Config) (*Server, error) {
 	if cfg.SuccessWriter != nil {
 		successWriter = cfg.SuccessWriter
 	}
+	if cfg.ErrorWriter != nil {
+		errorWriter = cfg.ErrorWriter
+	}
 
 	eventServer := &eventServer{
 		EventMaker:    eventMaker,
 		SuccessWriter: successWriter,
+		ErrorWriter:   errorWriter,
 		stages:        []types.Stage{},
 	}
 
@@ -206,6 +263,7 @@ MakeHandleFunc is used to create a function usable with the http.Handler interfa
 sends events to the specified sink.
 
 Used with the server Router to route events to different sink:
+
 	server.Router.HandleFunc("/some-path", server.MakeHandleFunc(someSink))
 */
 func (srv *Server) MakeHandleFunc(sink types.Sink) func(w http.ResponseWriter, req *http.Request) {
@@ -271,7 +329,7 @@ func (s *eventServer) makeHandleFunc(sink types.Sink) func(w http.ResponseWriter
 
 //writes en arror when request is malformatted
 func (s *eventServer) handleError(err error, w http.ResponseWriter) {
-	w.WriteHeader(http.StatusBadRequest)
+	s.ErrorWriter(err, w)
 	logging.Logger().Error("error on request", zap.Error(err))
 }
 
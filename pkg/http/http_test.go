@@ -10,10 +10,13 @@ import (
 	"github.com/underscorenygren/partaj/internal/logging"
 	"github.com/underscorenygren/partaj/pkg/buffer"
 	"github.com/underscorenygren/partaj/pkg/http"
+	pkgjson "github.com/underscorenygren/partaj/pkg/json"
 	"github.com/underscorenygren/partaj/pkg/types"
 	"github.com/underscorenygren/partaj/pkg/types/optional"
 	"go.uber.org/zap"
 	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
 	"time"
 )
 
@@ -110,3 +113,77 @@ var _ = Describe("Http", func() {
 		close(done)
 	})
 })
+
+var _ = Describe("Http errors", func() {
+
+	logging.ConfigureDevelopment(GinkgoWriter)
+
+	schema, err := pkgjson.CompileSchema([]byte(`{
+		"type": "object",
+		"required": ["id"],
+		"properties": {"id": {"type": "integer"}}
+	}`))
+	if err != nil {
+		panic(err)
+	}
+	validator, err := pkgjson.NewValidator(pkgjson.ValidatorConfig{Schema: schema})
+	if err != nil {
+		panic(err)
+	}
+
+	post := func(s *http.Server, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.Router.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		return w
+	}
+
+	It("replies bad request with no content by default", func() {
+		bufferSink := buffer.NewSink()
+		s, err := http.NewServer(http.Config{
+			Sink:       bufferSink,
+			EventMaker: http.ValidatingEventMaker(validator, http.DefaultEventMaker),
+		})
+		Expect(err).To(BeNil())
+
+		w := post(s, `{"id":"x"}`)
+		Expect(w.Code).To(Equal(nethttp.StatusBadRequest))
+		Expect(w.Body.String()).To(Equal(""))
+		Expect(bufferSink.Events).To(BeEmpty())
+	})
+
+	It("replies bad request with validation errors", func() {
+		s, err := http.NewServer(http.Config{
+			Sink:        buffer.NewSink(),
+			EventMaker:  http.ValidatingEventMaker(validator, http.DefaultEventMaker),
+			ErrorWriter: http.ValidationErrorWriter,
+		})
+		Expect(err).To(BeNil())
+
+		w := post(s, `{"id":"x"}`)
+		Expect(w.Code).To(Equal(nethttp.StatusBadRequest))
+		Expect(w.Header().Get("Content-Type")).To(Equal("application/json"))
+		Expect(w.Body.String()).To(Equal(`{"errors":[{"path":"id","message":"expected integer, got string"}]}`))
+
+		w = post(s, `not json`)
+		Expect(w.Code).To(Equal(nethttp.StatusBadRequest))
+		Expect(w.Body.String()).To(Equal(""))
+	})
+
+	It("writes errors with custom writers", func() {
+		s, err := http.NewServer(http.Config{
+			Sink: buffer.NewSink(),
+			EventMaker: func(body []byte, req *nethttp.Request) (*types.Event, error) {
+				return nil, fmt.Errorf("no events here")
+			},
+			ErrorWriter: func(err error, w nethttp.ResponseWriter) {
+				w.WriteHeader(nethttp.StatusTeapot)
+				w.Write([]byte(err.Error()))
+			},
+		})
+		Expect(err).To(BeNil())
+
+		w := post(s, `{"id":1}`)
+		Expect(w.Code).To(Equal(nethttp.StatusTeapot))
+		Expect(w.Body.String()).To(Equal("no events here"))
+	})
+})
@@ -17,24 +17,222 @@ import (
 )
 
 //Event is an event that has been parsed into fastjson.
+//
+//Paths of all operations are parsed with ParsePath. The chainable setters
+//take top level keys as is, and their At variants take paths.
+//They record the first error they encounter, which is returned by Err.
 type Event struct {
-	V *fastjson.Value //fastjson.Value exposed so you can operate directly in it inside the mapper
-	E *types.Event    //original event is available as well
+	V     *fastjson.Value //fastjson.Value exposed so you can operate directly in it inside the mapper
+	E     *types.Event    //original event is available as well
+	arena fastjson.Arena
+	err   error
 }
 
 //TransformerFn is the function signature for transforming json events.
 type TransformerFn func(*Event) *Event
 
+//Err returns the first error of the chainable setters.
+func (e *Event) Err() error {
+	return e.err
+}
+
+//Get returns the value at path, or ErrJSONPathNotFound.
+func (e *Event) Get(path string) (*fastjson.Value, error) {
+	p, err := ParsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return p.Get(e.V)
+}
+
+//Set sets value at path, converting go values with NewValue.
+//Missing objects and arrays along the path are created.
+func (e *Event) Set(path string, value interface{}) error {
+	p, err := ParsePath(path)
+	if err != nil {
+		return err
+	}
+	v, err := NewValue(&e.arena, value)
+	if err != nil {
+		return err
+	}
+	return p.Set(&e.arena, e.V, v)
+}
+
+//SetJSON parses raw json and sets it at path.
+func (e *Event) SetJSON(path string, raw string) error {
+	v, err := fastjson.Parse(raw)
+	if err != nil {
+		return err
+	}
+	return e.Set(path, v)
+}
+
+//Delete removes the value at path, or returns ErrJSONPathNotFound.
+func (e *Event) Delete(path string) error {
+	p, err := ParsePath(path)
+	if err != nil {
+		return err
+	}
+	return p.Delete(e.V)
+}
+
+//Rename moves the value at path to key in the same parent object.
+func (e *Event) Rename(path string, key string) error {
+	p, err := ParsePath(path)
+	if err != nil {
+		return err
+	}
+	to := append(Path{}, p[:len(p)-1]...)
+	return e.move(p, append(to, PathSegment{Key: key}))
+}
+
+//Move moves the value at from to the path to.
+func (e *Event) Move(from string, to string) error {
+	fromPath, err := ParsePath(from)
+	if err != nil {
+		return err
+	}
+	toPath, err := ParsePath(to)
+	if err != nil {
+		return err
+	}
+	return e.move(fromPath, toPath)
+}
+
+//move moves value between parsed paths
+func (e *Event) move(from Path, to Path) error {
+	v, err := from.Get(e.V)
+	if err != nil {
+		return err
+	}
+	if to.hasPrefix(from) {
+		if len(to) == len(from) {
+			return nil
+		}
+		return fmt.Errorf("can't move %s into itself", from)
+	}
+	//set first, so the value isn't lost if it can't be set.
+	//Sets replace or append, so from is still valid after, unless it was replaced
+	if err = to.Set(&e.arena, e.V, v); err != nil {
+		return err
+	}
+	if from.hasPrefix(to) {
+		return nil
+	}
+	return from.Delete(e.V)
+}
+
+//Copy sets a copy of the value at from at the path to.
+func (e *Event) Copy(from string, to string) error {
+	v, err := e.Get(from)
+	if err != nil {
+		return err
+	}
+	cp, err := fastjson.ParseBytes(v.MarshalTo(nil))
+	if err != nil {
+		return err
+	}
+	return e.Set(to, cp)
+}
+
+//chain records the first error of chainable setters
+func (e *Event) chain(err error) *Event {
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+	return e
+}
+
+//setKey sets value at a top level key
+func (e *Event) setKey(key string, value interface{}) error {
+	v, err := NewValue(&e.arena, value)
+	if err != nil {
+		return err
+	}
+	return Path{{Key: key}}.Set(&e.arena, e.V, v)
+}
+
 //SetString is a convenience function for adding a string value to the specified key.
 func (e *Event) SetString(key string, value string) *Event {
-	e.V.Set(key, fastjson.MustParse(fmt.Sprintf(`"%s"`, value)))
-	return e
+	return e.chain(e.setKey(key, value))
 }
 
 //SetInt is a convenience function for adding an int value to the specified key.
 func (e *Event) SetInt(key string, value int) *Event {
-	e.V.Set(key, fastjson.MustParse(fmt.Sprintf(`%d`, value)))
-	return e
+	return e.chain(e.setKey(key, value))
+}
+
+//SetFloat is a convenience function for adding a float value to the specified key.
+func (e *Event) SetFloat(key string, value float64) *Event {
+	return e.chain(e.setKey(key, value))
+}
+
+//SetBool is a convenience function for adding a bool value to the specified key.
+func (e *Event) SetBool(key string, value bool) *Event {
+	return e.chain(e.setKey(key, value))
+}
+
+//SetNull is a convenience function for adding null to the specified key.
+func (e *Event) SetNull(key string) *Event {
+	return e.chain(e.setKey(key, nil))
+}
+
+//SetObject is a convenience function for adding an object to the specified key.
+func (e *Event) SetObject(key string, value map[string]interface{}) *Event {
+	if value == nil {
+		value = map[string]interface{}{}
+	}
+	return e.chain(e.setKey(key, value))
+}
+
+//SetArray is a convenience function for adding an array to the specified key.
+func (e *Event) SetArray(key string, value []interface{}) *Event {
+	if value == nil {
+		value = []interface{}{}
+	}
+	return e.chain(e.setKey(key, value))
+}
+
+//SetStringAt is a convenience function for adding a string value at the specified path.
+func (e *Event) SetStringAt(path string, value string) *Event {
+	return e.chain(e.Set(path, value))
+}
+
+//SetIntAt is a convenience function for adding an int value at the specified path.
+func (e *Event) SetIntAt(path string, value int) *Event {
+	return e.chain(e.Set(path, value))
+}
+
+//SetFloatAt is a convenience function for adding a float value at the specified path.
+func (e *Event) SetFloatAt(path string, value float64) *Event {
+	return e.chain(e.Set(path, value))
+}
+
+//SetBoolAt is a convenience function for adding a bool value at the specified path.
+func (e *Event) SetBoolAt(path string, value bool) *Event {
+	return e.chain(e.Set(path, value))
+}
+
+//SetNullAt is a convenience function for adding null at the specified path.
+func (e *Event) SetNullAt(path string) *Event {
+	return e.chain(e.Set(path, nil))
+}
+
+//SetObjectAt is a convenience function for adding an object at the specified path.
+func (e *Event) SetObjectAt(path string, value map[string]interface{}) *Event {
+	if value == nil {
+		value = map[string]interface{}{}
+	}
+	return e.chain(e.Set(path, value))
+}
+
+//SetArrayAt is a convenience function for adding an array at the specified path.
+func (e *Event) SetArrayAt(path string, value []interface{}) *Event {
+	if value == nil {
+		value = []interface{}{}
+	}
+	return e.chain(e.Set(path, value))
 }
 
 /*
@@ -63,6 +261,10 @@ func Mapper(fn TransformerFn) func(*types.Event) (*types.Event, error) {
 		}
 
 		e := fn(&Event{V: v, E: evt})
+		if err = e.Err(); err != nil {
+			logger.Debug("json.Mapper: transform error", zap.Error(err))
+			return evt, err
+		}
 		bytes = e.V.MarshalTo(nil)
 		logger.Debug("json.Mapper: post-transform", zap.ByteString("eventBytes", bytes))
 
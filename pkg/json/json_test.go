@@ -5,15 +5,19 @@ import (
 	. "github.com/onsi/gomega"
 
 	"encoding/json"
+	"github.com/underscorenygren/partaj/internal"
 	"github.com/underscorenygren/partaj/internal/logging"
 	"github.com/underscorenygren/partaj/pkg/buffer"
 	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/underscorenygren/partaj/pkg/filter"
 	pkgjson "github.com/underscorenygren/partaj/pkg/json"
 	"github.com/underscorenygren/partaj/pkg/pipe"
 	"github.com/underscorenygren/partaj/pkg/programmatic"
 	"github.com/underscorenygren/partaj/pkg/transformer"
 	"github.com/underscorenygren/partaj/pkg/types"
+	"github.com/valyala/fastjson"
 	"go.uber.org/zap"
+	gomath "math"
 	"strings"
 )
 
@@ -142,3 +146,358 @@ var _ = Describe("Json", func() {
 		close(done)
 	})
 })
+
+var _ = Describe("Json paths", func() {
+
+	parse := func(s string) *pkgjson.Event {
+		v, err := fastjson.Parse(s)
+		Expect(err).To(BeNil())
+		return &pkgjson.Event{V: v}
+	}
+
+	str := func(e *pkgjson.Event) string {
+		return string(e.V.MarshalTo(nil))
+	}
+
+	It("parses dotted and bracket paths", func() {
+		p, err := pkgjson.ParsePath(`a.b[2]["c.d"].e`)
+		Expect(err).To(BeNil())
+		Expect(p).To(Equal(pkgjson.Path{
+			{Key: "a"},
+			{Key: "b"},
+			{Index: 2, IsIndex: true},
+			{Key: "c.d"},
+			{Key: "e"},
+		}))
+		Expect(p.String()).To(Equal(`a.b[2]["c.d"].e`))
+
+		for _, bad := range []string{"", ".a", "a.", "a..b", "a[", "a[x]", "a[-1]", `a["b]`, "a[0]b", "a]"} {
+			_, err = pkgjson.ParsePath(bad)
+			Expect(err).NotTo(BeNil(), bad)
+		}
+	})
+
+	It("gets nested values", func() {
+		e := parse(`{"a":{"b":[{"c":1},{"c":2}]},"x.y":true}`)
+
+		v, err := e.Get("a.b[1].c")
+		Expect(err).To(BeNil())
+		Expect(v.GetInt()).To(Equal(2))
+
+		v, err = e.Get("a.b.0.c")
+		Expect(err).To(BeNil())
+		Expect(v.GetInt()).To(Equal(1))
+
+		v, err = e.Get(`["x.y"]`)
+		Expect(err).To(BeNil())
+		Expect(v.GetBool()).To(BeTrue())
+
+		_, err = e.Get("a.b[2]")
+		Expect(err).To(Equal(errors.ErrJSONPathNotFound))
+		_, err = e.Get("a.missing")
+		Expect(err).To(Equal(errors.ErrJSONPathNotFound))
+	})
+
+	It("sets typed values with escaping, creating parents", func() {
+		e := parse(`{"a":1}`)
+		e.SetString("s", `quote " and \ backslash`).
+			SetIntAt("n.i", 2).
+			SetFloatAt("n.f", 1.5).
+			SetBool("b", true).
+			SetNull("z").
+			SetArrayAt("arr[0]", []interface{}{"x", 1}).
+			SetObject("obj", map[string]interface{}{"k": "v", "a": nil})
+		Expect(e.Err()).To(BeNil())
+		Expect(str(e)).To(Equal(`{"a":1,"s":"quote \" and \\ backslash","n":{"i":2,"f":1.5},"b":true,"z":null,"arr":[["x",1]],"obj":{"a":null,"k":"v"}}`))
+	})
+
+	It("sets keys that look like paths as is", func() {
+		e := parse(`{}`)
+		e.SetString("a.b", "x").SetInt("c[0]", 1).SetBoolAt(`d["e.f"]`, true)
+		Expect(e.Err()).To(BeNil())
+		Expect(str(e)).To(Equal(`{"a.b":"x","c[0]":1,"d":{"e.f":true}}`))
+	})
+
+	It("records the first error of chained setters", func() {
+		e := parse(`{"a":1}`)
+		e.SetStringAt("a.b", "x").SetInt("c", 1)
+		Expect(e.Err()).NotTo(BeNil())
+		Expect(str(e)).To(Equal(`{"a":1,"c":1}`))
+
+		Expect(e.Set("arr", []interface{}{})).To(BeNil())
+		Expect(e.Set("arr[1]", 1)).NotTo(BeNil())
+		Expect(e.SetJSON("raw", `{"bad"`)).NotTo(BeNil())
+		Expect(e.Set("ch", make(chan int))).NotTo(BeNil())
+		Expect(e.Set("nan", gomath.NaN())).NotTo(BeNil())
+		Expect(e.Set("inf", gomath.Inf(-1))).NotTo(BeNil())
+		Expect(str(e)).To(Equal(`{"a":1,"c":1,"arr":[]}`))
+	})
+
+	It("deletes, renames, moves and copies", func() {
+		e := parse(`{"a":{"b":1,"c":[1,2,3]},"d":"x"}`)
+
+		Expect(e.Delete("a.c[1]")).To(BeNil())
+		Expect(e.Delete("missing")).To(Equal(errors.ErrJSONPathNotFound))
+		Expect(e.Rename("a.b", "bb")).To(BeNil())
+		Expect(e.Move("d", "a.d")).To(BeNil())
+		Expect(e.Copy("a.c", "c")).To(BeNil())
+		Expect(str(e)).To(Equal(`{"a":{"c":[1,3],"bb":1,"d":"x"},"c":[1,3]}`))
+
+		//copies are independent
+		Expect(e.Set("c[0]", 9)).To(BeNil())
+		Expect(str(e)).To(Equal(`{"a":{"c":[1,3],"bb":1,"d":"x"},"c":[9,3]}`))
+
+		Expect(e.Move("a", "a.x")).NotTo(BeNil())
+		Expect(e.Move("a", "a")).To(BeNil())
+		Expect(e.Move("a.d", "a")).To(BeNil())
+		Expect(str(e)).To(Equal(`{"a":"x","c":[9,3]}`))
+	})
+
+	It("keeps values that can't be moved", func() {
+		e := parse(`{"a":1,"b":[],"c":"x"}`)
+		Expect(e.Move("a", "b[1]")).NotTo(BeNil())
+		Expect(e.Move("a", "c.d")).NotTo(BeNil())
+		Expect(e.Rename("b[0]", "x")).NotTo(BeNil())
+		Expect(str(e)).To(Equal(`{"a":1,"b":[],"c":"x"}`))
+	})
+
+	It("fails mapping when setters fail", func() {
+		fn := pkgjson.Mapper(func(e *pkgjson.Event) *pkgjson.Event {
+			return e.SetStringAt("id.x", "y")
+		})
+		_, err := fn(&types.Event{})
+		Expect(err).NotTo(BeNil())
+
+		evt := types.NewEventFromBytes([]byte(`{"id":1}`))
+		_, err = fn(&evt)
+		Expect(err).NotTo(BeNil())
+	})
+})
+
+var _ = Describe("Json schema validation", func() {
+
+	schemaJSON := `{
+		"type": "object",
+		"required": ["id", "kind"],
+		"properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"kind": {"enum": ["click", "view"]},
+			"email": {"type": "string", "pattern": "^[^@]+@[^@]+$", "maxLength": 20},
+			"user": {
+				"type": "object",
+				"properties": {"name": {"type": "string", "minLength": 1}},
+				"additionalProperties": false
+			},
+			"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+			"pair": {"items": [{"type": "number"}, {"type": "null"}]}
+		}
+	}`
+
+	var schema *pkgjson.Schema
+
+	validate := func(s string) pkgjson.ValidationErrors {
+		v, err := fastjson.Parse(s)
+		Expect(err).To(BeNil())
+		return schema.Validate(v)
+	}
+
+	BeforeEach(func() {
+		var err error
+		schema, err = pkgjson.CompileSchema([]byte(schemaJSON))
+		Expect(err).To(BeNil())
+	})
+
+	It("accepts valid documents", func() {
+		Expect(validate(`{"id":1,"kind":"click"}`)).To(BeNil())
+		Expect(validate(`{"id":2.0,"kind":"view","email":"a@b.c","user":{"name":"x"},"tags":["a"],"pair":[1.5,null]}`)).To(BeNil())
+	})
+
+	It("reports all errors with their paths", func() {
+		errs := validate(`{"id":0.5,"kind":"buy","email":"nope","user":{"name":"","age":3},"tags":["a",1,"c"],"pair":["x",null]}`)
+		Expect(errs).To(ConsistOf(
+			pkgjson.ValidationError{Path: "id", Message: "expected integer, got number"},
+			pkgjson.ValidationError{Path: "kind", Message: "value is not one of the allowed values"},
+			pkgjson.ValidationError{Path: "email", Message: "must match pattern ^[^@]+@[^@]+$"},
+			pkgjson.ValidationError{Path: "user.name", Message: "length must be at least 1"},
+			pkgjson.ValidationError{Path: "user.age", Message: "additional property is not allowed"},
+			pkgjson.ValidationError{Path: "tags", Message: "must have at most 2 items"},
+			pkgjson.ValidationError{Path: "tags[1]", Message: "expected string, got integer"},
+			pkgjson.ValidationError{Path: "pair[0]", Message: "expected number, got string"},
+		))
+
+		errs = validate(`[]`)
+		Expect(errs).To(HaveLen(1))
+		Expect(errs.Error()).To(Equal("expected object, got array"))
+
+		errs = validate(`{}`)
+		Expect(errs.Error()).To(Equal(`missing required property "id"; missing required property "kind"`))
+	})
+
+	It("fails to compile invalid schemas", func() {
+		for _, bad := range []string{`1`, `{"type":"thing"}`, `{"pattern":"("}`, `{"$ref":"#/x"}`, `{"properties":{"a":{"minLength":-1}}}`} {
+			_, err := pkgjson.CompileSchema([]byte(bad))
+			Expect(err).NotTo(BeNil(), bad)
+		}
+	})
+
+	It("routes invalid events to reject sink", func() {
+		valid := buffer.NewSink()
+		reject := buffer.NewSink()
+		validator, err := pkgjson.NewValidator(pkgjson.ValidatorConfig{
+			Schema: schema,
+			Reject: reject,
+		})
+		Expect(err).To(BeNil())
+
+		sink, err := filter.NewSink(valid, validator.Filter)
+		Expect(err).To(BeNil())
+		Expect(sink.Drain(internal.StringsToEvents([]string{`{"id":1,"kind":"view"}`, `{"id":1}`, `nope`}))).To(BeNil())
+
+		Expect(valid.Events).To(Equal(internal.StringsToEvents([]string{`{"id":1,"kind":"view"}`})))
+		Expect(reject.Events).To(HaveLen(2))
+		Expect(reject.Events[0].String()).To(Equal(`{"event":{"id":1},"errors":[{"path":"","message":"missing required property \"kind\""}]}`))
+		Expect(reject.Events[1].String()).To(HavePrefix(`{"event":"nope","errors":[{"path":"","message":`))
+	})
+
+	It("fails invalid events without reject sink", func() {
+		validator, err := pkgjson.NewValidator(pkgjson.ValidatorConfig{Schema: schema})
+		Expect(err).To(BeNil())
+
+		e := types.NewEventFromBytes([]byte(`{"id":1}`))
+		filtered, err := validator.Filter(&e)
+		Expect(filtered).To(BeNil())
+		Expect(err).To(BeAssignableToTypeOf(pkgjson.ValidationErrors{}))
+	})
+})
+
+var _ = Describe("Json transform specs", func() {
+
+	It("runs spec fixtures from yaml and json", func() {
+		for _, filename := range []string{"testdata/spec.yaml", "testdata/spec.json"} {
+			spec, err := pkgjson.LoadSpec(filename)
+			Expect(err).To(BeNil())
+			Expect(spec.Test()).To(BeNil(), filename)
+		}
+	})
+
+	It("reports failing fixtures", func() {
+		spec, err := pkgjson.ParseSpecJSON([]byte(`{
+			"steps": [{"op": "set", "path": "a", "value": 1}],
+			"tests": [
+				{"name": "ok", "in": {}, "out": {"a": 1}},
+				{"name": "wrong", "in": {}, "out": {"a": 2}},
+				{"name": "no error", "in": {}, "error": true}
+			]
+		}`))
+		Expect(err).To(BeNil())
+		err = spec.Test()
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(Equal("2 of 3 tests failed:\n" +
+			`wrong: expected {"a":2}, got {"a":1}` + "\n" +
+			`no error: expected error, got {"a":1}`))
+	})
+
+	It("maps events with compiled specs", func() {
+		spec, err := pkgjson.ParseSpecYAML([]byte(`
+steps:
+  - {op: set, path: s, value: 'quote "'}
+  - {op: rename, path: a, to: b}
+`))
+		Expect(err).To(BeNil())
+		fn, err := spec.Compile()
+		Expect(err).To(BeNil())
+
+		evt := types.NewEventFromBytes([]byte(`{"a":1}`))
+		mapped, err := pkgjson.Mapper(fn)(&evt)
+		Expect(err).To(BeNil())
+		Expect(mapped.String()).To(Equal(`{"s":"quote \"","b":1}`))
+	})
+
+	It("matches null values", func() {
+		yamlSpec, err := pkgjson.ParseSpecYAML([]byte(`
+steps:
+  - op: if
+    when: {path: a, equals: null}
+    then: [{op: set, path: isNull, value: true}]
+tests:
+  - {in: {a: null}, out: {a: null, isNull: true}}
+  - {in: {a: 0}, out: {a: 0}}
+  - {in: {}, out: {}}
+`))
+		Expect(err).To(BeNil())
+		Expect(yamlSpec.Test()).To(BeNil())
+
+		jsonSpec, err := pkgjson.ParseSpecJSON([]byte(`{
+			"steps": [{"op": "if", "when": {"path": "a", "equals": null, "not": true}, "then": [{"op": "remove", "path": "a"}]}],
+			"tests": [{"in": {"a": null}, "out": {"a": null}}, {"in": {"a": 1}, "out": {}}]
+		}`))
+		Expect(err).To(BeNil())
+		Expect(jsonSpec.Test()).To(BeNil())
+
+		_, err = pkgjson.ParseSpecJSON([]byte(`{"steps":[{"op":"if","when":{"path":"a","equal":null}}]}`))
+		Expect(err).NotTo(BeNil())
+		_, err = pkgjson.ParseSpecYAML([]byte("steps:\n  - {op: if, when: {path: a, equal: null}}\n"))
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("fails casting non-finite numbers", func() {
+		spec, err := pkgjson.ParseSpecYAML([]byte(`
+steps:
+  - {op: cast, path: f, type: float}
+tests:
+  - {in: {f: "1.5"}, out: {f: 1.5}}
+  - {in: {f: "NaN"}, error: true}
+  - {in: {f: "Infinity"}, error: true}
+  - {in: {f: "-Inf"}, error: true}
+  - {in: {f: "1e400"}, error: true}
+`))
+		Expect(err).To(BeNil())
+		Expect(spec.Test()).To(BeNil())
+	})
+
+	It("fails templates with missing values, unless allowed", func() {
+		spec, err := pkgjson.ParseSpecYAML([]byte(`
+steps:
+  - {op: template, path: label, template: "{{a}}-{{b}}"}
+tests:
+  - {in: {a: 1, b: x}, out: {a: 1, b: x, label: 1-x}}
+  - {in: {a: 1}, error: true}
+`))
+		Expect(err).To(BeNil())
+		Expect(spec.Test()).To(BeNil())
+
+		spec, err = pkgjson.ParseSpecYAML([]byte(`
+steps:
+  - {op: template, path: label, template: "{{a}}-{{b}}", allowMissing: true}
+tests:
+  - {in: {a: 1}, out: {a: 1, label: 1-}}
+`))
+		Expect(err).To(BeNil())
+		Expect(spec.Test()).To(BeNil())
+	})
+
+	It("fails compiling invalid specs with the location of the step", func() {
+		bad := map[string]string{
+			`{"steps":[{"op":"set","path":"a..b"}]}`:                                                      `steps[0] (set): path: empty key in path "a..b" at 2`,
+			`{"steps":[{"op":"nope","path":"a"}]}`:                                                        `steps[0] (nope): unknown op "nope"`,
+			`{"steps":[{"op":"cast","path":"a","type":"date"}]}`:                                          `steps[0] (cast): unknown type "date", expected string, int, float or bool`,
+			`{"steps":[{"op":"rename","path":"a"}]}`:                                                      `steps[0] (rename): missing to`,
+			`{"steps":[{"op":"move","path":"a","to":"a.b"}]}`:                                             `steps[0] (move): can't move a into itself`,
+			`{"steps":[{"op":"template","path":"a","template":"{{b[}}"}]}`:                                `steps[0] (template): template: unterminated index in path "b[" at 1`,
+			`{"steps":[{"op":"if","when":{"path":"a"}}]}`:                                                 `steps[0] (if): when: exactly one of exists, equals, in and matches must be set`,
+			`{"steps":[{"op":"if","when":{"path":"a","exists":true},"then":[{"op":"copy","path":"a"}]}]}`: `steps[0].then[0] (copy): to: empty path`,
+		}
+		for raw, msg := range bad {
+			spec, err := pkgjson.ParseSpecJSON([]byte(raw))
+			Expect(err).To(BeNil())
+			_, err = spec.Compile()
+			Expect(err).NotTo(BeNil(), raw)
+			Expect(err.Error()).To(Equal(msg))
+		}
+
+		_, err := pkgjson.ParseSpecJSON([]byte(`{"steps":[{"op":"set","path":"a","valeu":1}]}`))
+		Expect(err).NotTo(BeNil())
+		_, err = pkgjson.ParseSpecYAML([]byte("steps:\n  - {op: set, path: a, valeu: 1}\n"))
+		Expect(err).NotTo(BeNil())
+	})
+})
@@ -0,0 +1,301 @@
+package json
+
+import (
+	"fmt"
+	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/valyala/fastjson"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Path is a parsed path to a value in a json document.
+
+Paths are dotted keys, with brackets for array indices and for keys
+that contain dots or brackets:
+
+	user.name
+	items[0].id
+	tags["k8s.io/name"]
+
+A dotted key that is a number indexes arrays, and is a key in objects.
+*/
+type Path []PathSegment
+
+//PathSegment is one step of a Path, either an object key or an array index.
+type PathSegment struct {
+	Key     string
+	Index   int
+	IsIndex bool //true for bracketed indices, e.g. [0]
+}
+
+//ParsePath parses a dotted/bracket path.
+func ParsePath(path string) (Path, error) {
+	p := Path{}
+	i := 0
+	expectKey := true //a key may start at the beginning, and after dots
+
+	for i < len(path) {
+		switch c := path[i]; {
+		case c == '[':
+			end, seg, err := parseBracket(path, i)
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, seg)
+			i = end
+			expectKey = false
+		case c == '.':
+			if expectKey || i == len(path)-1 {
+				return nil, fmt.Errorf("empty key in path %q at %d", path, i)
+			}
+			i++
+			expectKey = true
+		default:
+			if !expectKey {
+				return nil, fmt.Errorf("missing dot in path %q at %d", path, i)
+			}
+			end := i
+			for end < len(path) && path[end] != '.' && path[end] != '[' {
+				if path[end] == ']' {
+					return nil, fmt.Errorf("unexpected ] in path %q at %d", path, end)
+				}
+				end++
+			}
+			p = append(p, PathSegment{Key: path[i:end]})
+			i = end
+			expectKey = false
+		}
+	}
+
+	if len(p) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+	return p, nil
+}
+
+//parseBracket parses a bracketed index or quoted key starting at start
+func parseBracket(path string, start int) (int, PathSegment, error) {
+	i := start + 1
+	if i < len(path) && (path[i] == '"' || path[i] == '\'') {
+		quote := path[i]
+		var b strings.Builder
+		for i++; i < len(path) && path[i] != quote; i++ {
+			if path[i] == '\\' && i+1 < len(path) {
+				i++
+			}
+			b.WriteByte(path[i])
+		}
+		if i+1 >= len(path) || path[i+1] != ']' {
+			return 0, PathSegment{}, fmt.Errorf("unterminated key in path %q at %d", path, start)
+		}
+		return i + 2, PathSegment{Key: b.String()}, nil
+	}
+
+	end := strings.IndexByte(path[i:], ']')
+	if end < 0 {
+		return 0, PathSegment{}, fmt.Errorf("unterminated index in path %q at %d", path, start)
+	}
+	n, err := strconv.Atoi(path[i : i+end])
+	if err != nil || n < 0 {
+		return 0, PathSegment{}, fmt.Errorf("invalid index in path %q at %d", path, start)
+	}
+	return i + end + 1, PathSegment{Index: n, IsIndex: true}, nil
+}
+
+//String formats the path so that ParsePath reads it back.
+func (p Path) String() string {
+	var b strings.Builder
+	for i, seg := range p {
+		switch {
+		case seg.IsIndex:
+			b.WriteString("[" + strconv.Itoa(seg.Index) + "]")
+		case seg.Key == "" || strings.ContainsAny(seg.Key, ".[]"):
+			b.WriteString(`["` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(seg.Key) + `"]`)
+		default:
+			if i > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(seg.Key)
+		}
+	}
+	return b.String()
+}
+
+//Get returns the value at path in v, or ErrJSONPathNotFound.
+func (p Path) Get(v *fastjson.Value) (*fastjson.Value, error) {
+	for _, seg := range p {
+		if v = child(v, seg); v == nil {
+			return nil, errors.ErrJSONPathNotFound
+		}
+	}
+	return v, nil
+}
+
+/*
+Set sets value at path in v, creating missing objects and arrays
+along the way. Array indices can at most be the length of the array,
+which appends to it.
+*/
+func (p Path) Set(arena *fastjson.Arena, v *fastjson.Value, value *fastjson.Value) error {
+	for i, seg := range p[:len(p)-1] {
+		next := child(v, seg)
+		if next == nil {
+			if p[i+1].IsIndex {
+				next = arena.NewArray()
+			} else {
+				next = arena.NewObject()
+			}
+			if err := setChild(v, seg, next); err != nil {
+				return fmt.Errorf("%s: %s", p[:i+1], err)
+			}
+		}
+		v = next
+	}
+
+	if err := setChild(v, p[len(p)-1], value); err != nil {
+		return fmt.Errorf("%s: %s", p, err)
+	}
+	return nil
+}
+
+//Delete removes the value at path in v, or returns ErrJSONPathNotFound.
+func (p Path) Delete(v *fastjson.Value) error {
+	parent, err := p[:len(p)-1].Get(v)
+	if err != nil {
+		return err
+	}
+	last := p[len(p)-1]
+	if child(parent, last) == nil {
+		return errors.ErrJSONPathNotFound
+	}
+	if last.IsIndex {
+		parent.Del(strconv.Itoa(last.Index))
+	} else {
+		parent.Del(last.Key)
+	}
+	return nil
+}
+
+//child returns the value of seg in v, nil if it doesn't exist
+func child(v *fastjson.Value, seg PathSegment) *fastjson.Value {
+	switch v.Type() {
+	case fastjson.TypeObject:
+		if seg.IsIndex {
+			return nil
+		}
+		return v.GetObject().Get(seg.Key)
+	case fastjson.TypeArray:
+		idx, ok := index(seg)
+		arr := v.GetArray()
+		if !ok || idx >= len(arr) {
+			return nil
+		}
+		return arr[idx]
+	}
+	return nil
+}
+
+//setChild sets value of seg in v
+func setChild(v *fastjson.Value, seg PathSegment, value *fastjson.Value) error {
+	switch v.Type() {
+	case fastjson.TypeObject:
+		if seg.IsIndex {
+			return fmt.Errorf("can't index object with [%d]", seg.Index)
+		}
+		v.Set(seg.Key, value)
+		return nil
+	case fastjson.TypeArray:
+		idx, ok := index(seg)
+		if !ok {
+			return fmt.Errorf("can't set key %q of array", seg.Key)
+		}
+		if n := len(v.GetArray()); idx > n {
+			return fmt.Errorf("index %d out of range of array of length %d", idx, n)
+		}
+		v.SetArrayItem(idx, value)
+		return nil
+	}
+	return fmt.Errorf("can't set child of %s", v.Type())
+}
+
+//index returns the array index of seg, including numeric keys
+func index(seg PathSegment) (int, bool) {
+	if seg.IsIndex {
+		return seg.Index, true
+	}
+	n, err := strconv.Atoi(seg.Key)
+	return n, err == nil && n >= 0
+}
+
+//hasPrefix true iff prefix is a path to p or one of its ancestors
+func (p Path) hasPrefix(prefix Path) bool {
+	if len(prefix) > len(p) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != p[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+NewValue converts a go value to a json value allocated on arena.
+Supports nil, bools, ints, floats, strings, *fastjson.Value,
+and maps with string keys and slices of those. Map keys are sorted.
+Floats that are NaN or infinite fail, since json can't represent them.
+*/
+func NewValue(arena *fastjson.Arena, value interface{}) (*fastjson.Value, error) {
+	switch v := value.(type) {
+	case nil:
+		return arena.NewNull(), nil
+	case *fastjson.Value:
+		return v, nil
+	case bool:
+		if v {
+			return arena.NewTrue(), nil
+		}
+		return arena.NewFalse(), nil
+	case string:
+		return arena.NewString(v), nil
+	case int:
+		return arena.NewNumberInt(v), nil
+	case int64:
+		return arena.NewNumberString(strconv.FormatInt(v, 10)), nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%v isn't a valid json number", v)
+		}
+		return arena.NewNumberFloat64(v), nil
+	case map[string]interface{}:
+		obj := arena.NewObject()
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			child, err := NewValue(arena, v[key])
+			if err != nil {
+				return nil, err
+			}
+			obj.Set(key, child)
+		}
+		return obj, nil
+	case []interface{}:
+		arr := arena.NewArray()
+		for i, item := range v {
+			child, err := NewValue(arena, item)
+			if err != nil {
+				return nil, err
+			}
+			arr.SetArrayItem(i, child)
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("unsupported json value type %T", value)
+}
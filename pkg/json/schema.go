@@ -0,0 +1,471 @@
+package json
+
+import (
+	"fmt"
+	"github.com/valyala/fastjson"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+Schema is a compiled JSON Schema, supporting a subset of draft-07:
+
+	type, enum, const
+	properties, required, additionalProperties
+	items (single schema or tuple), minItems, maxItems
+	pattern, minLength, maxLength
+	minimum, maximum, exclusiveMinimum, exclusiveMaximum
+	boolean schemas
+
+Other keywords are ignored, except $ref which fails compilation
+since it isn't supported.
+*/
+type Schema struct {
+	always           *bool //true/false schemas
+	types            []string
+	enum             []*fastjson.Value
+	constant         *fastjson.Value
+	properties       map[string]*Schema
+	propertyNames    []string //sorted, for ordered errors
+	required         []string
+	additional       *Schema
+	items            *Schema
+	tupleItems       []*Schema
+	minItems         *int
+	maxItems         *int
+	pattern          *regexp.Regexp
+	minLength        *int
+	maxLength        *int
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+}
+
+//ValidationError is one way a value fails a schema.
+type ValidationError struct {
+	Path    string //path of the invalid value, as formatted by Path.String, empty for the document
+	Message string
+}
+
+//ValidationErrors are all the ways a value fails a schema.
+type ValidationErrors []ValidationError
+
+//validTypes are the types of draft-07
+var validTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+//Error implements error interface
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+//Error implements error interface
+func (err ValidationError) Error() string {
+	if err.Path == "" {
+		return err.Message
+	}
+	return err.Path + ": " + err.Message
+}
+
+//Value returns the errors as a json array of {"path","message"} objects.
+func (errs ValidationErrors) Value(arena *fastjson.Arena) *fastjson.Value {
+	arr := arena.NewArray()
+	for i, err := range errs {
+		obj := arena.NewObject()
+		obj.Set("path", arena.NewString(err.Path))
+		obj.Set("message", arena.NewString(err.Message))
+		arr.SetArrayItem(i, obj)
+	}
+	return arr
+}
+
+//CompileSchema compiles a json schema document.
+func CompileSchema(raw []byte) (*Schema, error) {
+	v, err := fastjson.ParseBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	return compileSchema(v, Path{})
+}
+
+//compileSchema compiles the schema v, found at path in the schema document
+func compileSchema(v *fastjson.Value, path Path) (*Schema, error) {
+	s := &Schema{}
+	fail := func(format string, args ...interface{}) (*Schema, error) {
+		return nil, fmt.Errorf("schema %s: %s", path, fmt.Sprintf(format, args...))
+	}
+
+	switch v.Type() {
+	case fastjson.TypeTrue, fastjson.TypeFalse:
+		always := v.Type() == fastjson.TypeTrue
+		s.always = &always
+		return s, nil
+	case fastjson.TypeObject:
+	default:
+		return fail("must be an object or boolean")
+	}
+
+	var err error
+	v.GetObject().Visit(func(key []byte, kv *fastjson.Value) {
+		if err != nil {
+			return
+		}
+		keyPath := childPath(path, PathSegment{Key: string(key)})
+
+		switch string(key) {
+		case "$ref":
+			err = fmt.Errorf("schema %s: $ref is not supported", keyPath)
+		case "type":
+			err = s.compileType(kv, keyPath)
+		case "enum":
+			s.enum, err = kv.Array()
+		case "const":
+			s.constant = kv
+		case "properties":
+			s.properties = map[string]*Schema{}
+			var obj *fastjson.Object
+			if obj, err = kv.Object(); err != nil {
+				return
+			}
+			obj.Visit(func(name []byte, pv *fastjson.Value) {
+				if err != nil {
+					return
+				}
+				var prop *Schema
+				prop, err = compileSchema(pv, childPath(keyPath, PathSegment{Key: string(name)}))
+				s.properties[string(name)] = prop
+				s.propertyNames = append(s.propertyNames, string(name))
+			})
+			sort.Strings(s.propertyNames)
+		case "required":
+			var arr []*fastjson.Value
+			if arr, err = kv.Array(); err != nil {
+				return
+			}
+			for _, item := range arr {
+				var name []byte
+				if name, err = item.StringBytes(); err != nil {
+					return
+				}
+				s.required = append(s.required, string(name))
+			}
+		case "additionalProperties":
+			s.additional, err = compileSchema(kv, keyPath)
+		case "items":
+			if kv.Type() == fastjson.TypeArray {
+				for i, item := range kv.GetArray() {
+					var tuple *Schema
+					if tuple, err = compileSchema(item, childPath(keyPath, PathSegment{Index: i, IsIndex: true})); err != nil {
+						return
+					}
+					s.tupleItems = append(s.tupleItems, tuple)
+				}
+			} else {
+				s.items, err = compileSchema(kv, keyPath)
+			}
+		case "pattern":
+			var pattern []byte
+			if pattern, err = kv.StringBytes(); err != nil {
+				return
+			}
+			s.pattern, err = regexp.Compile(string(pattern))
+		case "minLength":
+			s.minLength, err = compileCount(kv)
+		case "maxLength":
+			s.maxLength, err = compileCount(kv)
+		case "minItems":
+			s.minItems, err = compileCount(kv)
+		case "maxItems":
+			s.maxItems, err = compileCount(kv)
+		case "minimum":
+			s.minimum, err = compileNumber(kv)
+		case "maximum":
+			s.maximum, err = compileNumber(kv)
+		case "exclusiveMinimum":
+			s.exclusiveMinimum, err = compileNumber(kv)
+		case "exclusiveMaximum":
+			s.exclusiveMaximum, err = compileNumber(kv)
+		}
+
+		if err != nil && !strings.HasPrefix(err.Error(), "schema ") {
+			err = fmt.Errorf("schema %s: %s", keyPath, err)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//compileType compiles the type keyword
+func (s *Schema) compileType(v *fastjson.Value, path Path) error {
+	types := []*fastjson.Value{v}
+	if v.Type() == fastjson.TypeArray {
+		types = v.GetArray()
+	}
+	for _, t := range types {
+		name, err := t.StringBytes()
+		if err != nil {
+			return err
+		}
+		if !validTypes[string(name)] {
+			return fmt.Errorf("schema %s: unknown type %q", path, name)
+		}
+		s.types = append(s.types, string(name))
+	}
+	return nil
+}
+
+//compileCount compiles non-negative integer keywords
+func compileCount(v *fastjson.Value) (*int, error) {
+	n, err := v.Int()
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("must be a non-negative integer")
+	}
+	return &n, nil
+}
+
+//compileNumber compiles number keywords
+func compileNumber(v *fastjson.Value) (*float64, error) {
+	f, err := v.Float64()
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+//Validate validates v against the schema, returns nil if it's valid.
+func (s *Schema) Validate(v *fastjson.Value) ValidationErrors {
+	errs := ValidationErrors{}
+	s.validate(v, Path{}, &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+//validate appends errors of v at path to errs
+func (s *Schema) validate(v *fastjson.Value, path Path, errs *ValidationErrors) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, ValidationError{
+			Path:    path.String(),
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if s.always != nil {
+		if !*s.always {
+			fail("no value is allowed")
+		}
+		return
+	}
+
+	if len(s.types) > 0 && !s.hasType(v) {
+		fail("expected %s, got %s", strings.Join(s.types, " or "), typeName(v))
+		return
+	}
+
+	if s.enum != nil {
+		found := false
+		for _, e := range s.enum {
+			if equal(v, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value is not one of the allowed values")
+		}
+	}
+	if s.constant != nil && !equal(v, s.constant) {
+		fail("value must be %s", s.constant.MarshalTo(nil))
+	}
+
+	switch v.Type() {
+	case fastjson.TypeObject:
+		s.validateObject(v.GetObject(), path, errs)
+	case fastjson.TypeArray:
+		s.validateArray(v.GetArray(), path, errs)
+	case fastjson.TypeString:
+		str := string(v.GetStringBytes())
+		n := utf8.RuneCountInString(str)
+		if s.minLength != nil && n < *s.minLength {
+			fail("length must be at least %d", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			fail("length must be at most %d", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			fail("must match pattern %s", s.pattern)
+		}
+	case fastjson.TypeNumber:
+		f := v.GetFloat64()
+		if s.minimum != nil && f < *s.minimum {
+			fail("must be at least %v", *s.minimum)
+		}
+		if s.maximum != nil && f > *s.maximum {
+			fail("must be at most %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && f <= *s.exclusiveMinimum {
+			fail("must be greater than %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && f >= *s.exclusiveMaximum {
+			fail("must be less than %v", *s.exclusiveMaximum)
+		}
+	}
+}
+
+//validateObject validates properties of an object
+func (s *Schema) validateObject(obj *fastjson.Object, path Path, errs *ValidationErrors) {
+	for _, name := range s.required {
+		if obj.Get(name) == nil {
+			*errs = append(*errs, ValidationError{
+				Path:    path.String(),
+				Message: fmt.Sprintf("missing required property %q", name),
+			})
+		}
+	}
+
+	for _, name := range s.propertyNames {
+		if pv := obj.Get(name); pv != nil {
+			s.properties[name].validate(pv, childPath(path, PathSegment{Key: name}), errs)
+		}
+	}
+
+	if s.additional != nil {
+		obj.Visit(func(key []byte, pv *fastjson.Value) {
+			if _, ok := s.properties[string(key)]; !ok {
+				childP := childPath(path, PathSegment{Key: string(key)})
+				if s.additional.always != nil && !*s.additional.always {
+					*errs = append(*errs, ValidationError{
+						Path:    childP.String(),
+						Message: "additional property is not allowed",
+					})
+					return
+				}
+				s.additional.validate(pv, childP, errs)
+			}
+		})
+	}
+}
+
+//validateArray validates items of an array
+func (s *Schema) validateArray(arr []*fastjson.Value, path Path, errs *ValidationErrors) {
+	if s.minItems != nil && len(arr) < *s.minItems {
+		*errs = append(*errs, ValidationError{
+			Path:    path.String(),
+			Message: fmt.Sprintf("must have at least %d items", *s.minItems),
+		})
+	}
+	if s.maxItems != nil && len(arr) > *s.maxItems {
+		*errs = append(*errs, ValidationError{
+			Path:    path.String(),
+			Message: fmt.Sprintf("must have at most %d items", *s.maxItems),
+		})
+	}
+
+	for i, item := range arr {
+		itemSchema := s.items
+		if s.tupleItems != nil {
+			itemSchema = nil
+			if i < len(s.tupleItems) {
+				itemSchema = s.tupleItems[i]
+			}
+		}
+		if itemSchema != nil {
+			itemSchema.validate(item, childPath(path, PathSegment{Index: i, IsIndex: true}), errs)
+		}
+	}
+}
+
+//hasType true iff v is one of the schema's types
+func (s *Schema) hasType(v *fastjson.Value) bool {
+	name := typeName(v)
+	for _, t := range s.types {
+		if t == name {
+			return true
+		}
+		if t == "number" && name == "integer" {
+			return true
+		}
+		if t == "integer" && name == "number" {
+			f := v.GetFloat64()
+			if f == math.Trunc(f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//typeName returns schema type name of v, numbers without fraction are integers
+func typeName(v *fastjson.Value) string {
+	switch v.Type() {
+	case fastjson.TypeNull:
+		return "null"
+	case fastjson.TypeTrue, fastjson.TypeFalse:
+		return "boolean"
+	case fastjson.TypeObject:
+		return "object"
+	case fastjson.TypeArray:
+		return "array"
+	case fastjson.TypeString:
+		return "string"
+	}
+	if strings.ContainsAny(v.String(), ".eE") {
+		return "number"
+	}
+	return "integer"
+}
+
+//equal true iff a and b are equal json values
+func equal(a *fastjson.Value, b *fastjson.Value) bool {
+	if a.Type() != b.Type() {
+		return false
+	}
+	switch a.Type() {
+	case fastjson.TypeNumber:
+		return a.GetFloat64() == b.GetFloat64()
+	case fastjson.TypeString:
+		return string(a.GetStringBytes()) == string(b.GetStringBytes())
+	case fastjson.TypeArray:
+		aa, ba := a.GetArray(), b.GetArray()
+		if len(aa) != len(ba) {
+			return false
+		}
+		for i := range aa {
+			if !equal(aa[i], ba[i]) {
+				return false
+			}
+		}
+		return true
+	case fastjson.TypeObject:
+		ao, bo := a.GetObject(), b.GetObject()
+		if ao.Len() != bo.Len() {
+			return false
+		}
+		eq := true
+		ao.Visit(func(key []byte, av *fastjson.Value) {
+			if bv := bo.Get(string(key)); eq && (bv == nil || !equal(av, bv)) {
+				eq = false
+			}
+		})
+		return eq
+	}
+	return true
+}
+
+//childPath returns a new path to seg of path
+func childPath(path Path, seg PathSegment) Path {
+	return append(append(Path{}, path...), seg)
+}
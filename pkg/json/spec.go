@@ -0,0 +1,616 @@
+package json
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/valyala/fastjson"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+Spec is a declarative transformation, that compiles into a TransformerFn.
+Specs are loaded from json or yaml:
+
+	steps:
+	  - op: set
+	    path: meta.source
+	    value: web
+	  - op: rename
+	    path: ts
+	    to: timestamp
+	  - op: cast
+	    path: count
+	    type: int
+	  - op: if
+	    when: {path: kind, equals: click}
+	    then:
+	      - op: template
+	        path: label
+	        template: "{{user.name}} clicked {{target}}"
+	tests:
+	  - name: clicks are labeled
+	    in: {kind: click, user: {name: a}, target: b, ts: 1, count: "2"}
+	    out: {kind: click, user: {name: a}, target: b, count: 2, meta: {source: web}, timestamp: 1, label: a clicked b}
+
+Steps operating on paths that don't exist in an event do nothing,
+except set and default.
+*/
+type Spec struct {
+	Steps []Step    `json:"steps" yaml:"steps"`
+	Tests []Fixture `json:"tests,omitempty" yaml:"tests,omitempty"`
+}
+
+/*
+Step is one operation of a Spec. Op is one of:
+
+	set       sets Value at Path
+	default   sets Value at Path if there's no value there
+	remove    removes the value at Path
+	rename    renames the key at Path to To, in the same object
+	move      moves the value at Path to the path To
+	copy      copies the value at Path to the path To
+	cast      converts the value at Path to Type: string, int, float or bool
+	template  sets a string at Path, replacing {{path}} in Template with values of the event.
+	          Paths without values fail, unless AllowMissing is set, which renders them as ""
+	if        runs Then steps when the When condition is true, and Else steps otherwise
+*/
+type Step struct {
+	Op           string      `json:"op" yaml:"op"`
+	Path         string      `json:"path,omitempty" yaml:"path,omitempty"`
+	To           string      `json:"to,omitempty" yaml:"to,omitempty"`
+	Value        interface{} `json:"value,omitempty" yaml:"value,omitempty"`
+	Type         string      `json:"type,omitempty" yaml:"type,omitempty"`
+	Template     string      `json:"template,omitempty" yaml:"template,omitempty"`
+	AllowMissing bool        `json:"allowMissing,omitempty" yaml:"allowMissing,omitempty"`
+	When         *Condition  `json:"when,omitempty" yaml:"when,omitempty"`
+	Then         []Step      `json:"then,omitempty" yaml:"then,omitempty"`
+	Else         []Step      `json:"else,omitempty" yaml:"else,omitempty"`
+}
+
+/*
+Condition is a test on the value at Path. Exactly one of Exists, Equals, In and Matches must be set.
+
+Specs match null with `equals: null`. Conditions made in code can't tell a nil
+Equals from an unset one, so they match null with In: []interface{}{nil}.
+*/
+type Condition struct {
+	Path      string        `json:"path" yaml:"path"`
+	Exists    *bool         `json:"exists,omitempty" yaml:"exists,omitempty"`
+	Equals    interface{}   `json:"equals,omitempty" yaml:"equals,omitempty"`
+	In        []interface{} `json:"in,omitempty" yaml:"in,omitempty"`
+	Matches   string        `json:"matches,omitempty" yaml:"matches,omitempty"`
+	Not       bool          `json:"not,omitempty" yaml:"not,omitempty"` //negates the condition
+	hasEquals bool          //true when equals was parsed, including equals: null
+}
+
+//Fixture is a sample event and the expected result of transforming it.
+type Fixture struct {
+	Name  string      `json:"name" yaml:"name"`
+	In    interface{} `json:"in" yaml:"in"`
+	Out   interface{} `json:"out,omitempty" yaml:"out,omitempty"`
+	Error bool        `json:"error,omitempty" yaml:"error,omitempty"` //true if the transformation is expected to fail
+}
+
+//condition has the fields of Condition, without its unmarshalers
+type condition Condition
+
+//UnmarshalJSON implements json.Unmarshaler, to tell equals: null from no equals.
+func (cond *Condition) UnmarshalJSON(b []byte) error {
+	c := condition{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	for key := range fields {
+		c.hasEquals = c.hasEquals || strings.EqualFold(key, "equals")
+	}
+	*cond = Condition(c)
+	return nil
+}
+
+//UnmarshalYAML implements yaml.Unmarshaler, to tell equals: null from no equals.
+func (cond *Condition) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	c := condition{}
+	if err := unmarshal(&c); err != nil {
+		return err
+	}
+	fields := map[string]interface{}{}
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	_, c.hasEquals = fields["equals"]
+	*cond = Condition(c)
+	return nil
+}
+
+//compiledStep runs one step on an event
+type compiledStep func(e *Event) error
+
+//compileError is an error of a step, prefixed with where the step is in the spec
+type compileError string
+
+//Error implements error interface
+func (err compileError) Error() string {
+	return string(err)
+}
+
+//templatePattern matches {{path}} placeholders
+var templatePattern = regexp.MustCompile(`{{\s*([^{}]*?)\s*}}`)
+
+//ParseSpecJSON parses a json spec. Unknown fields are errors.
+func ParseSpecJSON(b []byte) (*Spec, error) {
+	spec := &Spec{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+//ParseSpecYAML parses a yaml spec. Unknown fields are errors.
+func ParseSpecYAML(b []byte) (*Spec, error) {
+	spec := &Spec{}
+	if err := yaml.UnmarshalStrict(b, spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+//LoadSpec reads a spec from a file, as json if it has a .json extension and as yaml otherwise.
+func LoadSpec(filename string) (*Spec, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		return ParseSpecJSON(b)
+	}
+	return ParseSpecYAML(b)
+}
+
+//Compile compiles the spec into a TransformerFn, failing on invalid steps.
+//Errors of the TransformerFn are returned by Event.Err, and by Mapper.
+func (spec *Spec) Compile() (TransformerFn, error) {
+	steps, err := compileSteps(spec.Steps, "steps")
+	if err != nil {
+		return nil, err
+	}
+
+	return func(e *Event) *Event {
+		if e.err != nil {
+			return e
+		}
+		return e.chain(runSteps(steps, e))
+	}, nil
+}
+
+/*
+Test compiles the spec and runs its fixtures. Returns an error
+describing every fixture whose result isn't the expected output.
+*/
+func (spec *Spec) Test() error {
+	fn, err := spec.Compile()
+	if err != nil {
+		return err
+	}
+
+	failures := []string{}
+	for i, fixture := range spec.Tests {
+		name := fixture.Name
+		if name == "" {
+			name = fmt.Sprintf("tests[%d]", i)
+		}
+		if err := fixture.run(fn); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d tests failed:\n%s", len(failures), len(spec.Tests), strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+//run transforms fixture input and compares it to expected output
+func (fixture Fixture) run(fn TransformerFn) error {
+	arena := &fastjson.Arena{}
+	in, err := NewValue(arena, normalize(fixture.In))
+	if err != nil {
+		return err
+	}
+	//transform a copy, so values are not shared with the arena
+	v, err := fastjson.ParseBytes(in.MarshalTo(nil))
+	if err != nil {
+		return err
+	}
+
+	e := fn(&Event{V: v})
+	if fixture.Error {
+		if e.Err() == nil {
+			return fmt.Errorf("expected error, got %s", e.V.MarshalTo(nil))
+		}
+		return nil
+	}
+	if e.Err() != nil {
+		return e.Err()
+	}
+
+	out, err := NewValue(arena, normalize(fixture.Out))
+	if err != nil {
+		return err
+	}
+	if !equal(e.V, out) {
+		return fmt.Errorf("expected %s, got %s", out.MarshalTo(nil), e.V.MarshalTo(nil))
+	}
+	return nil
+}
+
+//compileSteps compiles steps, where is the location of steps in the spec for errors
+func compileSteps(steps []Step, where string) ([]compiledStep, error) {
+	compiled := make([]compiledStep, len(steps))
+	for i, step := range steps {
+		stepWhere := fmt.Sprintf("%s[%d]", where, i)
+		fn, err := step.compile(stepWhere)
+		if _, nested := err.(compileError); err != nil && !nested {
+			err = compileError(fmt.Sprintf("%s (%s): %s", stepWhere, step.Op, err))
+		}
+		if err != nil {
+			return nil, err
+		}
+		compiled[i] = fn
+	}
+	return compiled, nil
+}
+
+//runSteps runs steps in order, stopping on the first error
+func runSteps(steps []compiledStep, e *Event) error {
+	for _, step := range steps {
+		if err := step(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//compile compiles one step
+func (step Step) compile(where string) (compiledStep, error) {
+	if step.Op == "if" {
+		return step.compileIf(where)
+	}
+
+	path, err := ParsePath(step.Path)
+	if err != nil {
+		return nil, fmt.Errorf("path: %s", err)
+	}
+
+	var to Path
+	switch step.Op {
+	case "rename":
+		if step.To == "" {
+			return nil, fmt.Errorf("missing to")
+		}
+		if path[len(path)-1].IsIndex {
+			return nil, fmt.Errorf("can't rename array item %s", path)
+		}
+		to = childPath(path[:len(path)-1], PathSegment{Key: step.To})
+	case "move", "copy":
+		if to, err = ParsePath(step.To); err != nil {
+			return nil, fmt.Errorf("to: %s", err)
+		}
+	}
+
+	switch step.Op {
+	case "set", "default":
+		value := normalize(step.Value)
+		if _, err = NewValue(&fastjson.Arena{}, value); err != nil {
+			return nil, err
+		}
+		onlyMissing := step.Op == "default"
+		return func(e *Event) error {
+			if onlyMissing {
+				if _, err := path.Get(e.V); err == nil {
+					return nil
+				}
+			}
+			v, err := NewValue(&e.arena, value)
+			if err != nil {
+				return err
+			}
+			return path.Set(&e.arena, e.V, v)
+		}, nil
+
+	case "remove":
+		return func(e *Event) error {
+			path.Delete(e.V)
+			return nil
+		}, nil
+
+	case "rename", "move":
+		if to.hasPrefix(path) && len(to) > len(path) {
+			return nil, fmt.Errorf("can't move %s into itself", path)
+		}
+		return func(e *Event) error {
+			if _, err := path.Get(e.V); err != nil {
+				return nil
+			}
+			return e.move(path, to)
+		}, nil
+
+	case "copy":
+		return func(e *Event) error {
+			v, err := path.Get(e.V)
+			if err != nil {
+				return nil
+			}
+			cp, err := fastjson.ParseBytes(v.MarshalTo(nil))
+			if err != nil {
+				return err
+			}
+			return to.Set(&e.arena, e.V, cp)
+		}, nil
+
+	case "cast":
+		cast, ok := casts[step.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown type %q, expected string, int, float or bool", step.Type)
+		}
+		return func(e *Event) error {
+			v, err := path.Get(e.V)
+			if err != nil {
+				return nil
+			}
+			if v, err = cast(&e.arena, v); err != nil {
+				return fmt.Errorf("cast %s: %s", path, err)
+			}
+			return path.Set(&e.arena, e.V, v)
+		}, nil
+
+	case "template":
+		return compileTemplate(path, step.Template, step.AllowMissing)
+	}
+
+	return nil, fmt.Errorf("unknown op %q", step.Op)
+}
+
+//compileIf compiles conditional steps
+func (step Step) compileIf(where string) (compiledStep, error) {
+	if step.When == nil {
+		return nil, fmt.Errorf("missing when")
+	}
+	cond, err := step.When.compile()
+	if err != nil {
+		return nil, fmt.Errorf("when: %s", err)
+	}
+	then, err := compileSteps(step.Then, where+".then")
+	if err != nil {
+		return nil, err
+	}
+	otherwise, err := compileSteps(step.Else, where+".else")
+	if err != nil {
+		return nil, err
+	}
+
+	return func(e *Event) error {
+		if cond(e) {
+			return runSteps(then, e)
+		}
+		return runSteps(otherwise, e)
+	}, nil
+}
+
+//compile compiles a condition into a test of events
+func (cond *Condition) compile() (func(*Event) bool, error) {
+	path, err := ParsePath(cond.Path)
+	if err != nil {
+		return nil, fmt.Errorf("path: %s", err)
+	}
+
+	n := 0
+	hasEquals := cond.Equals != nil || cond.hasEquals
+	for _, set := range []bool{cond.Exists != nil, hasEquals, cond.In != nil, cond.Matches != ""} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return nil, fmt.Errorf("exactly one of exists, equals, in and matches must be set")
+	}
+
+	var test func(v *fastjson.Value) bool
+	switch {
+	case cond.Exists != nil:
+		exists := *cond.Exists
+		test = func(v *fastjson.Value) bool {
+			return (v != nil) == exists
+		}
+	case cond.Matches != "":
+		re, err := regexp.Compile(cond.Matches)
+		if err != nil {
+			return nil, fmt.Errorf("matches: %s", err)
+		}
+		test = func(v *fastjson.Value) bool {
+			return v != nil && v.Type() == fastjson.TypeString && re.Match(v.GetStringBytes())
+		}
+	default:
+		candidates := cond.In
+		if hasEquals {
+			candidates = []interface{}{cond.Equals}
+		}
+		values := make([]*fastjson.Value, len(candidates))
+		arena := &fastjson.Arena{}
+		for i, c := range candidates {
+			if values[i], err = NewValue(arena, normalize(c)); err != nil {
+				return nil, err
+			}
+		}
+		test = func(v *fastjson.Value) bool {
+			if v == nil {
+				return false
+			}
+			for _, c := range values {
+				if equal(v, c) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	not := cond.Not
+	return func(e *Event) bool {
+		v, _ := path.Get(e.V)
+		return test(v) != not
+	}, nil
+}
+
+//compileTemplate compiles a template step, replacing {{path}} with values at path
+func compileTemplate(path Path, template string, allowMissing bool) (compiledStep, error) {
+	matches := templatePattern.FindAllStringSubmatchIndex(template, -1)
+	literals := []string{}
+	fields := []Path{}
+	last := 0
+	for _, m := range matches {
+		field, err := ParsePath(template[m[2]:m[3]])
+		if err != nil {
+			return nil, fmt.Errorf("template: %s", err)
+		}
+		literals = append(literals, template[last:m[0]])
+		fields = append(fields, field)
+		last = m[1]
+	}
+	literals = append(literals, template[last:])
+
+	return func(e *Event) error {
+		var b strings.Builder
+		for i, field := range fields {
+			b.WriteString(literals[i])
+			v, err := field.Get(e.V)
+			if err != nil {
+				if allowMissing {
+					continue
+				}
+				return fmt.Errorf("template %s: no value at %s", path, field)
+			}
+			if v.Type() == fastjson.TypeString {
+				b.Write(v.GetStringBytes())
+			} else {
+				b.Write(v.MarshalTo(nil))
+			}
+		}
+		b.WriteString(literals[len(literals)-1])
+		return path.Set(&e.arena, e.V, e.arena.NewString(b.String()))
+	}, nil
+}
+
+//casts converts values to types
+var casts = map[string]func(*fastjson.Arena, *fastjson.Value) (*fastjson.Value, error){
+	"string": func(arena *fastjson.Arena, v *fastjson.Value) (*fastjson.Value, error) {
+		if v.Type() == fastjson.TypeString {
+			return v, nil
+		}
+		return arena.NewString(string(v.MarshalTo(nil))), nil
+	},
+	"int": func(arena *fastjson.Arena, v *fastjson.Value) (*fastjson.Value, error) {
+		f, err := toFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		f = math.Trunc(f)
+		if f < math.MinInt64 || f >= math.MaxInt64 {
+			return nil, fmt.Errorf("%v is out of range for int", f)
+		}
+		return arena.NewNumberString(strconv.FormatInt(int64(f), 10)), nil
+	},
+	"float": func(arena *fastjson.Arena, v *fastjson.Value) (*fastjson.Value, error) {
+		f, err := toFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		return arena.NewNumberFloat64(f), nil
+	},
+	"bool": func(arena *fastjson.Arena, v *fastjson.Value) (*fastjson.Value, error) {
+		var b bool
+		switch v.Type() {
+		case fastjson.TypeTrue, fastjson.TypeFalse:
+			return v, nil
+		case fastjson.TypeNumber:
+			b = v.GetFloat64() != 0
+		case fastjson.TypeString:
+			var err error
+			if b, err = strconv.ParseBool(string(v.GetStringBytes())); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("can't convert %s to bool", v.Type())
+		}
+		if b {
+			return arena.NewTrue(), nil
+		}
+		return arena.NewFalse(), nil
+	},
+}
+
+//toFloat converts numbers, numeric strings and booleans to float, failing on NaN and infinities
+func toFloat(v *fastjson.Value) (float64, error) {
+	var f float64
+	var err error
+	switch v.Type() {
+	case fastjson.TypeNumber:
+		f, err = v.Float64()
+	case fastjson.TypeString:
+		f, err = strconv.ParseFloat(strings.TrimSpace(string(v.GetStringBytes())), 64)
+	case fastjson.TypeTrue:
+		return 1, nil
+	case fastjson.TypeFalse:
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("can't convert %s to number", v.Type())
+	}
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("%v isn't a valid json number", f)
+	}
+	return f, nil
+}
+
+//normalize converts values decoded from yaml to values NewValue supports
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = normalize(item)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = normalize(item)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, item := range v {
+			s[i] = normalize(item)
+		}
+		return s
+	case uint64:
+		return float64(v)
+	}
+	return value
+}
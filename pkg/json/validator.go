@@ -0,0 +1,106 @@
+package json
+
+import (
+	"fmt"
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/internal/stage"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"github.com/valyala/fastjson"
+	"go.uber.org/zap"
+)
+
+//ValidatorConfig is the input arguments to NewValidator.
+type ValidatorConfig struct {
+	Schema *Schema    //schema events are validated against
+	Reject types.Sink //receives invalid events, wrapped with their errors. When nil, invalid events are errors
+}
+
+/*
+Validator validates events against a Schema, passing valid events through.
+
+Invalid events are sent to the Reject sink as json objects with the original
+event and its validation errors:
+
+	{"event":{"id":"x"},"errors":[{"path":"id","message":"expected integer, got string"}]}
+
+Events that aren't json are rejected with the event as a string.
+
+Use Filter with filter.NewSink or filter.NewSource, or http.ValidatingEventMaker
+and http.ValidationErrorWriter with http.Config to reply 400 with the errors.
+*/
+type Validator struct {
+	schema *Schema
+	reject types.Sink
+}
+
+//NewValidator creates a new Validator
+func NewValidator(cfg ValidatorConfig) (*Validator, error) {
+	if cfg.Schema == nil {
+		return nil, fmt.Errorf("No schema provided")
+	}
+
+	return &Validator{
+		schema: cfg.Schema,
+		reject: cfg.Reject,
+	}, nil
+}
+
+/*
+Validate returns ValidationErrors if the event doesn't match the schema,
+a parse error if it isn't json, and nil if it's valid.
+*/
+func (validator *Validator) Validate(e *types.Event) error {
+	v, err := fastjson.ParseBytes(e.Bytes())
+	if err != nil {
+		return err
+	}
+	if errs := validator.schema.Validate(v); errs != nil {
+		return errs
+	}
+	return nil
+}
+
+/*
+Filter implements filter.EventFilterFn. Valid events are returned, and invalid
+events are drained to the Reject sink and filtered out. Returns the validation
+error when there's no Reject sink, and the drain error if rejecting fails.
+*/
+func (validator *Validator) Filter(e *types.Event) (*types.Event, error) {
+	logger := logging.Logger()
+
+	err := validator.Validate(e)
+	if err == nil {
+		return e, nil
+	}
+	logger.Debug("json.Validator: invalid event", zap.ByteString("event", e.Bytes()), zap.Error(err))
+
+	if validator.reject == nil {
+		return nil, err
+	}
+
+	rejected := Rejected(e, err)
+	if err = stage.FlattenErrors(validator.reject.Drain([]types.Event{rejected}), logger); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+//Rejected makes the event sent to reject sinks, of the event and why it's invalid.
+func Rejected(e *types.Event, err error) types.Event {
+	arena := &fastjson.Arena{}
+	obj := arena.NewObject()
+
+	if v, parseErr := fastjson.ParseBytes(e.Bytes()); parseErr == nil {
+		obj.Set("event", v)
+	} else {
+		obj.Set("event", arena.NewStringBytes(e.Bytes()))
+	}
+
+	if errs, ok := err.(ValidationErrors); ok {
+		obj.Set("errors", errs.Value(arena))
+	} else {
+		obj.Set("errors", ValidationErrors{{Message: err.Error()}}.Value(arena))
+	}
+
+	return types.NewEventFromBytes(obj.MarshalTo(nil))
+}
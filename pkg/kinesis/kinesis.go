@@ -0,0 +1,554 @@
+/*
+Package kinesis provides a source that reads events from an AWS Kinesis Data Stream,
+and a sink that sends events to one.
+*/
+package kinesis
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/awsconfig"
+	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"go.uber.org/zap"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//LocalEndpoint is the address of the kinesis service when using localstack for testing.
+	LocalEndpoint = "http://localhost:4568"
+	//MaxBatchRecords is the max number of records in one PutRecords call.
+	MaxBatchRecords = 500
+	//MaxBatchBytes is the max size of one PutRecords call, including partition keys.
+	MaxBatchBytes = 5 * 1024 * 1024
+	//MaxRecordBytes is the max size of one record, including partition key.
+	MaxRecordBytes = 1024 * 1024
+	//DefaultPollInterval is how long Source waits when no shard returned records.
+	DefaultPollInterval = 1 * time.Second
+)
+
+//PartitionKeyFn is the function signature for choosing the partition key of an event.
+type PartitionKeyFn func(*types.Event) (string, error)
+
+//Sink implements Sink interface for pushing events to a Kinesis Data Stream.
+type Sink struct {
+	Name           string //the name of the stream
+	partitionKeyFn PartitionKeyFn
+	kinesis        *kinesis.Kinesis
+}
+
+//Config is the input arguments to NewSink.
+type Config struct {
+	Name           string             //name of the stream as defined by AWS.
+	PartitionKeyFn PartitionKeyFn     //chooses partition key of events, defaults to HashPartitionKey
+	Local          bool               //when set to true, will configure client to make requests to the local endpoint.
+	AWS            *awsconfig.Options //aws session options, e.g. region, credentials and retries. Defaults to the environment
+}
+
+//Source implements Source interface for reading from a Kinesis Data Stream.
+//
+//Shards are read round-robin. Child shards created by splits and merges
+//are read after their parents have been read to completion.
+type Source struct {
+	Name    string //the name of the stream
+	cfg     SourceConfig
+	kinesis *kinesis.Kinesis
+	shards  map[string]*shard
+	order   []string //shard ids in the order they are read
+	next    int      //index into order of next shard to read
+	listed  bool
+	relist  bool       //true when a shard closed since shards were listed
+	mu      sync.Mutex //guards sequence numbers in shards
+	done    chan struct{}
+}
+
+//SourceConfig is the input arguments to NewSource.
+type SourceConfig struct {
+	Name string //name of the stream as defined by AWS.
+	//IteratorType is where shards without a sequence number start reading,
+	//TRIM_HORIZON (default) or LATEST.
+	IteratorType string
+	//SequenceNumbers are per shard sequence numbers to resume reading after,
+	//e.g. as returned by Source.SequenceNumbers().
+	SequenceNumbers map[string]string
+	Limit           *int64             //max records per GetRecords call
+	PollInterval    time.Duration      //wait when no shard has records, defaults to DefaultPollInterval
+	Local           bool               //when set to true, will configure client to make requests to the local endpoint.
+	AWS             *awsconfig.Options //aws session options, e.g. region, credentials and retries. Defaults to the environment
+}
+
+//shard is the read state of one kinesis shard
+type shard struct {
+	id             string
+	parents        []string
+	started        bool    //true once an iterator has been requested
+	iterator       *string //nil when shard is closed, or not yet started
+	sequenceNumber string  //of last drawn record
+	records        []*kinesis.Record
+	closed         bool //no more records will be fetched
+}
+
+//implements interfaces
+var _ types.Sink = &Sink{}
+var _ types.Source = &Source{}
+
+// ** Constructors ** //
+
+//NewClient makes a kinesis client with aws sdk, using default options
+func NewClient(local bool) *kinesis.Kinesis {
+	//default options never fail
+	client, _ := NewClientWithOptions(nil, local)
+	return client
+}
+
+//NewClientWithOptions makes a kinesis client with aws sdk, configured by opts
+func NewClientWithOptions(opts *awsconfig.Options, local bool) (*kinesis.Kinesis, error) {
+	endpoint := ""
+	if local {
+		endpoint = LocalEndpoint
+	}
+	sess, err := opts.NewSession(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return kinesis.New(sess), nil
+}
+
+//NewSink constructs a kinesis Sink.
+func NewSink(cfg Config) (*Sink, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("No name provided")
+	}
+
+	partitionKeyFn := cfg.PartitionKeyFn
+	if partitionKeyFn == nil {
+		partitionKeyFn = HashPartitionKey
+	}
+
+	client, err := NewClientWithOptions(cfg.AWS, cfg.Local)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sink{
+		Name:           cfg.Name,
+		partitionKeyFn: partitionKeyFn,
+		kinesis:        client,
+	}, nil
+}
+
+//NewSource constructs a kinesis Source.
+func NewSource(cfg SourceConfig) (*Source, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("No name provided")
+	}
+
+	if cfg.IteratorType == "" {
+		cfg.IteratorType = kinesis.ShardIteratorTypeTrimHorizon
+	}
+	if cfg.IteratorType != kinesis.ShardIteratorTypeTrimHorizon &&
+		cfg.IteratorType != kinesis.ShardIteratorTypeLatest {
+		return nil, fmt.Errorf("unsupported iterator type %s", cfg.IteratorType)
+	}
+
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+
+	client, err := NewClientWithOptions(cfg.AWS, cfg.Local)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Source{
+		Name:    cfg.Name,
+		cfg:     cfg,
+		kinesis: client,
+		shards:  map[string]*shard{},
+		order:   []string{},
+		done:    make(chan struct{}),
+	}, nil
+}
+
+//HashPartitionKey implements PartitionKeyFn by hashing the event bytes,
+//which spreads events evenly across shards.
+func HashPartitionKey(e *types.Event) (string, error) {
+	h := fnv.New64a()
+	h.Write(e.Bytes())
+	return strconv.FormatUint(h.Sum64(), 16), nil
+}
+
+// ** SINK ** //
+
+//Client returns the underlying AWS Kinesis Client
+func (sink *Sink) Client() *kinesis.Kinesis {
+	return sink.kinesis
+}
+
+//Drain sends the supplied events to the stream using PutRecords,
+//split into as many calls as PutRecords limits require.
+func (sink *Sink) Drain(events []types.Event) []error {
+	logger := logging.Logger()
+	errs := make([]error, len(events))
+	failed := false
+
+	entries := []*kinesis.PutRecordsRequestEntry{}
+	indices := []int{}
+	size := 0
+
+	put := func() {
+		if len(entries) == 0 {
+			return
+		}
+		for j, err := range sink.putRecords(entries) {
+			if err != nil {
+				errs[indices[j]] = err
+				failed = true
+			}
+		}
+		entries = []*kinesis.PutRecordsRequestEntry{}
+		indices = []int{}
+		size = 0
+	}
+
+	for i := range events {
+		key, err := sink.partitionKeyFn(&events[i])
+		if err == nil && key == "" {
+			err = fmt.Errorf("empty partition key")
+		}
+		recordSize := len(events[i].Bytes()) + len(key)
+		if err == nil && recordSize > MaxRecordBytes {
+			err = fmt.Errorf("record of %d bytes exceeds max of %d", recordSize, MaxRecordBytes)
+		}
+		if err != nil {
+			logger.Debug("kinesis.Drain: invalid record", zap.Int("index", i), zap.Error(err))
+			errs[i] = err
+			failed = true
+			continue
+		}
+
+		if len(entries) == MaxBatchRecords || size+recordSize > MaxBatchBytes {
+			put()
+		}
+		entries = append(entries, &kinesis.PutRecordsRequestEntry{
+			Data:         events[i].Bytes(),
+			PartitionKey: aws.String(key),
+		})
+		indices = append(indices, i)
+		size += recordSize
+	}
+	put()
+
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+//putRecords puts one batch of records, and returns errors at record indices
+func (sink *Sink) putRecords(entries []*kinesis.PutRecordsRequestEntry) []error {
+	logger := logging.Logger()
+	errs := make([]error, len(entries))
+
+	logger.Debug("kinesis.Drain: putting batch",
+		zap.Int("n", len(entries)),
+		zap.String("name", sink.Name))
+	res, err := sink.kinesis.PutRecords(&kinesis.PutRecordsInput{
+		StreamName: aws.String(sink.Name),
+		Records:    entries,
+	})
+
+	//Put error means all failed (permission error or whatnot)
+	if err != nil {
+		logger.Debug("kinesis.Drain: put error", zap.Error(err))
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	for i, resp := range res.Records {
+		if i >= len(errs) {
+			break
+		}
+		if resp.ErrorCode != nil {
+			code := aws.StringValue(resp.ErrorCode)
+			msg := aws.StringValue(resp.ErrorMessage)
+			logger.Debug("kinesis.Drain: record error",
+				zap.Int("index", i),
+				zap.String("code", code),
+				zap.String("msg", msg))
+			errs[i] = fmt.Errorf("[%s]:%s", code, msg)
+		}
+	}
+
+	return errs
+}
+
+// ** SOURCE ** //
+
+//Client returns the underlying AWS Kinesis Client
+func (source *Source) Client() *kinesis.Kinesis {
+	return source.kinesis
+}
+
+//SequenceNumbers returns the sequence number of the last drawn record of each shard,
+//keyed by shard id. Safe to call concurrently with DrawOne, e.g. for checkpointing.
+func (source *Source) SequenceNumbers() map[string]string {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	res := map[string]string{}
+	for id, s := range source.shards {
+		if s.sequenceNumber != "" {
+			res[id] = s.sequenceNumber
+		}
+	}
+	return res
+}
+
+/*
+DrawOne draws one event from the stream.
+
+Blocks until a record is available in any shard, polling at PollInterval.
+Returns ErrKinesisEnd when all shards are closed and read.
+*/
+func (source *Source) DrawOne() (*types.Event, error) {
+	logger := logging.Logger()
+
+	if !source.listed {
+		if err := source.listShards(); err != nil {
+			return nil, err
+		}
+		source.listed = true
+	}
+
+	for {
+		//children of closed shards are listed before reading on, also when
+		//the fetch that closed the shard returned records
+		if source.relist {
+			logger.Debug("kinesis.DrawOne: shard closed, listing shards")
+			if err := source.listShards(); err != nil {
+				return nil, err
+			}
+			source.relist = false
+		}
+
+		idle := true
+
+		for n := 0; n < len(source.order); n++ {
+			s := source.shards[source.order[source.next]]
+			source.next = (source.next + 1) % len(source.order)
+
+			if len(s.records) == 0 && source.isReadable(s) {
+				behind, err := source.fetch(s)
+				if err != nil {
+					return nil, err
+				}
+				idle = idle && !behind
+			}
+
+			if len(s.records) > 0 {
+				return source.pop(s), nil
+			}
+		}
+
+		if source.relist {
+			continue
+		}
+
+		if source.isEnded() {
+			return nil, errors.ErrKinesisEnd
+		}
+
+		if idle {
+			logger.Debug("kinesis.DrawOne: no records, waiting", zap.Duration("interval", source.cfg.PollInterval))
+			select {
+			case <-source.done:
+				return nil, errors.ErrSourceClosed
+			case <-time.After(source.cfg.PollInterval):
+			}
+		}
+	}
+}
+
+//Close stops the source. Any DrawOne waiting for records returns ErrSourceClosed.
+func (source *Source) Close() error {
+	select {
+	case <-source.done:
+	default:
+		close(source.done)
+	}
+	return nil
+}
+
+//listShards adds any shards not yet known to the source
+func (source *Source) listShards() error {
+	logger := logging.Logger()
+	input := &kinesis.ListShardsInput{StreamName: aws.String(source.Name)}
+
+	for {
+		out, err := source.kinesis.ListShards(input)
+		if err != nil {
+			logger.Debug("kinesis.listShards: error", zap.Error(err))
+			return err
+		}
+
+		for _, s := range out.Shards {
+			id := aws.StringValue(s.ShardId)
+			if _, ok := source.shards[id]; ok {
+				continue
+			}
+			parents := []string{}
+			for _, parent := range []*string{s.ParentShardId, s.AdjacentParentShardId} {
+				if parent != nil {
+					parents = append(parents, *parent)
+				}
+			}
+			logger.Debug("kinesis.listShards: new shard", zap.String("shardId", id), zap.Strings("parents", parents))
+			source.mu.Lock()
+			source.shards[id] = &shard{
+				id:             id,
+				parents:        parents,
+				sequenceNumber: source.cfg.SequenceNumbers[id],
+			}
+			source.mu.Unlock()
+			source.order = append(source.order, id)
+		}
+
+		if out.NextToken == nil {
+			return nil
+		}
+		input = &kinesis.ListShardsInput{NextToken: out.NextToken}
+	}
+}
+
+//isReadable true iff shard is open and all its known parents have been read
+func (source *Source) isReadable(s *shard) bool {
+	if s.closed {
+		return false
+	}
+	for _, id := range s.parents {
+		if parent, ok := source.shards[id]; ok && !parent.isDone() {
+			return false
+		}
+	}
+	return true
+}
+
+//isEnded true iff all shards are read to completion
+func (source *Source) isEnded() bool {
+	for _, s := range source.shards {
+		if !s.isDone() {
+			return false
+		}
+	}
+	return true
+}
+
+//isDone true iff shard is closed and all its records drawn
+func (s *shard) isDone() bool {
+	return s.closed && len(s.records) == 0
+}
+
+//iterator gets a new shard iterator for the shard
+func (source *Source) iterator(s *shard) error {
+	input := &kinesis.GetShardIteratorInput{
+		StreamName: aws.String(source.Name),
+		ShardId:    aws.String(s.id),
+	}
+
+	if s.sequenceNumber != "" {
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+		input.StartingSequenceNumber = aws.String(s.sequenceNumber)
+	} else if source.hasKnownParent(s) {
+		//children of shards we've read must be read from the start to not lose records
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeTrimHorizon)
+	} else {
+		input.ShardIteratorType = aws.String(source.cfg.IteratorType)
+	}
+
+	out, err := source.kinesis.GetShardIterator(input)
+	if err != nil {
+		return err
+	}
+	s.started = true
+	s.iterator = out.ShardIterator
+	if s.iterator == nil {
+		s.closed = true
+		source.relist = true
+	}
+	return nil
+}
+
+//hasKnownParent true iff any parent of shard is known to the source
+func (source *Source) hasKnownParent(s *shard) bool {
+	for _, id := range s.parents {
+		if _, ok := source.shards[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+//fetch buffers records from shard, returns true if shard is behind the tip of the stream
+func (source *Source) fetch(s *shard) (bool, error) {
+	logger := logging.Logger()
+
+	if !s.started {
+		if err := source.iterator(s); err != nil {
+			return false, err
+		}
+		if s.closed {
+			return false, nil
+		}
+	}
+
+	out, err := source.kinesis.GetRecords(&kinesis.GetRecordsInput{
+		ShardIterator: s.iterator,
+		Limit:         source.cfg.Limit,
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == kinesis.ErrCodeExpiredIteratorException {
+		logger.Debug("kinesis.fetch: iterator expired", zap.String("shardId", s.id))
+		s.started = false
+		return true, nil
+	}
+	if err != nil {
+		logger.Debug("kinesis.fetch: get records failed", zap.String("shardId", s.id), zap.Error(err))
+		return false, err
+	}
+
+	s.records = out.Records
+	s.iterator = out.NextShardIterator
+	if s.iterator == nil {
+		logger.Debug("kinesis.fetch: shard closed", zap.String("shardId", s.id))
+		s.closed = true
+		source.relist = true
+	}
+
+	logger.Debug("kinesis.fetch: fetched",
+		zap.String("shardId", s.id),
+		zap.Int("n", len(out.Records)),
+		zap.Int64p("millisBehindLatest", out.MillisBehindLatest))
+
+	return aws.Int64Value(out.MillisBehindLatest) > 0, nil
+}
+
+//pop advances the shard buffer once and tracks sequence number
+func (source *Source) pop(s *shard) *types.Event {
+	record := s.records[0]
+	s.records = s.records[1:]
+
+	source.mu.Lock()
+	s.sequenceNumber = aws.StringValue(record.SequenceNumber)
+	source.mu.Unlock()
+
+	evt := types.NewEventFromBytes(record.Data)
+	return &evt
+}
@@ -0,0 +1,175 @@
+package kinesis_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	awskinesis "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/underscorenygren/partaj/internal"
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/awsconfig"
+	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/underscorenygren/partaj/pkg/kinesis"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+//examples on how to use kinesis
+func Example() {}
+
+func localStackRunning() bool {
+	_, err := http.Get(kinesis.LocalEndpoint)
+	return err == nil
+}
+
+//stubStream serves a stream whose one shard is split after being read.
+//Only the parent is listed until the source lists shards again.
+func stubStream(records map[string]string) *httptest.Server {
+	listed := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		var res interface{}
+		switch r.Header.Get("X-Amz-Target") {
+		case "Kinesis_20131202.ListShards":
+			shards := []map[string]interface{}{{"ShardId": "parent"}}
+			if listed > 0 {
+				shards = append(shards, map[string]interface{}{"ShardId": "child", "ParentShardId": "parent"})
+			}
+			listed++
+			res = map[string]interface{}{"Shards": shards}
+		case "Kinesis_20131202.GetShardIterator":
+			res = map[string]interface{}{"ShardIterator": req["ShardId"]}
+		case "Kinesis_20131202.GetRecords":
+			//every shard has one record, and closes when it's read
+			id := req["ShardIterator"].(string)
+			res = map[string]interface{}{
+				"Records": []map[string]interface{}{{
+					"Data":           []byte(records[id]),
+					"PartitionKey":   "key",
+					"SequenceNumber": id + "-1",
+				}},
+				"MillisBehindLatest": 0,
+			}
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		json.NewEncoder(w).Encode(res)
+	}))
+}
+
+var _ = Describe("Kinesis shards", func() {
+
+	logging.ConfigureDevelopment(GinkgoWriter)
+
+	It("reads children of a shard that closed with records", func() {
+		server := stubStream(map[string]string{"parent": "one", "child": "two"})
+		defer server.Close()
+
+		source, err := kinesis.NewSource(kinesis.SourceConfig{
+			Name:         "stub-stream",
+			PollInterval: 10 * time.Millisecond,
+			AWS: &awsconfig.Options{
+				Endpoint:    server.URL,
+				Region:      "us-east-1",
+				Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+				MaxRetries:  aws.Int(0),
+			},
+		})
+		Expect(err).To(BeNil())
+
+		for _, expected := range []string{"one", "two"} {
+			evt, err := source.DrawOne()
+			Expect(err).To(BeNil())
+			Expect(string(evt.Bytes())).To(Equal(expected))
+		}
+
+		_, err = source.DrawOne()
+		Expect(err).To(Equal(errors.ErrKinesisEnd))
+		Expect(source.SequenceNumbers()).To(Equal(map[string]string{"parent": "parent-1", "child": "child-1"}))
+	})
+})
+
+var _ = Describe("Kinesis", func() {
+
+	logger := logging.ConfigureDevelopment(GinkgoWriter)
+	streamName := "test-stream"
+	var sink *kinesis.Sink
+
+	BeforeEach(func() {
+		if !localStackRunning() {
+			logger.Debug("localstack not running")
+			Skip("localstack isn't running")
+		} else {
+			var err error
+			sink, err = kinesis.NewSink(kinesis.Config{
+				Name: streamName,
+				PartitionKeyFn: func(*types.Event) (string, error) {
+					return "key", nil
+				},
+				Local: true,
+			})
+			Expect(err).To(BeNil())
+
+			cli := sink.Client()
+			_, err = cli.CreateStream(&awskinesis.CreateStreamInput{
+				StreamName: aws.String(streamName),
+				ShardCount: aws.Int64(2),
+			})
+			Expect(err).To(BeNil())
+			Expect(cli.WaitUntilStreamExists(&awskinesis.DescribeStreamInput{
+				StreamName: aws.String(streamName),
+			})).To(BeNil())
+		}
+	})
+
+	AfterEach(func() {
+		if localStackRunning() {
+			sink.Client().DeleteStream(&awskinesis.DeleteStreamInput{
+				StreamName: aws.String(streamName),
+			})
+		}
+	})
+
+	It("reads and writes to kinesis", func() {
+		events := internal.StringsToEvents([]string{"one", "two", "three"})
+		Expect(sink.Drain(events)).To(BeNil())
+
+		source, err := kinesis.NewSource(kinesis.SourceConfig{
+			Name:         streamName,
+			PollInterval: 100 * time.Millisecond,
+			Local:        true,
+		})
+		Expect(err).To(BeNil())
+
+		for _, ref := range events {
+			evt, err := source.DrawOne()
+			Expect(err).To(BeNil())
+			Expect(evt.IsEqual(&ref)).To(BeTrue())
+		}
+
+		//one key means all records are in one shard
+		Expect(len(source.SequenceNumbers())).To(Equal(1))
+		Expect(source.Close()).To(BeNil())
+	})
+
+	It("returns errors for records that are too large", func() {
+		events := []types.Event{
+			types.NewEventFromBytes([]byte("small")),
+			types.NewEventFromBytes([]byte(strings.Repeat("a", kinesis.MaxRecordBytes))),
+		}
+		errs := sink.Drain(events)
+		Expect(len(errs)).To(Equal(2))
+		Expect(errs[0]).To(BeNil())
+		Expect(errs[1]).ToNot(BeNil())
+	})
+})
@@ -0,0 +1,139 @@
+package math
+
+import (
+	"container/list"
+	"fmt"
+	pkgjson "github.com/underscorenygren/partaj/pkg/json"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"github.com/valyala/fastjson"
+	"sort"
+)
+
+//KeyFn is the function signature for grouping events by key, e.g. by customer or status code.
+type KeyFn func(*types.Event) (string, error)
+
+//Eviction is what happens to events of new keys when a Stage has MaxKeys keys.
+type Eviction int
+
+const (
+	//EvictLeastRecent emits the stats of the least recently updated key, and removes it.
+	EvictLeastRecent Eviction = iota
+	//DropNewKeys drops events of new keys.
+	DropNewKeys
+)
+
+//group is the state of one key
+type group struct {
+	key     string
+	state   State
+	windows *windows //nil when not windowed
+	elem    *list.Element
+}
+
+//groups are the groups of a Stage, bounded by max keys
+type groups struct {
+	byKey    map[string]*group
+	recent   *list.List //of *group, most recently updated first
+	max      int
+	eviction Eviction
+	window   *Window //nil when not windowed
+	newState func() State
+}
+
+/*
+KeyField groups json events by the value at a json path.
+Strings are used without quotes, other json values by their json encoding.
+Events without a value at path fail.
+*/
+func KeyField(path string) (KeyFn, error) {
+	p, err := pkgjson.ParsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return func(e *types.Event) (string, error) {
+		v, err := fastjson.ParseBytes(e.Bytes())
+		if err != nil {
+			return "", err
+		}
+		found, err := p.Get(v)
+		if err != nil {
+			return "", err
+		}
+		if found.Type() == fastjson.TypeString {
+			return string(found.GetStringBytes()), nil
+		}
+		return string(found.MarshalTo(nil)), nil
+	}, nil
+}
+
+//newGroups makes groups for a validated config
+func newGroups(max int, eviction Eviction, window *Window, newState func() State) (*groups, error) {
+	if max < 0 {
+		return nil, fmt.Errorf("max keys can't be negative")
+	}
+	if eviction != EvictLeastRecent && eviction != DropNewKeys {
+		return nil, fmt.Errorf("invalid eviction %d", eviction)
+	}
+	return &groups{
+		byKey:    map[string]*group{},
+		recent:   list.New(),
+		max:      max,
+		eviction: eviction,
+		window:   window,
+		newState: newState,
+	}, nil
+}
+
+//get returns the group of a key, creating it if needed.
+//Returns the group evicted to make room for it, and a nil group if the key was dropped.
+func (g *groups) get(key string) (*group, *group) {
+	if grp, ok := g.byKey[key]; ok {
+		g.recent.MoveToFront(grp.elem)
+		return grp, nil
+	}
+
+	var evicted *group
+	if g.max > 0 && len(g.byKey) >= g.max {
+		if g.eviction == DropNewKeys {
+			return nil, nil
+		}
+		evicted = g.recent.Remove(g.recent.Back()).(*group)
+		delete(g.byKey, evicted.key)
+	}
+
+	grp := &group{key: key, state: g.newState()}
+	if g.window != nil {
+		grp.windows = newWindows(*g.window, g.newState)
+	}
+	grp.elem = g.recent.PushFront(grp)
+	g.byKey[key] = grp
+	return grp, evicted
+}
+
+//sorted returns all groups, ordered by key
+func (g *groups) sorted() []*group {
+	sorted := make([]*group, 0, len(g.byKey))
+	for _, grp := range g.byKey {
+		sorted = append(sorted, grp)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].key < sorted[j].key })
+	return sorted
+}
+
+//states returns the running state of the group, or the states of windows
+func (grp *group) states(closed []*window) []State {
+	if grp.windows == nil {
+		state := grp.state
+		state.Key = grp.key
+		return []State{state}
+	}
+	states := make([]State, len(closed))
+	for i, win := range closed {
+		start, end := win.start, win.end
+		states[i] = win.state
+		states[i].Key = grp.key
+		states[i].Start = &start
+		states[i].End = &end
+	}
+	return states
+}
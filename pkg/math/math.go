@@ -1,34 +1,112 @@
 /*
-Package math provides functionality for counting and doing stats on events
+Package math provides functionality for counting and doing stats on events.
+
+Stages emit running stats every Interval events, or stats of time
+windows, e.g. requests per minute, when configured with a Window.
+Stats can be grouped by key, e.g. per customer or status code.
+
+States can be merged, and stages snapshotted and restored, so aggregation
+can resume after restarts, and be split across shards and reduced.
 */
 package math
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/underscorenygren/partaj/internal/logging"
 	"github.com/underscorenygren/partaj/internal/stage"
+	"github.com/underscorenygren/partaj/pkg/errors"
 	"github.com/underscorenygren/partaj/pkg/types"
+	"go.uber.org/zap"
 	gomath "math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
-//State statistics state for a given Stage
+/*
+State statistics state for a given Stage.
+
+Min and Max are 0 until a value has been added.
+States are combined with Merge, e.g. states of several shards,
+see NewReduceStage.
+*/
 type State struct {
 	Min float64 `json:"min"`
 	Max float64 `json:"max"`
 	Sum float64 `json:"sum"`
 	N   int64   `json:"n"`
+	M2  float64 `json:"m2"` //sum of squared differences from the mean, for variance
+
+	Sketch    *Sketch      `json:"sketch,omitempty"`    //quantile sketch, when configured
+	Histogram *Histogram   `json:"histogram,omitempty"` //histogram, when configured
+	Distinct  *HyperLogLog `json:"distinct,omitempty"`  //distinct values, when configured
+
+	//summaries, set when emitted
+	Variance      float64            `json:"variance"`
+	StdDev        float64            `json:"stddev"`
+	Quantiles     map[string]float64 `json:"quantiles,omitempty"` //by name, e.g. p99
+	DistinctCount uint64             `json:"distinct_count,omitempty"`
+
+	Key   string     `json:"key,omitempty"`   //key of group, for grouped stages
+	Start *time.Time `json:"start,omitempty"` //start of window, for windowed stages
+	End   *time.Time `json:"end,omitempty"`   //end of window, for windowed stages
 }
 
 //ValueFn is the function signature for turning an event into a number
 type ValueFn func(*types.Event) float64
 
+/*
+Config is the input arguments to NewStageWithConfig.
+
+Stats are kept per key when KeyFn or KeyField is set, and
+one event is emitted per key, in key order.
+*/
+type Config struct {
+	Interval int64    //emits running stats every Interval events, when > 0. Ignored with Window
+	Fn       ValueFn  //turns events into numbers
+	Window   *Window  //emits stats of time windows instead of running stats, when set
+	TimeFn   TimeFn   //event time of events for windows, defaults to processing time
+	KeyFn    KeyFn    //groups events by key, overrides KeyField
+	KeyField string   //groups json events by the value at a json path, see KeyField
+	MaxKeys  int      //max number of keys, when > 0
+	Eviction Eviction //handling of new keys at MaxKeys, defaults to EvictLeastRecent
+
+	Quantiles     []float64 //quantiles to estimate, between 0 and 1, e.g. 0.5 and 0.99
+	Accuracy      float64   //relative accuracy of quantiles, defaults to DefaultAccuracy
+	Buckets       []float64 //upper bounds of histogram buckets, see LinearBuckets and ExponentialBuckets
+	DistinctFn    KeyFn     //value of events to count distinct values of, overrides DistinctField
+	DistinctField string    //counts distinct values at a json path, see KeyField
+	Precision     uint8     //precision of distinct counts, defaults to DefaultPrecision
+
+	Checkpoint CheckpointFn //receives a snapshot after every emit, when set
+}
+
 //Stage struct for Stage data, fulfills Stage interface
 type Stage struct {
-	Interval int64
-	fn       ValueFn
-	source   types.Source
-	sink     types.Sink
-	state    State
+	Interval   int64
+	fn         ValueFn
+	timeFn     TimeFn
+	keyFn      KeyFn
+	distinct   KeyFn
+	quantiles  []float64
+	newState   func() State
+	checkpoint CheckpointFn
+	source     types.Source
+	sink       types.Sink
+	groups     *groups
+	n          int64 //events aggregated, for intervals
+	window     *Window
+	watermark  time.Time
+	nextClose  time.Time  //earliest end of open windows, zero when there are none
+	mu         sync.Mutex //guards state, so it can be read while flowing
+}
+
+//drawn is the result of drawing from the source in the background
+type drawn struct {
+	e   *types.Event
+	err error
 }
 
 //Average returns average for state
@@ -38,18 +116,116 @@ func (stat *State) Average() float64 {
 
 //NewStage creates a Stage that emits stats about events
 func NewStage(source types.Source, sink types.Sink, interval int64, fn ValueFn) (*Stage, error) {
+	return NewStageWithConfig(source, sink, Config{Interval: interval, Fn: fn})
+}
+
+//NewStageWithConfig creates a Stage that emits stats about events, configured by cfg
+func NewStageWithConfig(source types.Source, sink types.Sink, cfg Config) (*Stage, error) {
+	if source == nil {
+		return nil, errors.ErrNilSource
+	}
+	if sink == nil {
+		return nil, errors.ErrNilSink
+	}
+	if cfg.Fn == nil {
+		return nil, errors.ErrNilFn
+	}
 
 	s := &Stage{
-		Interval: interval,
-		fn:       fn,
-		source:   source,
-		sink:     sink,
-		state:    State{},
+		Interval:   cfg.Interval,
+		fn:         cfg.Fn,
+		timeFn:     cfg.TimeFn,
+		keyFn:      cfg.KeyFn,
+		distinct:   cfg.DistinctFn,
+		quantiles:  cfg.Quantiles,
+		checkpoint: cfg.Checkpoint,
+		source:     source,
+		sink:       sink,
 	}
 
+	if s.keyFn == nil && cfg.KeyField != "" {
+		keyFn, err := KeyField(cfg.KeyField)
+		if err != nil {
+			return nil, err
+		}
+		s.keyFn = keyFn
+	}
+
+	if s.distinct == nil && cfg.DistinctField != "" {
+		distinct, err := KeyField(cfg.DistinctField)
+		if err != nil {
+			return nil, err
+		}
+		s.distinct = distinct
+	}
+
+	newState, err := cfg.stateFn(s.distinct != nil)
+	if err != nil {
+		return nil, err
+	}
+	s.newState = newState
+
+	if cfg.Window != nil {
+		window := *cfg.Window
+		if err := window.validate(); err != nil {
+			return nil, err
+		}
+		s.window = &window
+	}
+
+	groups, err := newGroups(cfg.MaxKeys, cfg.Eviction, s.window, s.newState)
+	if err != nil {
+		return nil, err
+	}
+	s.groups = groups
+
 	return s, nil
 }
 
+//stateFn returns a function making empty states with configured sketches, failing on invalid config
+func (cfg *Config) stateFn(distinct bool) (func() State, error) {
+	for _, q := range cfg.Quantiles {
+		if q < 0 || q > 1 {
+			return nil, fmt.Errorf("quantile %v isn't between 0 and 1", q)
+		}
+	}
+	accuracy := cfg.Accuracy
+	if accuracy == 0 {
+		accuracy = DefaultAccuracy
+	}
+	precision := cfg.Precision
+	if precision == 0 {
+		precision = DefaultPrecision
+	}
+
+	//check config once, so states can be made without errors
+	if _, err := NewSketch(accuracy); err != nil {
+		return nil, err
+	}
+	if len(cfg.Buckets) > 0 {
+		if _, err := NewHistogram(cfg.Buckets); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := NewHyperLogLog(precision); err != nil {
+		return nil, err
+	}
+
+	return func() State {
+		state := State{}
+		if len(cfg.Quantiles) > 0 {
+			state.Sketch, _ = NewSketch(accuracy)
+		}
+		if len(cfg.Buckets) > 0 {
+			state.Histogram, _ = NewHistogram(cfg.Buckets)
+		}
+		if distinct {
+			state.Distinct, _ = NewHyperLogLog(precision)
+		}
+		return state
+	}, nil
+}
+
 //Unmarshal parses stat struct from event. Returns error if invalid struct
 func Unmarshal(e *types.Event) (*State, error) {
 	state := State{}
@@ -59,70 +235,416 @@ func Unmarshal(e *types.Event) (*State, error) {
 	return &state, nil
 }
 
-//update updates internal state
-func (s *Stage) update(e *types.Event) {
+//update adds a value to the state
+func (state *State) update(val float64) {
+	//welford's algorithm, with means before and after the value
+	mean := 0.0
+	if state.N > 0 {
+		mean = state.Sum / float64(state.N)
+	}
+	if state.N == 0 {
+		state.Min, state.Max = val, val
+	} else {
+		state.Min = gomath.Min(state.Min, val)
+		state.Max = gomath.Max(state.Max, val)
+	}
+	state.Sum += val
+	state.N++
+	state.M2 += (val - mean) * (val - state.Sum/float64(state.N))
+
+	if state.Sketch != nil {
+		state.Sketch.Add(val)
+	}
+	if state.Histogram != nil {
+		state.Histogram.Add(val)
+	}
+}
+
+/*
+Merge adds another state to the state, e.g. one emitted by another process,
+as if all values of both had been added to it. Empty states don't change Min and Max,
+and windows are widened to cover both. The key of the state is kept, unless it has none.
+
+Fails if their sketches, histograms or hyperloglogs are configured differently.
+*/
+func (state *State) Merge(other *State) error {
+	switch {
+	case other.N == 0:
+	case state.N == 0:
+		state.Min, state.Max = other.Min, other.Max
+		state.M2 = other.M2
+	default:
+		delta := other.Sum/float64(other.N) - state.Sum/float64(state.N)
+		state.M2 += other.M2 + delta*delta*float64(state.N)*float64(other.N)/float64(state.N+other.N)
+		state.Min = gomath.Min(state.Min, other.Min)
+		state.Max = gomath.Max(state.Max, other.Max)
+	}
+	state.Sum += other.Sum
+	state.N += other.N
+
+	if state.Key == "" {
+		state.Key = other.Key
+	}
+	if other.Start != nil && (state.Start == nil || other.Start.Before(*state.Start)) {
+		start := *other.Start
+		state.Start = &start
+	}
+	if other.End != nil && (state.End == nil || other.End.After(*state.End)) {
+		end := *other.End
+		state.End = &end
+	}
+
+	return mergeSketches(state, other)
+}
+
+//mergeSketches merges sketches, histograms and hyperloglogs of other into state
+func mergeSketches(state *State, other *State) error {
+	if other.Sketch != nil {
+		if state.Sketch == nil {
+			state.Sketch, _ = NewSketch(other.Sketch.Accuracy)
+		}
+		if err := state.Sketch.Merge(other.Sketch); err != nil {
+			return err
+		}
+	}
+	if other.Histogram != nil {
+		if state.Histogram == nil {
+			state.Histogram = &Histogram{Bounds: other.Histogram.Bounds, Counts: make([]int64, len(other.Histogram.Counts))}
+		}
+		if err := state.Histogram.Merge(other.Histogram); err != nil {
+			return err
+		}
+	}
+	if other.Distinct != nil {
+		if state.Distinct == nil {
+			state.Distinct = &HyperLogLog{Precision: other.Distinct.Precision, Registers: make([]byte, len(other.Distinct.Registers))}
+		}
+		if err := state.Distinct.Merge(other.Distinct); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//clone copies the state, including its sketches
+func (state State) clone() State {
+	if state.Sketch != nil {
+		sketch := *state.Sketch
+		sketch.Positive, sketch.Negative = map[int32]int64{}, map[int32]int64{}
+		sketch.Merge(state.Sketch)
+		state.Sketch = &sketch
+	}
+	if state.Histogram != nil {
+		histogram := *state.Histogram
+		histogram.Counts = append([]int64{}, histogram.Counts...)
+		state.Histogram = &histogram
+	}
+	if state.Distinct != nil {
+		distinct := *state.Distinct
+		distinct.Registers = append([]byte{}, distinct.Registers...)
+		state.Distinct = &distinct
+	}
+	return state
+}
+
+//summarize sets summaries of the state, for emitting
+func (state *State) summarize(quantiles []float64) {
+	state.Variance, state.StdDev = 0, 0
+	if state.N > 0 {
+		state.Variance = state.M2 / float64(state.N)
+		state.StdDev = gomath.Sqrt(state.Variance)
+	}
+	state.Quantiles = nil
+	if state.Sketch != nil && state.Sketch.Count() > 0 {
+		state.Quantiles = map[string]float64{}
+		for _, q := range quantiles {
+			state.Quantiles[QuantileName(q)] = state.Sketch.Quantile(q)
+		}
+	}
+	if state.Distinct != nil {
+		state.DistinctCount = state.Distinct.Count()
+	}
+}
+
+//QuantileName names quantiles in emitted states, e.g. p99 for 0.99 and p99.9 for 0.999.
+func QuantileName(q float64) string {
+	return "p" + strconv.FormatFloat(q*100, 'f', -1, 64)
+}
+
+//update updates internal state, emitting evicted groups and windows that closed
+func (s *Stage) update(e *types.Event) error {
+	logger := logging.Logger()
+
+	key := ""
+	if s.keyFn != nil {
+		var err error
+		if key, err = s.keyFn(e); err != nil {
+			logger.Debug("math.Flow: dropping event without key", zap.Error(err))
+			return nil
+		}
+	}
+
+	now := time.Now()
+	t := now
+	if s.window != nil && s.timeFn != nil {
+		var err error
+		if t, err = s.timeFn(e); err != nil {
+			logger.Debug("math.Flow: dropping event without time", zap.Error(err))
+			return nil
+		}
+	}
+
+	grp, evicted := s.groups.get(key)
+	if grp == nil {
+		logger.Debug("math.Flow: dropping event of new key", zap.String("key", key))
+		return nil
+	}
+
+	states := []State{}
+	if evicted != nil {
+		logger.Debug("math.Flow: evicting key", zap.String("key", evicted.key))
+		states = append(states, s.flush(evicted)...)
+	}
+
 	val := s.fn(e)
-	s.state.Min = gomath.Min(s.state.Min, val)
-	s.state.Max = gomath.Max(s.state.Max, val)
-	s.state.Sum += val
-	s.state.N++
+	distinct, hasDistinct := "", false
+	if s.distinct != nil {
+		var err error
+		if distinct, err = s.distinct(e); err != nil {
+			logger.Debug("math.Flow: event without distinct value", zap.Error(err))
+		} else {
+			hasDistinct = true
+		}
+	}
+	update := func(state *State) {
+		state.update(val)
+		if hasDistinct {
+			state.Distinct.Add(distinct)
+		}
+	}
+
+	s.n++
+	if s.window == nil {
+		update(&grp.state)
+		return s.emit(states...)
+	}
+
+	if !grp.windows.add(t, s.watermark, update) {
+		logger.Debug("math.Flow: dropping late event", zap.Time("t", t))
+	}
+	if next, ok := grp.windows.next(); ok && (s.nextClose.IsZero() || next.Before(s.nextClose)) {
+		s.nextClose = next
+	}
+
+	watermark := now
+	if s.timeFn != nil {
+		watermark = t.Add(-s.window.Lateness)
+	}
+	return s.emit(append(states, s.advance(watermark)...)...)
+}
+
+//advance moves the watermark forward, returning states of windows it closed, ordered by end
+func (s *Stage) advance(watermark time.Time) []State {
+	if watermark.After(s.watermark) {
+		s.watermark = watermark
+	}
+	if s.nextClose.IsZero() || s.nextClose.After(s.watermark) {
+		return nil
+	}
+
+	states := []State{}
+	s.nextClose = time.Time{}
+	for _, grp := range s.groups.sorted() {
+		states = append(states, grp.states(grp.windows.advance(s.watermark))...)
+		if next, ok := grp.windows.next(); ok && (s.nextClose.IsZero() || next.Before(s.nextClose)) {
+			s.nextClose = next
+		}
+	}
+	sort.SliceStable(states, func(i, j int) bool { return states[i].End.Before(*states[j].End) })
+	return states
+}
+
+//flush returns the states of a group, closing its windows
+func (s *Stage) flush(grp *group) []State {
+	if grp.windows == nil {
+		return grp.states(nil)
+	}
+	return grp.states(grp.windows.flush())
 }
 
 //True iff Stage should emit an event
 func (s *Stage) isAtEmitInterval() bool {
-	return s.Interval > 0 && s.state.N%s.Interval == 0
+	return s.window == nil && s.Interval > 0 && s.n%s.Interval == 0
 }
 
-//emits an event to the sink
-func (s *Stage) emit() error {
-	logger := logging.Logger()
+//running returns the running states of all groups
+func (s *Stage) running() []State {
+	states := []State{}
+	for _, grp := range s.groups.sorted() {
+		states = append(states, grp.states(nil)...)
+	}
+	return states
+}
 
-	bytes, err := json.Marshal(s.state)
+//finish emits all remaining stats, at the end of the source
+func (s *Stage) finish() error {
+	logging.Logger().Debug("math.Flow: emitting at end")
+	if s.window == nil {
+		states := s.running()
+		//ungrouped stages always emit, even without events
+		if len(states) == 0 && s.keyFn == nil {
+			states = append(states, s.newState())
+		}
+		return s.emit(states...)
+	}
+
+	states := []State{}
+	for _, grp := range s.groups.sorted() {
+		states = append(states, s.flush(grp)...)
+	}
+	sort.SliceStable(states, func(i, j int) bool { return states[i].End.Before(*states[j].End) })
+	return s.emit(states...)
+}
+
+//emits an event per state to the sink, and checkpoints after
+func (s *Stage) emit(states ...State) error {
+	if len(states) == 0 {
+		return nil
+	}
+	if err := emit(s.sink, s.quantiles, states); err != nil {
+		return err
+	}
+	if s.checkpoint == nil {
+		return nil
+	}
+	snapshot, err := s.snapshot()
 	if err != nil {
 		return err
 	}
+	return s.checkpoint(snapshot)
+}
 
-	e := types.NewEventFromBytes(bytes)
-	events := []types.Event{e}
-	errs := s.sink.Drain(events)
-	//End flow iff errors from drain
-	if err = stage.FlattenErrors(errs, logger); err != nil {
-		return err
+//emit summarizes states and drains them to sink
+func emit(sink types.Sink, quantiles []float64, states []State) error {
+	logger := logging.Logger()
+
+	events := make([]types.Event, len(states))
+	for i, state := range states {
+		state.summarize(quantiles)
+		bytes, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		events[i] = types.NewEventFromBytes(bytes)
 	}
 
-	return nil
+	errs := sink.Drain(events)
+	//End flow iff errors from drain
+	return stage.FlattenErrors(errs, logger)
 }
 
 /*Flow fulfills Stage interface.
-* draws events from source and emits events at interval,
-* and one final one at source end
+* draws events from source and emits events at interval or when windows close,
+* and one final one at source end.
+* The source isn't closed by Flow, and must be closed by the caller.
  */
 func (s *Stage) Flow() error {
 	logger := logging.Logger()
 
+	//windows of processing time close without events arriving
+	if s.window != nil && s.timeFn == nil {
+		return s.flowProcessingTime()
+	}
+
 	for {
 		logger.Debug("math.Flow: drawing")
 		e, err := s.source.DrawOne()
 		logger.Debug("math.Flow: drew")
 
-		if e != nil {
-			s.update(e)
+		if done, err := s.handle(e, err); done {
+			return err
+		}
+	}
+}
+
+/*
+flowProcessingTime draws in the background, and emits windows as they close.
+
+If it fails before the source ends, background drawing stops
+once the pending DrawOne returns, e.g. when the caller closes the source.
+*/
+func (s *Stage) flowProcessingTime() error {
+	draws := make(chan drawn)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		for {
+			e, err := s.source.DrawOne()
+			select {
+			case draws <- drawn{e: e, err: err}:
+			case <-stop:
+				return
+			}
+			if err != nil || e == nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !s.nextClose.IsZero() {
+			timer = time.NewTimer(time.Until(s.nextClose))
+			timeout = timer.C
 		}
 
-		//always emit stats when
-		if err != nil || e == nil {
-			logger.Debug("math.Flow: emitting at end")
-			//if emit fails, returns that error first
-			if e2 := s.emit(); e2 != nil {
-				return e2
+		select {
+		case d := <-draws:
+			if done, err := s.handle(d.e, d.err); done {
+				return err
 			}
-			return err
-		} else if s.isAtEmitInterval() {
-			logger.Debug("math.Flow: emitting at interval")
-			//exit if emit fails
-			if err := s.emit(); err != nil {
+		case now := <-timeout:
+			s.mu.Lock()
+			err := s.emit(s.advance(now)...)
+			s.mu.Unlock()
+			if err != nil {
 				return err
 			}
 		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+//handle handles a draw, true when flow is done
+func (s *Stage) handle(e *types.Event, err error) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e != nil {
+		//exit if emit fails
+		if updateErr := s.update(e); updateErr != nil {
+			return true, updateErr
+		}
+	}
+
+	//always emit stats when source ends
+	if err != nil || e == nil {
+		//if emit fails, returns that error first
+		if e2 := s.finish(); e2 != nil {
+			return true, e2
+		}
+		return true, err
+	} else if s.isAtEmitInterval() {
+		logging.Logger().Debug("math.Flow: emitting at interval")
+		//exit if emit fails
+		if err := s.emit(s.running()...); err != nil {
+			return true, err
+		}
 	}
+	return false, nil
 }
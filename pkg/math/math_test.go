@@ -6,17 +6,70 @@ import (
 
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"github.com/underscorenygren/partaj/internal/logging"
 	"github.com/underscorenygren/partaj/pkg/buffer"
 	"github.com/underscorenygren/partaj/pkg/errors"
 	"github.com/underscorenygren/partaj/pkg/math"
 	"github.com/underscorenygren/partaj/pkg/programmatic"
 	"github.com/underscorenygren/partaj/pkg/types"
+	"github.com/valyala/fastjson"
+	gomath "math"
+	"time"
 )
 
 //examples on how to use json
 func Example() {}
 
+//base is the time that event times are relative to
+var base = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+//value reads v of {"v": value} events
+func value(e *types.Event) float64 {
+	return fastjson.MustParseBytes(e.Bytes()).GetFloat64("v")
+}
+
+//eventTime reads t of {"t": seconds after base} events
+func eventTime(e *types.Event) (time.Time, error) {
+	v, err := fastjson.ParseBytes(e.Bytes())
+	if err != nil {
+		return time.Time{}, err
+	}
+	return base.Add(time.Duration(v.GetFloat64("t") * float64(time.Second))), nil
+}
+
+//newStage makes a stage over events that drains to sink, using value as Fn
+func newStage(cfg math.Config, sink types.Sink, events ...string) *math.Stage {
+	source := programmatic.NewSource()
+	for _, e := range events {
+		source.PutString(e)
+	}
+	source.Close()
+
+	cfg.Fn = value
+	stage, err := math.NewStageWithConfig(source, sink, cfg)
+	Expect(err).To(BeNil())
+	return stage
+}
+
+//unmarshal returns states of emitted events
+func unmarshal(events []types.Event) []*math.State {
+	states := []*math.State{}
+	for i := range events {
+		state, err := math.Unmarshal(&events[i])
+		Expect(err).To(BeNil())
+		states = append(states, state)
+	}
+	return states
+}
+
+//runStage flows a stage over events until they end, and returns emitted states
+func runStage(cfg math.Config, events ...string) []*math.State {
+	sink := buffer.NewSink()
+	Expect(newStage(cfg, sink, events...).Flow()).To(Equal(errors.ErrSourceClosed))
+	return unmarshal(sink.Events)
+}
+
 var _ = Describe("Math", func() {
 
 	var testBytes [][]byte
@@ -125,3 +178,399 @@ var _ = Describe("Math", func() {
 		close(done)
 	})
 })
+
+var _ = Describe("Windows", func() {
+
+	logging.ConfigureDevelopment(GinkgoWriter)
+
+	//flow runs a stage with window over events in event time, and returns emitted states
+	flow := func(window math.Window, events ...string) []*math.State {
+		return runStage(math.Config{Window: &window, TimeFn: eventTime}, events...)
+	}
+
+	//bounds returns window starts and ends in seconds after base
+	bounds := func(states []*math.State) [][2]float64 {
+		res := [][2]float64{}
+		for _, state := range states {
+			res = append(res, [2]float64{state.Start.Sub(base).Seconds(), state.End.Sub(base).Seconds()})
+		}
+		return res
+	}
+
+	It("emits tumbling windows as the watermark passes them", func() {
+		states := flow(math.Window{Kind: math.Tumbling, Size: time.Minute},
+			`{"t": 1, "v": 1}`, `{"t": 30, "v": 2}`, `{"t": 61, "v": 4}`, `{"t": 200, "v": 8}`)
+
+		Expect(bounds(states)).To(Equal([][2]float64{{0, 60}, {60, 120}, {180, 240}}))
+		Expect(states[0].Sum).To(Equal(float64(3)))
+		Expect(states[0].N).To(Equal(int64(2)))
+		Expect(states[1].Sum).To(Equal(float64(4)))
+		Expect(states[2].Sum).To(Equal(float64(8)))
+	})
+
+	It("adds events to every sliding window containing them", func() {
+		states := flow(math.Window{Kind: math.Sliding, Size: time.Minute, Slide: 30 * time.Second},
+			`{"t": 10, "v": 1}`, `{"t": 40, "v": 2}`)
+
+		Expect(bounds(states)).To(Equal([][2]float64{{-30, 30}, {0, 60}, {30, 90}}))
+		Expect(states[0].Sum).To(Equal(float64(1)))
+		Expect(states[1].Sum).To(Equal(float64(3)))
+		Expect(states[2].Sum).To(Equal(float64(2)))
+	})
+
+	It("groups events into sessions", func() {
+		states := flow(math.Window{Kind: math.Session, Gap: 10 * time.Second},
+			`{"t": 0, "v": 1}`, `{"t": 5, "v": 1}`, `{"t": 30, "v": 1}`, `{"t": 20, "v": 1}`, `{"t": 35, "v": 1}`)
+
+		Expect(bounds(states)).To(Equal([][2]float64{{0, 15}, {30, 45}}))
+		Expect(states[0].N).To(Equal(int64(2)))
+		Expect(states[1].N).To(Equal(int64(2)))
+	})
+
+	It("accepts out of order events within lateness", func() {
+		window := math.Window{Kind: math.Tumbling, Size: time.Minute}
+		states := flow(window, `{"t": 50, "v": 1}`, `{"t": 70, "v": 1}`, `{"t": 55, "v": 1}`)
+		Expect(states[0].N).To(Equal(int64(1)))
+
+		window.Lateness = 30 * time.Second
+		states = flow(window, `{"t": 50, "v": 1}`, `{"t": 70, "v": 1}`, `{"t": 55, "v": 1}`)
+		Expect(states[0].N).To(Equal(int64(2)))
+	})
+
+	It("emits windows of processing time", func(done Done) {
+		source := programmatic.NewSource()
+		sink := buffer.NewSink()
+		window := &math.Window{Kind: math.Tumbling, Size: 50 * time.Millisecond}
+		stage, err := math.NewStageWithConfig(source, sink, math.Config{Fn: value, Window: window})
+		Expect(err).To(BeNil())
+
+		flowed := make(chan error)
+		go func() {
+			flowed <- stage.Flow()
+		}()
+
+		source.PutString(`{"v": 1}`)
+		//window closes without more events
+		time.Sleep(150 * time.Millisecond)
+		source.Close()
+
+		Expect(<-flowed).To(Equal(errors.ErrSourceClosed))
+		Expect(sink.Events).To(HaveLen(1))
+
+		close(done)
+	})
+
+	It("leaves its source open when processing time windows fail", func(done Done) {
+		source := programmatic.NewSource()
+		window := &math.Window{Kind: math.Tumbling, Size: 50 * time.Millisecond}
+		failed := fmt.Errorf("checkpoint failed")
+		stage, err := math.NewStageWithConfig(source, buffer.NewSink(), math.Config{
+			Fn:         value,
+			Window:     window,
+			Checkpoint: func([]byte) error { return failed },
+		})
+		Expect(err).To(BeNil())
+
+		flowed := make(chan error)
+		go func() {
+			flowed <- stage.Flow()
+		}()
+
+		source.PutString(`{"v": 1}`)
+
+		Expect(<-flowed).To(Equal(failed))
+		//callers close sources, which stops background draws
+		Expect(source.PutString(`{"v": 2}`)).To(BeNil())
+		Expect(source.Close()).To(BeNil())
+
+		close(done)
+	})
+
+	It("fails on invalid windows", func() {
+		for _, window := range []math.Window{
+			math.Window{Kind: math.Tumbling},
+			math.Window{Kind: math.Sliding, Size: time.Second, Slide: time.Minute},
+			math.Window{Kind: math.Session},
+		} {
+			_, err := math.NewStageWithConfig(programmatic.NewSource(), buffer.NewSink(), math.Config{Fn: value, Window: &window})
+			Expect(err).NotTo(BeNil())
+		}
+	})
+})
+
+var _ = Describe("Groups", func() {
+
+	logging.ConfigureDevelopment(GinkgoWriter)
+
+	//sums returns sums of states by key
+	sums := func(states []*math.State) map[string]float64 {
+		res := map[string]float64{}
+		for _, state := range states {
+			res[state.Key] += state.Sum
+		}
+		return res
+	}
+
+	events := []string{
+		`{"customer": "a", "status": 200, "v": 1}`,
+		`{"customer": "b", "status": 500, "v": 2}`,
+		`{"customer": "a", "status": 200, "v": 3}`,
+		`{"customer": "c", "status": 200, "v": 4}`,
+	}
+
+	It("keeps state per key", func() {
+		states := runStage(math.Config{KeyField: "customer"}, events...)
+		Expect(states).To(HaveLen(3))
+		Expect(states[0].Key).To(Equal("a"))
+		Expect(states[0].N).To(Equal(int64(2)))
+		Expect(sums(states)).To(Equal(map[string]float64{"a": 4, "b": 2, "c": 4}))
+
+		states = runStage(math.Config{KeyField: "status"}, events...)
+		Expect(sums(states)).To(Equal(map[string]float64{"200": 8, "500": 2}))
+	})
+
+	It("emits every key at interval", func() {
+		states := runStage(math.Config{KeyField: "customer", Interval: 2}, events...)
+		//two keys after 2 events, three after 4, and three at end
+		Expect(states).To(HaveLen(8))
+		Expect(states[0].Key).To(Equal("a"))
+		Expect(states[1].Key).To(Equal("b"))
+	})
+
+	It("evicts the least recent key at max keys", func() {
+		states := runStage(math.Config{KeyField: "customer", MaxKeys: 2}, events...)
+		//b is evicted by c, and emitted first
+		Expect(states).To(HaveLen(3))
+		Expect(states[0].Key).To(Equal("b"))
+		Expect(sums(states)).To(Equal(map[string]float64{"a": 4, "b": 2, "c": 4}))
+
+		states = runStage(math.Config{KeyField: "customer", MaxKeys: 2, Eviction: math.DropNewKeys}, events...)
+		Expect(sums(states)).To(Equal(map[string]float64{"a": 4, "b": 2}))
+	})
+
+	It("emits windows per key", func() {
+		states := runStage(math.Config{
+			KeyField: "customer",
+			Window:   &math.Window{Kind: math.Tumbling, Size: time.Minute},
+			TimeFn:   eventTime,
+		},
+			`{"customer": "b", "t": 1, "v": 1}`,
+			`{"customer": "a", "t": 2, "v": 2}`,
+			`{"customer": "a", "t": 61, "v": 4}`)
+
+		Expect(states).To(HaveLen(3))
+		Expect(states[0].Key).To(Equal("a"))
+		Expect(states[0].Sum).To(Equal(float64(2)))
+		Expect(states[1].Key).To(Equal("b"))
+		Expect(states[2].Key).To(Equal("a"))
+		Expect(states[2].Sum).To(Equal(float64(4)))
+	})
+})
+
+var _ = Describe("Distributions", func() {
+
+	logging.ConfigureDevelopment(GinkgoWriter)
+
+	//flow runs a stage over values 1..n, with user ids i % users, and returns the emitted state
+	flow := func(cfg math.Config, n int, users int) *math.State {
+		events := make([]string, n)
+		for i := 1; i <= n; i++ {
+			events[i-1] = fmt.Sprintf(`{"v": %d, "user": "u%d"}`, i, i%users)
+		}
+		states := runStage(cfg, events...)
+		Expect(states).To(HaveLen(1))
+		return states[0]
+	}
+
+	It("estimates quantiles within accuracy", func() {
+		state := flow(math.Config{Quantiles: []float64{0.5, 0.9, 0.99}}, 1000, 1)
+		Expect(state.Quantiles).To(HaveLen(3))
+		Expect(state.Quantiles["p50"]).To(BeNumerically("~", 500, 500*0.02))
+		Expect(state.Quantiles["p90"]).To(BeNumerically("~", 900, 900*0.02))
+		Expect(state.Quantiles["p99"]).To(BeNumerically("~", 990, 990*0.02))
+	})
+
+	It("computes variance and standard deviation", func() {
+		state := flow(math.Config{}, 4, 1)
+		//values 1, 2, 3, 4 have mean 2.5
+		Expect(state.Variance).To(BeNumerically("~", 1.25, 1e-9))
+		Expect(state.StdDev).To(BeNumerically("~", gomath.Sqrt(1.25), 1e-9))
+	})
+
+	It("counts values in histogram buckets", func() {
+		state := flow(math.Config{Buckets: math.ExponentialBuckets(1, 10, 3)}, 1000, 1)
+		Expect(state.Histogram.Bounds).To(Equal([]float64{1, 10, 100}))
+		Expect(state.Histogram.Counts).To(Equal([]int64{1, 9, 90, 900}))
+
+		state = flow(math.Config{Buckets: math.LinearBuckets(250, 250, 3)}, 1000, 1)
+		Expect(state.Histogram.Counts).To(Equal([]int64{250, 250, 250, 250}))
+	})
+
+	It("counts distinct values", func() {
+		state := flow(math.Config{DistinctField: "user"}, 5000, 3000)
+		Expect(float64(state.DistinctCount)).To(BeNumerically("~", 3000, 3000*0.05))
+
+		state = flow(math.Config{DistinctField: "user"}, 10, 3)
+		Expect(state.DistinctCount).To(Equal(uint64(3)))
+	})
+
+	It("merges states of several processes", func() {
+		cfg := math.Config{Quantiles: []float64{0.5}, Buckets: []float64{500}, DistinctField: "user"}
+		merged := flow(cfg, 500, 100)
+		other := flow(cfg, 1000, 200)
+		Expect(merged.Merge(other)).To(BeNil())
+
+		Expect(merged.N).To(Equal(int64(1500)))
+		Expect(merged.Histogram.Counts).To(Equal([]int64{1000, 500}))
+		Expect(merged.Sketch.Count()).To(Equal(int64(1500)))
+		Expect(merged.Sketch.Quantile(0.5)).To(BeNumerically("~", 375, 375*0.02))
+		Expect(float64(merged.Distinct.Count())).To(BeNumerically("~", 200, 200*0.05))
+
+		//variance of merged states is the variance of all values
+		all := flow(math.Config{}, 500, 1)
+		Expect(all.Merge(flow(math.Config{}, 1000, 1))).To(BeNil())
+		m2 := 0.0
+		mean := all.Sum / float64(all.N)
+		for _, n := range []int{500, 1000} {
+			for i := 1; i <= n; i++ {
+				m2 += (float64(i) - mean) * (float64(i) - mean)
+			}
+		}
+		Expect(all.M2).To(BeNumerically("~", m2, 1e-6*m2))
+
+		other = flow(math.Config{Buckets: []float64{1}}, 1, 1)
+		Expect(merged.Merge(other)).NotTo(BeNil())
+	})
+
+	It("fails on invalid configs", func() {
+		for _, cfg := range []math.Config{
+			math.Config{Quantiles: []float64{2}},
+			math.Config{Quantiles: []float64{0.5}, Accuracy: 1},
+			math.Config{Buckets: []float64{2, 1}},
+			math.Config{DistinctField: "user", Precision: 30},
+		} {
+			cfg.Fn = value
+			_, err := math.NewStageWithConfig(programmatic.NewSource(), buffer.NewSink(), cfg)
+			Expect(err).NotTo(BeNil())
+		}
+	})
+})
+
+var _ = Describe("Merging", func() {
+
+	logging.ConfigureDevelopment(GinkgoWriter)
+
+	It("initializes min and max from the first value", func() {
+		state := runStage(math.Config{}, `{"v": 5}`, `{"v": 3}`, `{"v": 4}`)[0]
+		Expect(state.Min).To(Equal(float64(3)))
+		Expect(state.Max).To(Equal(float64(5)))
+
+		state = runStage(math.Config{}, `{"v": -5}`, `{"v": -3}`)[0]
+		Expect(state.Min).To(Equal(float64(-5)))
+		Expect(state.Max).To(Equal(float64(-3)))
+	})
+
+	It("merges empty states", func() {
+		state := math.State{}
+		Expect(state.Merge(&math.State{Min: 2, Max: 4, Sum: 6, N: 2, Key: "a"})).To(BeNil())
+		Expect(state.Merge(&math.State{})).To(BeNil())
+		Expect(state.Min).To(Equal(float64(2)))
+		Expect(state.Max).To(Equal(float64(4)))
+		Expect(state.N).To(Equal(int64(2)))
+		Expect(state.Key).To(Equal("a"))
+	})
+
+	It("resumes from a snapshot", func() {
+		sink := buffer.NewSink()
+		first := newStage(math.Config{KeyField: "k"}, sink, `{"k": "a", "v": 1}`, `{"k": "b", "v": 2}`)
+		Expect(first.Flow()).To(Equal(errors.ErrSourceClosed))
+		snapshot, err := first.Snapshot()
+		Expect(err).To(BeNil())
+
+		sink = buffer.NewSink()
+		second := newStage(math.Config{KeyField: "k"}, sink, `{"k": "a", "v": 3}`)
+		Expect(second.Restore(snapshot)).To(BeNil())
+		Expect(second.States()).To(HaveLen(2))
+		Expect(second.Flow()).To(Equal(errors.ErrSourceClosed))
+
+		states := unmarshal(sink.Events)
+		Expect(states).To(HaveLen(2))
+		Expect(states[0].Key).To(Equal("a"))
+		Expect(states[0].Sum).To(Equal(float64(4)))
+		Expect(states[0].Min).To(Equal(float64(1)))
+		Expect(states[1].Sum).To(Equal(float64(2)))
+
+		windowed := newStage(math.Config{Window: &math.Window{Kind: math.Tumbling, Size: time.Minute}}, sink)
+		Expect(windowed.Restore(snapshot)).NotTo(BeNil())
+	})
+
+	It("checkpoints open windows", func() {
+		cfg := math.Config{
+			Window: &math.Window{Kind: math.Tumbling, Size: time.Minute},
+			TimeFn: eventTime,
+		}
+		var checkpoint []byte
+		cfg.Checkpoint = func(snapshot []byte) error {
+			if checkpoint == nil {
+				checkpoint = snapshot
+			}
+			return nil
+		}
+
+		//first checkpoint is after the first window closes, with the second open
+		sink := buffer.NewSink()
+		stage := newStage(cfg, sink, `{"t": 1, "v": 1}`, `{"t": 61, "v": 2}`, `{"t": 62, "v": 3}`)
+		Expect(stage.Flow()).To(Equal(errors.ErrSourceClosed))
+		Expect(checkpoint).NotTo(BeNil())
+
+		cfg.Checkpoint = nil
+		sink = buffer.NewSink()
+		stage = newStage(cfg, sink, `{"t": 62, "v": 3}`, `{"t": 1, "v": 100}`)
+		Expect(stage.Restore(checkpoint)).To(BeNil())
+		Expect(stage.Flow()).To(Equal(errors.ErrSourceClosed))
+
+		//late event is dropped, since watermark was restored
+		states := unmarshal(sink.Events)
+		Expect(states).To(HaveLen(1))
+		Expect(states[0].Start.Sub(base)).To(Equal(time.Minute))
+		Expect(states[0].Sum).To(Equal(float64(5)))
+	})
+
+	It("reduces states of several shards", func() {
+		cfg := math.Config{
+			KeyField:  "k",
+			Window:    &math.Window{Kind: math.Tumbling, Size: time.Minute},
+			TimeFn:    eventTime,
+			Quantiles: []float64{0.5},
+		}
+		emitted := buffer.NewSink()
+		shard := newStage(cfg, emitted, `{"k": "a", "t": 1, "v": 1}`, `{"k": "b", "t": 2, "v": 10}`, `{"k": "a", "t": 61, "v": 2}`)
+		Expect(shard.Flow()).To(Equal(errors.ErrSourceClosed))
+		shard = newStage(cfg, emitted, `{"k": "a", "t": 3, "v": 3}`, `{"k": "a", "t": 62, "v": 4}`)
+		Expect(shard.Flow()).To(Equal(errors.ErrSourceClosed))
+
+		source := programmatic.NewSource()
+		for _, e := range emitted.Events {
+			source.Put(e)
+		}
+		source.PutString("not a state")
+		source.Close()
+
+		sink := buffer.NewSink()
+		reduce, err := math.NewReduceStage(source, sink, math.ReduceConfig{Shards: 2, Quantiles: []float64{0.5}})
+		Expect(err).To(BeNil())
+		Expect(reduce.Flow()).To(Equal(errors.ErrSourceClosed))
+
+		states := unmarshal(sink.Events)
+		Expect(states).To(HaveLen(3))
+		//windows of a are merged from both shards, and b at the end
+		Expect(states[0].Key).To(Equal("a"))
+		Expect(states[0].Sum).To(Equal(float64(4)))
+		Expect(states[0].Min).To(Equal(float64(1)))
+		Expect(states[1].Key).To(Equal("a"))
+		Expect(states[1].Sum).To(Equal(float64(6)))
+		Expect(states[1].Quantiles).To(HaveKey("p50"))
+		Expect(states[2].Key).To(Equal("b"))
+		Expect(states[2].N).To(Equal(int64(1)))
+	})
+})
@@ -0,0 +1,136 @@
+package math
+
+import (
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"go.uber.org/zap"
+	"time"
+)
+
+//ReduceConfig is the input arguments to NewReduceStage.
+type ReduceConfig struct {
+	Shards    int       //emits merged states once this many states of a key and window have been merged, when > 0
+	Quantiles []float64 //quantiles to summarize merged states with
+}
+
+/*
+ReduceStage merges states emitted by several Stages, e.g. one per shard,
+into one state per key and window, fulfills Stage interface.
+
+Merged states are emitted when Shards states have been merged, and all
+remaining ones at the end of the source, in the order they first arrived.
+Events that aren't states are dropped.
+*/
+type ReduceStage struct {
+	cfg     ReduceConfig
+	source  types.Source
+	sink    types.Sink
+	pending map[reduceKey]*reduced
+	order   []reduceKey //keys of pending states, by first arrival
+}
+
+//reduceKey identifies states that are merged together
+type reduceKey struct {
+	key   string
+	start time.Time
+	end   time.Time
+}
+
+//reduced is a state being merged
+type reduced struct {
+	state  State
+	merged int
+}
+
+//NewReduceStage creates a ReduceStage that merges states drawn from source.
+func NewReduceStage(source types.Source, sink types.Sink, cfg ReduceConfig) (*ReduceStage, error) {
+	if source == nil {
+		return nil, errors.ErrNilSource
+	}
+	if sink == nil {
+		return nil, errors.ErrNilSink
+	}
+
+	return &ReduceStage{
+		cfg:     cfg,
+		source:  source,
+		sink:    sink,
+		pending: map[reduceKey]*reduced{},
+	}, nil
+}
+
+//Flow fulfills Stage interface, merging states until the source ends.
+func (r *ReduceStage) Flow() error {
+	logger := logging.Logger()
+
+	for {
+		e, err := r.source.DrawOne()
+		if e != nil {
+			if mergeErr := r.merge(e); mergeErr != nil {
+				logger.Debug("math.ReduceStage: dropping event", zap.Error(mergeErr))
+			}
+			if r.cfg.Shards > 0 {
+				if emitErr := r.emit(r.cfg.Shards); emitErr != nil {
+					return emitErr
+				}
+			}
+		}
+
+		if err != nil || e == nil {
+			if emitErr := r.emit(0); emitErr != nil {
+				return emitErr
+			}
+			return err
+		}
+	}
+}
+
+//merge merges a state event into the pending state of its key and window
+func (r *ReduceStage) merge(e *types.Event) error {
+	state, err := Unmarshal(e)
+	if err != nil {
+		return err
+	}
+
+	k := reduceKey{key: state.Key}
+	if state.Start != nil {
+		k.start = state.Start.UTC()
+	}
+	if state.End != nil {
+		k.end = state.End.UTC()
+	}
+
+	p, ok := r.pending[k]
+	if !ok {
+		r.pending[k] = &reduced{state: *state, merged: 1}
+		r.order = append(r.order, k)
+		return nil
+	}
+	if err = p.state.Merge(state); err != nil {
+		return err
+	}
+	p.merged++
+	return nil
+}
+
+//emit emits pending states merged from at least min states
+func (r *ReduceStage) emit(min int) error {
+	states := []State{}
+	order := r.order[:0]
+	for _, k := range r.order {
+		p := r.pending[k]
+		if p.merged < min {
+			order = append(order, k)
+			continue
+		}
+		states = append(states, p.state)
+		delete(r.pending, k)
+	}
+	r.order = order
+
+	if len(states) == 0 {
+		return nil
+	}
+	return emit(r.sink, r.cfg.Quantiles, states)
+}
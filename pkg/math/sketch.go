@@ -0,0 +1,294 @@
+package math
+
+import (
+	"fmt"
+	"hash/fnv"
+	gomath "math"
+	"math/bits"
+	"sort"
+)
+
+const (
+	//DefaultAccuracy is the relative accuracy of quantiles.
+	DefaultAccuracy = 0.01
+	//DefaultPrecision is the precision of distinct counts, using 2^precision bytes per state.
+	DefaultPrecision = 12
+)
+
+/*
+Sketch estimates quantiles of values, with a relative accuracy.
+
+It's a DDSketch, that counts values in logarithmic buckets,
+so the estimated quantile of a value x is within x*Accuracy of it.
+Sketches of the same accuracy can be merged.
+*/
+type Sketch struct {
+	Accuracy float64         `json:"accuracy"`
+	Positive map[int32]int64 `json:"positive,omitempty"` //counts of positive values, by bucket
+	Negative map[int32]int64 `json:"negative,omitempty"` //counts of negative values, by bucket of their absolute value
+	Zero     int64           `json:"zero,omitempty"`     //count of zeros
+}
+
+//Histogram counts values in buckets, by upper bound. Histograms with the same bounds can be merged.
+type Histogram struct {
+	Bounds []float64 `json:"bounds"` //inclusive upper bounds of buckets, in increasing order
+	Counts []int64   `json:"counts"` //counts of buckets, and a last one for values above all bounds
+}
+
+/*
+HyperLogLog estimates the number of distinct values, with a standard
+error of about 1.04/sqrt(2^Precision). HyperLogLogs of the same
+precision can be merged.
+*/
+type HyperLogLog struct {
+	Precision uint8  `json:"precision"`
+	Registers []byte `json:"registers"`
+}
+
+//NewSketch creates a Sketch with a relative accuracy between 0 and 1.
+func NewSketch(accuracy float64) (*Sketch, error) {
+	if accuracy <= 0 || accuracy >= 1 {
+		return nil, fmt.Errorf("sketch accuracy must be between 0 and 1")
+	}
+	return &Sketch{
+		Accuracy: accuracy,
+		Positive: map[int32]int64{},
+		Negative: map[int32]int64{},
+	}, nil
+}
+
+//init makes bucket maps, which are omitted from json when empty
+func (sketch *Sketch) init() {
+	if sketch.Positive == nil {
+		sketch.Positive = map[int32]int64{}
+	}
+	if sketch.Negative == nil {
+		sketch.Negative = map[int32]int64{}
+	}
+}
+
+//gamma is the ratio of bucket bounds
+func (sketch *Sketch) gamma() float64 {
+	return (1 + sketch.Accuracy) / (1 - sketch.Accuracy)
+}
+
+//Add counts a value.
+func (sketch *Sketch) Add(val float64) {
+	sketch.init()
+	switch {
+	case val > 0:
+		sketch.Positive[sketch.bucket(val)]++
+	case val < 0:
+		sketch.Negative[sketch.bucket(-val)]++
+	default:
+		sketch.Zero++
+	}
+}
+
+//bucket is the index of the bucket of a positive value
+func (sketch *Sketch) bucket(val float64) int32 {
+	return int32(gomath.Ceil(gomath.Log(val) / gomath.Log(sketch.gamma())))
+}
+
+//value is the estimate for values in a bucket
+func (sketch *Sketch) value(bucket int32) float64 {
+	gamma := sketch.gamma()
+	return 2 * gomath.Pow(gamma, float64(bucket)) / (gamma + 1)
+}
+
+//Count returns the number of values counted.
+func (sketch *Sketch) Count() int64 {
+	n := sketch.Zero
+	for _, c := range sketch.Positive {
+		n += c
+	}
+	for _, c := range sketch.Negative {
+		n += c
+	}
+	return n
+}
+
+//Quantile estimates the q quantile, for q between 0 and 1. Returns NaN for empty sketches.
+func (sketch *Sketch) Quantile(q float64) float64 {
+	n := sketch.Count()
+	if n == 0 || q < 0 || q > 1 {
+		return gomath.NaN()
+	}
+	rank := int64(q * float64(n-1))
+
+	//negative values in increasing order, which is decreasing bucket order
+	negative := sortedBuckets(sketch.Negative)
+	for i := len(negative) - 1; i >= 0; i-- {
+		if rank -= sketch.Negative[negative[i]]; rank < 0 {
+			return -sketch.value(negative[i])
+		}
+	}
+	if rank -= sketch.Zero; rank < 0 {
+		return 0
+	}
+	positive := sortedBuckets(sketch.Positive)
+	for _, bucket := range positive {
+		if rank -= sketch.Positive[bucket]; rank < 0 {
+			return sketch.value(bucket)
+		}
+	}
+	return sketch.value(positive[len(positive)-1])
+}
+
+//Merge adds the counts of another sketch, which must have the same accuracy.
+func (sketch *Sketch) Merge(other *Sketch) error {
+	if other.Accuracy != sketch.Accuracy {
+		return fmt.Errorf("can't merge sketches of accuracy %v and %v", sketch.Accuracy, other.Accuracy)
+	}
+	sketch.init()
+	for bucket, c := range other.Positive {
+		sketch.Positive[bucket] += c
+	}
+	for bucket, c := range other.Negative {
+		sketch.Negative[bucket] += c
+	}
+	sketch.Zero += other.Zero
+	return nil
+}
+
+//sortedBuckets returns bucket indexes in increasing order
+func sortedBuckets(counts map[int32]int64) []int32 {
+	buckets := make([]int32, 0, len(counts))
+	for bucket := range counts {
+		buckets = append(buckets, bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	return buckets
+}
+
+//NewHistogram creates a Histogram with bucket upper bounds, in increasing order.
+func NewHistogram(bounds []float64) (*Histogram, error) {
+	if len(bounds) == 0 {
+		return nil, fmt.Errorf("histogram needs at least one bucket")
+	}
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			return nil, fmt.Errorf("histogram bounds must be increasing")
+		}
+	}
+	return &Histogram{
+		Bounds: append([]float64{}, bounds...),
+		Counts: make([]int64, len(bounds)+1),
+	}, nil
+}
+
+//LinearBuckets returns count bucket bounds, starting at start and width apart.
+func LinearBuckets(start float64, width float64, count int) []float64 {
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start + float64(i)*width
+	}
+	return bounds
+}
+
+//ExponentialBuckets returns count bucket bounds, starting at start and each factor times the last.
+func ExponentialBuckets(start float64, factor float64, count int) []float64 {
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start * gomath.Pow(factor, float64(i))
+	}
+	return bounds
+}
+
+//Add counts a value in its bucket.
+func (histogram *Histogram) Add(val float64) {
+	histogram.Counts[sort.SearchFloat64s(histogram.Bounds, val)]++
+}
+
+//Merge adds the counts of another histogram, which must have the same bounds.
+func (histogram *Histogram) Merge(other *Histogram) error {
+	if len(other.Bounds) != len(histogram.Bounds) || len(other.Counts) != len(histogram.Counts) {
+		return fmt.Errorf("can't merge histograms with different bounds")
+	}
+	for i, bound := range other.Bounds {
+		if bound != histogram.Bounds[i] {
+			return fmt.Errorf("can't merge histograms with different bounds")
+		}
+	}
+	for i, c := range other.Counts {
+		histogram.Counts[i] += c
+	}
+	return nil
+}
+
+//NewHyperLogLog creates a HyperLogLog with a precision between 4 and 18.
+func NewHyperLogLog(precision uint8) (*HyperLogLog, error) {
+	if precision < 4 || precision > 18 {
+		return nil, fmt.Errorf("hyperloglog precision must be between 4 and 18")
+	}
+	return &HyperLogLog{
+		Precision: precision,
+		Registers: make([]byte, 1<<precision),
+	}, nil
+}
+
+//Add counts a value.
+func (hll *HyperLogLog) Add(val string) {
+	h := fnv.New64a()
+	h.Write([]byte(val))
+	x := mix(h.Sum64())
+
+	i := x >> (64 - hll.Precision)
+	rank := byte(bits.LeadingZeros64(x<<hll.Precision|1<<(hll.Precision-1)) + 1)
+	if rank > hll.Registers[i] {
+		hll.Registers[i] = rank
+	}
+}
+
+//mix finalizes fnv hashes, so all bits are well distributed
+func mix(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+//Count estimates the number of distinct values.
+func (hll *HyperLogLog) Count() uint64 {
+	m := float64(len(hll.Registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range hll.Registers {
+		sum += gomath.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	switch len(hll.Registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	}
+	estimate := alpha * m * m / sum
+
+	//linear counting is more accurate for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * gomath.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+//Merge adds the values of another HyperLogLog, which must have the same precision.
+func (hll *HyperLogLog) Merge(other *HyperLogLog) error {
+	if other.Precision != hll.Precision || len(other.Registers) != len(hll.Registers) {
+		return fmt.Errorf("can't merge hyperloglogs of precision %d and %d", hll.Precision, other.Precision)
+	}
+	for i, r := range other.Registers {
+		if r > hll.Registers[i] {
+			hll.Registers[i] = r
+		}
+	}
+	return nil
+}
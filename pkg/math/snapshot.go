@@ -0,0 +1,128 @@
+package math
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+//CheckpointFn is the function signature for saving snapshots of a Stage, e.g. to a file.
+type CheckpointFn func(snapshot []byte) error
+
+//snapshot is the serialized state of a Stage
+type snapshot struct {
+	N         int64           `json:"n"`
+	Watermark time.Time       `json:"watermark"`
+	Groups    []snapshotGroup `json:"groups"` //least recently updated first
+}
+
+//snapshotGroup is the serialized state of a key
+type snapshotGroup struct {
+	Key     string  `json:"key"`
+	State   *State  `json:"state,omitempty"`   //running state, when not windowed
+	Windows []State `json:"windows,omitempty"` //open windows, when windowed
+}
+
+/*
+Snapshot serializes the state of the stage, which can be restored
+with Restore to resume aggregating, e.g. after a restart.
+
+Safe to call while flowing. Use Config.Checkpoint to get snapshots
+consistent with emitted events.
+*/
+func (s *Stage) Snapshot() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot()
+}
+
+//snapshot serializes the state. Must hold lock
+func (s *Stage) snapshot() ([]byte, error) {
+	snap := snapshot{N: s.n, Watermark: s.watermark, Groups: []snapshotGroup{}}
+	for elem := s.groups.recent.Back(); elem != nil; elem = elem.Prev() {
+		grp := elem.Value.(*group)
+		sg := snapshotGroup{Key: grp.key}
+		if grp.windows == nil {
+			state := grp.state
+			sg.State = &state
+		} else {
+			sg.Windows = grp.states(grp.windows.open)
+		}
+		snap.Groups = append(snap.Groups, sg)
+	}
+	return json.Marshal(snap)
+}
+
+/*
+Restore replaces the state of the stage with a snapshot.
+
+The stage should be configured like the one the snapshot
+was made from, and fails if it's windowed and the snapshot isn't,
+or the other way around.
+*/
+func (s *Stage) Restore(b []byte) error {
+	snap := snapshot{}
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	groups, err := newGroups(s.groups.max, s.groups.eviction, s.window, s.newState)
+	if err != nil {
+		return err
+	}
+	nextClose := time.Time{}
+	for _, sg := range snap.Groups {
+		if (sg.State == nil) != (s.window != nil) {
+			return fmt.Errorf("snapshot of key %s doesn't match stage windowing", sg.Key)
+		}
+		grp := &group{key: sg.Key, state: s.newState()}
+		if sg.State != nil {
+			grp.state = *sg.State
+		} else {
+			grp.windows = newWindows(*s.window, s.newState)
+			for _, state := range sg.Windows {
+				if state.Start == nil || state.End == nil {
+					return fmt.Errorf("snapshot window of key %s has no bounds", sg.Key)
+				}
+				grp.windows.open = append(grp.windows.open, &window{start: *state.Start, end: *state.End, state: state})
+			}
+			sort.Slice(grp.windows.open, func(i, j int) bool { return grp.windows.open[i].start.Before(grp.windows.open[j].start) })
+			if next, ok := grp.windows.next(); ok && (nextClose.IsZero() || next.Before(nextClose)) {
+				nextClose = next
+			}
+		}
+		grp.elem = groups.recent.PushFront(grp)
+		groups.byKey[grp.key] = grp
+	}
+
+	s.groups = groups
+	s.n = snap.N
+	s.watermark = snap.Watermark
+	s.nextClose = nextClose
+	return nil
+}
+
+//States returns the current states of all keys, or of all open windows, ordered by key.
+//Safe to call while flowing.
+func (s *Stage) States() []State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	states := []State{}
+	for _, grp := range s.groups.sorted() {
+		if grp.windows == nil {
+			states = append(states, grp.states(nil)...)
+		} else {
+			states = append(states, grp.states(grp.windows.open)...)
+		}
+	}
+	for i := range states {
+		states[i] = states[i].clone()
+		states[i].summarize(s.quantiles)
+	}
+	return states
+}
@@ -0,0 +1,188 @@
+package math
+
+import (
+	"fmt"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"sort"
+	"time"
+)
+
+//WindowKind is the kind of time window stats are aggregated in.
+type WindowKind int
+
+const (
+	//Tumbling windows are fixed size, and don't overlap.
+	Tumbling WindowKind = iota
+	//Sliding windows are fixed size, and start every Slide, so they can overlap.
+	Sliding
+	//Session windows contain events that are less than Gap apart.
+	Session
+)
+
+/*
+Window configures aggregation in time windows, emitting one
+event per window, when the watermark passes its end.
+
+The watermark is the latest event time seen minus Lateness, so events
+can arrive up to Lateness out of order. Events arriving after the watermark
+passed the end of all their windows are dropped.
+With processing time, the watermark is the current time.
+*/
+type Window struct {
+	Kind     WindowKind
+	Size     time.Duration //length of tumbling and sliding windows
+	Slide    time.Duration //start interval of sliding windows, defaults to Size
+	Gap      time.Duration //max time between events of a session
+	Lateness time.Duration //how far behind the latest event time the watermark is
+}
+
+//TimeFn is the function signature for reading the event time of an event.
+type TimeFn func(*types.Event) (time.Time, error)
+
+//window is an open window and its state
+type window struct {
+	start time.Time
+	end   time.Time
+	state State
+}
+
+//windows are the open windows of a group
+type windows struct {
+	cfg      Window
+	open     []*window //sorted by start
+	newState func() State
+}
+
+//validate checks the window config, and sets defaults
+func (w *Window) validate() error {
+	switch w.Kind {
+	case Tumbling, Sliding:
+		if w.Size <= 0 {
+			return fmt.Errorf("window size must be positive")
+		}
+		if w.Slide == 0 {
+			w.Slide = w.Size
+		}
+		if w.Slide < 0 || w.Slide > w.Size {
+			return fmt.Errorf("window slide must be positive and at most size")
+		}
+	case Session:
+		if w.Gap <= 0 {
+			return fmt.Errorf("session gap must be positive")
+		}
+	default:
+		return fmt.Errorf("invalid window kind %d", w.Kind)
+	}
+	if w.Lateness < 0 {
+		return fmt.Errorf("window lateness can't be negative")
+	}
+	return nil
+}
+
+//newWindows makes windows for a validated config
+func newWindows(cfg Window, newState func() State) *windows {
+	return &windows{cfg: cfg, newState: newState}
+}
+
+//add updates all windows at t with fn, returning false if the watermark passed all of them
+func (w *windows) add(t time.Time, watermark time.Time, fn func(*State)) bool {
+	if w.cfg.Kind == Session {
+		return w.addSession(t, watermark, fn)
+	}
+
+	added := false
+	//latest window containing t starts at the last slide before it
+	for start := t.Truncate(w.cfg.Slide); start.Add(w.cfg.Size).After(t); start = start.Add(-w.cfg.Slide) {
+		end := start.Add(w.cfg.Size)
+		if !end.After(watermark) {
+			break
+		}
+		fn(&w.find(start, end).state)
+		added = true
+	}
+	return added
+}
+
+//find returns the open window, creating it if needed
+func (w *windows) find(start time.Time, end time.Time) *window {
+	i := sort.Search(len(w.open), func(i int) bool { return !w.open[i].start.Before(start) })
+	if i < len(w.open) && w.open[i].start.Equal(start) {
+		return w.open[i]
+	}
+	win := &window{start: start, end: end, state: w.newState()}
+	w.open = append(w.open, nil)
+	copy(w.open[i+1:], w.open[i:])
+	w.open[i] = win
+	return win
+}
+
+//addSession updates the session at t with fn, merging sessions it bridges
+func (w *windows) addSession(t time.Time, watermark time.Time, fn func(*State)) bool {
+	end := t.Add(w.cfg.Gap)
+	if !end.After(watermark) {
+		return false
+	}
+
+	session := &window{start: t, end: end, state: w.newState()}
+	fn(&session.state)
+
+	//merge overlapping sessions into the new one
+	open := w.open[:0]
+	for _, win := range w.open {
+		if !win.start.Before(session.end) || !win.end.After(session.start) {
+			open = append(open, win)
+			continue
+		}
+		if win.start.Before(session.start) {
+			session.start = win.start
+		}
+		if win.end.After(session.end) {
+			session.end = win.end
+		}
+		//states of the same windows always merge
+		session.state.Merge(&win.state)
+	}
+	w.open = open
+	i := sort.Search(len(w.open), func(i int) bool { return !w.open[i].start.Before(session.start) })
+	w.open = append(w.open, nil)
+	copy(w.open[i+1:], w.open[i:])
+	w.open[i] = session
+	return true
+}
+
+//advance closes windows the watermark has passed, ordered by end
+func (w *windows) advance(watermark time.Time) []*window {
+	return w.close(func(win *window) bool { return !win.end.After(watermark) })
+}
+
+//flush closes all windows, ordered by end
+func (w *windows) flush() []*window {
+	return w.close(func(*window) bool { return true })
+}
+
+//close removes windows matching fn, ordered by end
+func (w *windows) close(fn func(*window) bool) []*window {
+	closed := []*window{}
+	open := w.open[:0]
+	for _, win := range w.open {
+		if fn(win) {
+			closed = append(closed, win)
+		} else {
+			open = append(open, win)
+		}
+	}
+	w.open = open
+	sort.SliceStable(closed, func(i, j int) bool { return closed[i].end.Before(closed[j].end) })
+	return closed
+}
+
+//next returns the earliest end of open windows, false if there are none
+func (w *windows) next() (time.Time, bool) {
+	var next time.Time
+	for _, win := range w.open {
+		if next.IsZero() || win.end.Before(next) {
+			next = win.end
+		}
+	}
+	return next, !next.IsZero()
+}
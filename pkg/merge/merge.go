@@ -0,0 +1,326 @@
+/*
+Package merge provides a source that draws from many
+sources concurrently, and exposes them as one source.
+
+Inputs are drawn from in the background, and DrawOne takes
+one event from each ready input in turn, so busy inputs can't
+starve quiet ones. Inputs can be added and removed while drawing,
+and events can be tagged with the name of their input.
+
+A drawing error ends an input, which is removed and closed, so sources
+must tolerate being closed after they end. Depending on Mode, the merged
+source ends when all inputs have ended, or when any of them have, returning
+the error of the input that ended it, or only when it's closed.
+*/
+package merge
+
+import (
+	"fmt"
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/errors"
+	pkgjson "github.com/underscorenygren/partaj/pkg/json"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"go.uber.org/zap"
+	"sync"
+)
+
+//Mode is when the merged source ends.
+type Mode int
+
+const (
+	//EndWhenAll ends the source when all inputs have ended.
+	EndWhenAll Mode = iota
+	//EndWhenAny ends the source when any input ends.
+	EndWhenAny
+	//EndWhenClosed only ends the source when it's closed. Inputs that end are
+	//removed, and DrawOne waits for inputs to be added when there are none.
+	EndWhenClosed
+)
+
+//DefaultBufferSize is the number of events drawn ahead from each input.
+const DefaultBufferSize = 1
+
+//TagFn is the function signature for tagging events with the name of their input.
+type TagFn func(name string, e *types.Event) (*types.Event, error)
+
+//Config is the input arguments to NewSource.
+type Config struct {
+	Mode       Mode  //defaults to EndWhenAll
+	Tag        TagFn //tags events with the name of their input, when set
+	BufferSize int   //events drawn ahead from each input, defaults to DefaultBufferSize
+}
+
+//Source implements the Source interface, merging events of its inputs.
+type Source struct {
+	cfg    Config
+	mu     sync.Mutex
+	inputs []*input
+	next   int           //input to draw from first, for round robin
+	ready  chan struct{} //signals that an input has an event, or inputs changed
+	err    error         //set when the source has ended
+	closed bool
+}
+
+//input is a source being drawn from in the background
+type input struct {
+	name    string
+	source  types.Source
+	c       chan result
+	removed chan struct{}
+}
+
+//result is the result of drawing from an input
+type result struct {
+	e   *types.Event
+	err error
+}
+
+//implements interfaces
+var _ types.Source = &Source{}
+
+//NewSource creates a merged Source, with inputs added by name.
+func NewSource(cfg Config, inputs map[string]types.Source) (*Source, error) {
+	if cfg.Mode != EndWhenAll && cfg.Mode != EndWhenAny && cfg.Mode != EndWhenClosed {
+		return nil, fmt.Errorf("invalid merge mode %d", cfg.Mode)
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = DefaultBufferSize
+	}
+
+	source := &Source{
+		cfg:   cfg,
+		ready: make(chan struct{}, 1),
+	}
+	for name, s := range inputs {
+		if err := source.Add(name, s); err != nil {
+			return nil, err
+		}
+	}
+	return source, nil
+}
+
+/*
+Add starts drawing from a source, whose events are tagged with name.
+
+Fails if the name is taken, or the merged source has ended.
+*/
+func (source *Source) Add(name string, s types.Source) error {
+	if s == nil {
+		return errors.ErrNilSource
+	}
+
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	if source.closed {
+		return errors.ErrSourceClosed
+	}
+	if source.err != nil {
+		return source.err
+	}
+	if source.find(name) >= 0 {
+		return fmt.Errorf("merge input %s already exists", name)
+	}
+
+	in := &input{
+		name:    name,
+		source:  s,
+		c:       make(chan result, source.cfg.BufferSize),
+		removed: make(chan struct{}),
+	}
+	source.inputs = append(source.inputs, in)
+	go source.draw(in)
+	source.signal()
+
+	logging.Logger().Debug("merge.Add: added input", zap.String("name", name))
+	return nil
+}
+
+//Remove stops drawing from an input and closes it. Events drawn ahead are discarded.
+func (source *Source) Remove(name string) error {
+	source.mu.Lock()
+	i := source.find(name)
+	if i < 0 {
+		source.mu.Unlock()
+		return fmt.Errorf("merge input %s doesn't exist", name)
+	}
+	in := source.inputs[i]
+	source.remove(i)
+	source.mu.Unlock()
+
+	logging.Logger().Debug("merge.Remove: removed input", zap.String("name", name))
+	return in.close()
+}
+
+//Names returns the names of current inputs.
+func (source *Source) Names() []string {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	names := make([]string, len(source.inputs))
+	for i, in := range source.inputs {
+		names[i] = in.name
+	}
+	return names
+}
+
+/*
+DrawOne draws an event from the next ready input, blocking until there is one.
+
+Returns errors.ErrSourceClosed after Close, and the error of the input
+that ended the source once it has ended.
+*/
+func (source *Source) DrawOne() (*types.Event, error) {
+	logger := logging.Logger()
+
+draw:
+	for {
+		source.mu.Lock()
+		if source.closed {
+			source.mu.Unlock()
+			return nil, errors.ErrSourceClosed
+		}
+		if source.err != nil {
+			err := source.err
+			source.mu.Unlock()
+			return nil, err
+		}
+
+		for k := 0; k < len(source.inputs); k++ {
+			i := (source.next + k) % len(source.inputs)
+			in := source.inputs[i]
+			select {
+			case r := <-in.c:
+				source.next = i + 1
+				if r.err != nil {
+					logger.Debug("merge.DrawOne: input ended", zap.String("name", in.name), zap.Error(r.err))
+					source.remove(i)
+					if source.cfg.Mode == EndWhenAny || (source.cfg.Mode == EndWhenAll && len(source.inputs) == 0) {
+						source.err = r.err
+					}
+					source.mu.Unlock()
+					if err := in.close(); err != nil {
+						logger.Debug("merge.DrawOne: input close failed", zap.String("name", in.name), zap.Error(err))
+					}
+					continue draw
+				}
+				source.mu.Unlock()
+				return source.tag(in.name, r.e)
+			default:
+			}
+		}
+		source.mu.Unlock()
+
+		<-source.ready
+	}
+}
+
+//Close closes all inputs, ending the source.
+func (source *Source) Close() error {
+	source.mu.Lock()
+	if source.closed {
+		source.mu.Unlock()
+		return nil
+	}
+	source.closed = true
+	inputs := source.inputs
+	source.inputs = nil
+	source.signal()
+	source.mu.Unlock()
+
+	var err error
+	for _, in := range inputs {
+		if closeErr := in.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+//TagPrefix tags events by prefixing them with the input name and sep.
+func TagPrefix(sep string) TagFn {
+	return func(name string, e *types.Event) (*types.Event, error) {
+		bytes := make([]byte, 0, len(name)+len(sep)+len(e.Bytes()))
+		bytes = append(append(append(bytes, name...), sep...), e.Bytes()...)
+		return e.NewBytes(bytes), nil
+	}
+}
+
+//TagField tags json events by setting the input name at a json path.
+func TagField(path string) TagFn {
+	return func(name string, e *types.Event) (*types.Event, error) {
+		return pkgjson.Mapper(func(jsonEvent *pkgjson.Event) *pkgjson.Event {
+			return jsonEvent.SetStringAt(path, name)
+		})(e)
+	}
+}
+
+//tag tags an event when configured
+func (source *Source) tag(name string, e *types.Event) (*types.Event, error) {
+	if source.cfg.Tag == nil {
+		return e, nil
+	}
+	return source.cfg.Tag(name, e)
+}
+
+//draw draws from an input until it errors or is removed
+func (source *Source) draw(in *input) {
+	for {
+		e, err := in.source.DrawOne()
+		if e != nil {
+			if !in.send(result{e: e}) {
+				return
+			}
+			source.signal()
+		}
+		if err != nil {
+			if in.send(result{err: err}) {
+				source.signal()
+			}
+			return
+		}
+	}
+}
+
+//signal wakes a blocked DrawOne, without blocking
+func (source *Source) signal() {
+	select {
+	case source.ready <- struct{}{}:
+	default:
+	}
+}
+
+//find returns the index of an input by name, or -1. Must hold lock
+func (source *Source) find(name string) int {
+	for i, in := range source.inputs {
+		if in.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+//remove removes an input by index. Must hold lock
+func (source *Source) remove(i int) {
+	source.inputs = append(source.inputs[:i:i], source.inputs[i+1:]...)
+	if source.next > i {
+		source.next--
+	}
+	source.signal()
+}
+
+//send sends a result, false if the input was removed first
+func (in *input) send(r result) bool {
+	select {
+	case in.c <- r:
+		return true
+	case <-in.removed:
+		return false
+	}
+}
+
+//close stops drawing and closes the input's source
+func (in *input) close() error {
+	close(in.removed)
+	return in.source.Close()
+}
@@ -0,0 +1,13 @@
+package merge_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestMerge(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Merge Suite")
+}
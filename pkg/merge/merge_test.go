@@ -0,0 +1,183 @@
+package merge_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"fmt"
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/buffer"
+	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/underscorenygren/partaj/pkg/merge"
+	"github.com/underscorenygren/partaj/pkg/pipe"
+	"github.com/underscorenygren/partaj/pkg/programmatic"
+	"github.com/underscorenygren/partaj/pkg/types"
+)
+
+//Example is just used to show the specs in godoc
+func Example() {}
+
+//drawN draws n non-nil events from a source
+func drawN(source types.Source, n int) []string {
+	drawn := []string{}
+	for len(drawn) < n {
+		e, err := source.DrawOne()
+		Expect(err).To(BeNil())
+		if e != nil {
+			drawn = append(drawn, e.String())
+		}
+	}
+	return drawn
+}
+
+//failSource fails drawing, and records that it's closed
+type failSource struct {
+	closed chan struct{}
+}
+
+func (s *failSource) DrawOne() (*types.Event, error) {
+	return nil, fmt.Errorf("failed")
+}
+
+func (s *failSource) Close() error {
+	close(s.closed)
+	return nil
+}
+
+var _ = Describe("Merge", func() {
+
+	logging.ConfigureDevelopment(GinkgoWriter)
+
+	var a, b *programmatic.Source
+
+	BeforeEach(func() {
+		a = programmatic.NewSource()
+		b = programmatic.NewSource()
+	})
+
+	It("merges and tags events until all inputs end", func(done Done) {
+		for i := 0; i < 3; i++ {
+			a.PutString("x")
+		}
+		b.PutString("y")
+		a.Close()
+		b.Close()
+
+		source, err := merge.NewSource(
+			merge.Config{Tag: merge.TagPrefix(":")},
+			map[string]types.Source{"a": a, "b": b})
+		Expect(err).To(BeNil())
+
+		sink := buffer.NewSink()
+		p, err := pipe.NewStage(source, sink)
+		Expect(err).To(BeNil())
+		Expect(p.Flow()).To(Equal(errors.ErrSourceClosed))
+
+		drawn := []string{}
+		for _, e := range sink.Events {
+			drawn = append(drawn, e.String())
+		}
+		Expect(drawn).To(ConsistOf("a:x", "a:x", "a:x", "b:y"))
+
+		close(done)
+	})
+
+	It("draws from ready inputs in turn", func(done Done) {
+		for i := 0; i < 10; i++ {
+			a.PutString("a")
+		}
+		source, err := merge.NewSource(merge.Config{}, map[string]types.Source{"a": a, "b": b})
+		Expect(err).To(BeNil())
+
+		Expect(drawN(source, 1)).To(Equal([]string{"a"}))
+		b.PutString("b")
+		Eventually(func() []string { return drawN(source, 2) }).Should(ContainElement("b"))
+
+		Expect(source.Close()).To(BeNil())
+		_, err = source.DrawOne()
+		Expect(err).To(Equal(errors.ErrSourceClosed))
+
+		close(done)
+	})
+
+	It("ends when any input ends", func(done Done) {
+		source, err := merge.NewSource(merge.Config{Mode: merge.EndWhenAny}, map[string]types.Source{"a": a, "b": b})
+		Expect(err).To(BeNil())
+
+		b.Close()
+		var drawErr error
+		for drawErr == nil {
+			_, drawErr = source.DrawOne()
+		}
+		Expect(drawErr).To(Equal(errors.ErrSourceClosed))
+		Expect(source.Names()).To(Equal([]string{"a"}))
+		Expect(source.Add("c", programmatic.NewSource())).NotTo(BeNil())
+
+		close(done)
+	})
+
+	It("adds and removes inputs", func(done Done) {
+		source, err := merge.NewSource(merge.Config{Tag: merge.TagField("input")}, nil)
+		Expect(err).To(BeNil())
+
+		Expect(source.Add("a", a)).To(BeNil())
+		Expect(source.Add("a", b)).NotTo(BeNil())
+		Expect(source.Add("b", b)).To(BeNil())
+		Expect(source.Names()).To(ConsistOf("a", "b"))
+
+		b.PutString(`{"id": 1}`)
+		Expect(drawN(source, 1)).To(Equal([]string{`{"id":1,"input":"b"}`}))
+
+		Expect(source.Remove("b")).To(BeNil())
+		Expect(source.Remove("b")).NotTo(BeNil())
+		Expect(source.Names()).To(Equal([]string{"a"}))
+
+		a.PutString(`{"id": 2}`)
+		Expect(drawN(source, 1)).To(Equal([]string{`{"id":2,"input":"a"}`}))
+
+		close(done)
+	})
+
+	It("closes inputs that end", func(done Done) {
+		failed := &failSource{closed: make(chan struct{})}
+		source, err := merge.NewSource(merge.Config{}, map[string]types.Source{"a": a, "failed": failed})
+		Expect(err).To(BeNil())
+
+		drawn := make(chan []string)
+		go func() {
+			defer GinkgoRecover()
+			drawn <- drawN(source, 1)
+		}()
+
+		Eventually(failed.closed).Should(BeClosed())
+		Expect(source.Names()).To(Equal([]string{"a"}))
+		a.PutString("one")
+		Eventually(drawn).Should(Receive(Equal([]string{"one"})))
+
+		Expect(source.Close()).To(BeNil())
+		close(done)
+	})
+
+	It("keeps drawing after all inputs end, until closed", func(done Done) {
+		failed := &failSource{closed: make(chan struct{})}
+		source, err := merge.NewSource(merge.Config{Mode: merge.EndWhenClosed}, map[string]types.Source{"failed": failed})
+		Expect(err).To(BeNil())
+
+		drawn := make(chan []string)
+		go func() {
+			defer GinkgoRecover()
+			drawn <- drawN(source, 1)
+		}()
+
+		Eventually(failed.closed).Should(BeClosed())
+		Eventually(source.Names).Should(BeEmpty())
+		Expect(source.Add("a", a)).To(BeNil())
+		a.PutString("one")
+		Eventually(drawn).Should(Receive(Equal([]string{"one"})))
+
+		Expect(source.Close()).To(BeNil())
+		_, err = source.DrawOne()
+		Expect(err).To(Equal(errors.ErrSourceClosed))
+		close(done)
+	})
+})
@@ -89,8 +89,12 @@ func (manual *Source) DrawOne() (*types.Event, error) {
 }
 
 //Close closes the source, the underlying channel, causing further puts to error.
+//Closing a closed source does nothing.
 func (manual *Source) Close() error {
-	close(manual.c)
+	if manual.closed {
+		return nil
+	}
 	manual.closed = true
+	close(manual.c)
 	return nil
 }
@@ -0,0 +1,218 @@
+/*
+Package router is a sink that routes events to other sinks
+based on their content.
+
+Routes are evaluated in order for every event, and matching
+events are drained to the route's sink in sub-batches, e.g.
+errors to one firehose, audit events to cloudwatch and the
+rest to s3.
+*/
+package router
+
+import (
+	"fmt"
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/underscorenygren/partaj/pkg/filter"
+	pkgjson "github.com/underscorenygren/partaj/pkg/json"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"github.com/valyala/fastjson"
+	"go.uber.org/zap"
+)
+
+//Mode is how many routes an event is sent to.
+type Mode int
+
+const (
+	//ModeFirstMatch sends events to the first route they match.
+	ModeFirstMatch Mode = iota
+	//ModeAllMatch sends events to every route they match.
+	ModeAllMatch
+)
+
+/*
+Route sends events matching a predicate to a sink.
+
+Events match if Fn returns a non-nil event, which is the event
+that is drained, or if the value at Field equals Value.
+Strings are compared without quotes, other json values by
+their json encoding, e.g. "200" or "true".
+*/
+type Route struct {
+	Name  string               //identifies the route in logs
+	Sink  types.Sink           //where matching events are drained
+	Fn    filter.EventFilterFn //predicate, overrides Field
+	Field string               //json path of field to match, as parsed by json.ParsePath
+	Value string               //value of Field to match
+}
+
+//Config is the input arguments to NewSink.
+type Config struct {
+	Routes  []Route    //evaluated in order
+	Mode    Mode       //defaults to ModeFirstMatch
+	Default types.Sink //receives events matching no routes, which are dropped when nil
+}
+
+//Sink implements the Sink interface, draining events to the sinks of their routes.
+//Safe to drain concurrently if the sinks of its routes are.
+type Sink struct {
+	routes  []route
+	mode    Mode
+	def     types.Sink
+	parsers fastjson.ParserPool
+}
+
+//route is a Route with a parsed field
+type route struct {
+	Route
+	path pkgjson.Path
+}
+
+//match is an event routed to the route at index route
+type match struct {
+	route int
+	event types.Event
+}
+
+//batch is a sub-batch of events for a sink, with their original indexes
+type batch struct {
+	name    string
+	sink    types.Sink
+	events  []types.Event
+	indexes []int
+}
+
+//implements interfaces
+var _ types.Sink = &Sink{}
+
+//NewSink creates a Sink from a Config, failing if routes have no sink or predicate.
+func NewSink(cfg Config) (*Sink, error) {
+	if cfg.Mode != ModeFirstMatch && cfg.Mode != ModeAllMatch {
+		return nil, fmt.Errorf("invalid router mode %d", cfg.Mode)
+	}
+
+	routes := make([]route, len(cfg.Routes))
+	for i, r := range cfg.Routes {
+		if r.Sink == nil {
+			return nil, errors.ErrNilSink
+		}
+		routes[i] = route{Route: r}
+		if r.Fn != nil {
+			continue
+		}
+		if r.Field == "" {
+			return nil, fmt.Errorf("route %d (%s) needs Fn or Field", i, r.Name)
+		}
+		path, err := pkgjson.ParsePath(r.Field)
+		if err != nil {
+			return nil, err
+		}
+		routes[i].path = path
+	}
+
+	return &Sink{
+		routes: routes,
+		mode:   cfg.Mode,
+		def:    cfg.Default,
+	}, nil
+}
+
+//Drain routes events and drains each sub-batch to its sink.
+//Errors are returned at the index of the event that failed, and
+//events sent to several sinks fail if any of them fail.
+//Events that fail to be routed aren't sent to any sink.
+func (sink *Sink) Drain(events []types.Event) []error {
+	logger := logging.Logger()
+	parser := sink.parsers.Get()
+	defer sink.parsers.Put(parser)
+
+	batches := make([]batch, len(sink.routes))
+	for i, r := range sink.routes {
+		batches[i] = batch{name: r.Name, sink: r.Sink}
+	}
+	def := batch{name: "default", sink: sink.def}
+	errs := make([]error, len(events))
+
+	matches := []match{}
+	for i := range events {
+		e := &events[i]
+		matches = matches[:0]
+		var v *fastjson.Value
+		var parseErr error
+		for j, r := range sink.routes {
+			var routed *types.Event
+			var err error
+			if r.Fn != nil {
+				routed, err = r.Fn(e)
+			} else {
+				if v == nil && parseErr == nil {
+					v, parseErr = parser.ParseBytes(e.Bytes())
+				}
+				if parseErr != nil {
+					err = parseErr
+				} else if r.matches(v) {
+					routed = e
+				}
+			}
+			if err != nil {
+				errs[i] = err
+				break
+			}
+			if routed == nil {
+				continue
+			}
+			matches = append(matches, match{route: j, event: *routed})
+			if sink.mode == ModeFirstMatch {
+				break
+			}
+		}
+
+		//events are only dispatched once all routes are evaluated
+		if errs[i] != nil {
+			logger.Debug("router.Drain: route failed", zap.Int("i", i), zap.Error(errs[i]))
+		} else if len(matches) > 0 {
+			for _, m := range matches {
+				batches[m.route].events = append(batches[m.route].events, m.event)
+				batches[m.route].indexes = append(batches[m.route].indexes, i)
+			}
+		} else {
+			if def.sink == nil {
+				logger.Debug("router.Drain: no route", zap.ByteString("event", e.Bytes()))
+				continue
+			}
+			def.events = append(def.events, *e)
+			def.indexes = append(def.indexes, i)
+		}
+	}
+
+	for _, b := range append(batches, def) {
+		if len(b.events) == 0 {
+			continue
+		}
+		logger.Debug("router.Drain: draining", zap.String("route", b.name), zap.Int("n", len(b.events)))
+		for k, err := range b.sink.Drain(b.events) {
+			if err != nil && k < len(b.indexes) && errs[b.indexes[k]] == nil {
+				errs[b.indexes[k]] = err
+			}
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+	return nil
+}
+
+//matches true iff the value at the route's field equals Value
+func (r *route) matches(v *fastjson.Value) bool {
+	found, err := r.path.Get(v)
+	if err != nil {
+		return false
+	}
+	if found.Type() == fastjson.TypeString {
+		return string(found.GetStringBytes()) == r.Value
+	}
+	return string(found.MarshalTo(nil)) == r.Value
+}
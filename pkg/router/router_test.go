@@ -0,0 +1,132 @@
+package router_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"fmt"
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/buffer"
+	"github.com/underscorenygren/partaj/pkg/filter"
+	"github.com/underscorenygren/partaj/pkg/router"
+	"github.com/underscorenygren/partaj/pkg/types"
+)
+
+//Example is just used to show the specs in godoc
+func Example() {}
+
+//errSink fails every event it receives
+type errSink struct{}
+
+func (sink errSink) Drain(events []types.Event) []error {
+	errs := make([]error, len(events))
+	for i := range events {
+		errs[i] = fmt.Errorf("failed %d", i)
+	}
+	return errs
+}
+
+var _ = Describe("Router", func() {
+
+	logging.ConfigureDevelopment(GinkgoWriter)
+
+	errorEvent := types.NewEventFromBytes([]byte(`{"level": "error", "audit": true}`))
+	auditEvent := types.NewEventFromBytes([]byte(`{"level": "info", "audit": true}`))
+	infoEvent := types.NewEventFromBytes([]byte(`{"level": "info"}`))
+	events := []types.Event{errorEvent, auditEvent, infoEvent}
+
+	var errors, audit, rest *buffer.Sink
+
+	BeforeEach(func() {
+		errors = buffer.NewSink()
+		audit = buffer.NewSink()
+		rest = buffer.NewSink()
+	})
+
+	routes := func() []router.Route {
+		isAudit, err := filter.NewExprFn(`audit == true`)
+		Expect(err).To(BeNil())
+		return []router.Route{
+			router.Route{Name: "errors", Sink: errors, Field: "level", Value: "error"},
+			router.Route{Name: "audit", Sink: audit, Fn: isAudit},
+		}
+	}
+
+	It("routes events to their first match", func() {
+		sink, err := router.NewSink(router.Config{Routes: routes(), Default: rest})
+		Expect(err).To(BeNil())
+
+		Expect(sink.Drain(events)).To(BeNil())
+		Expect(errors.Events).To(Equal([]types.Event{errorEvent}))
+		Expect(audit.Events).To(Equal([]types.Event{auditEvent}))
+		Expect(rest.Events).To(Equal([]types.Event{infoEvent}))
+	})
+
+	It("routes events to all matches", func() {
+		sink, err := router.NewSink(router.Config{Routes: routes(), Mode: router.ModeAllMatch})
+		Expect(err).To(BeNil())
+
+		Expect(sink.Drain(events)).To(BeNil())
+		Expect(errors.Events).To(Equal([]types.Event{errorEvent}))
+		Expect(audit.Events).To(Equal([]types.Event{errorEvent, auditEvent}))
+	})
+
+	It("routes events that fail a later route nowhere", func() {
+		failErrors := func(e *types.Event) (*types.Event, error) {
+			if e.String() == errorEvent.String() {
+				return nil, fmt.Errorf("can't route errors")
+			}
+			return e, nil
+		}
+		sink, err := router.NewSink(router.Config{
+			Routes: []router.Route{
+				router.Route{Name: "errors", Sink: errors, Field: "level", Value: "error"},
+				router.Route{Name: "all", Sink: audit, Fn: failErrors},
+			},
+			Mode:    router.ModeAllMatch,
+			Default: rest,
+		})
+		Expect(err).To(BeNil())
+
+		errs := sink.Drain(events)
+		Expect(errs).To(HaveLen(3))
+		Expect(errs[0]).NotTo(BeNil())
+		Expect(errs[1:]).To(Equal([]error{nil, nil}))
+		Expect(errors.Events).To(BeEmpty())
+		Expect(audit.Events).To(Equal([]types.Event{auditEvent, infoEvent}))
+		Expect(rest.Events).To(BeEmpty())
+	})
+
+	It("matches non-string fields by their json", func() {
+		sink, err := router.NewSink(router.Config{
+			Routes: []router.Route{router.Route{Sink: audit, Field: "audit", Value: "true"}},
+		})
+		Expect(err).To(BeNil())
+
+		Expect(sink.Drain(events)).To(BeNil())
+		Expect(audit.Events).To(Equal([]types.Event{errorEvent, auditEvent}))
+	})
+
+	It("returns errors at their original index", func() {
+		sink, err := router.NewSink(router.Config{
+			Routes:  []router.Route{router.Route{Sink: errSink{}, Field: "audit", Value: "true"}},
+			Default: rest,
+		})
+		Expect(err).To(BeNil())
+
+		errs := sink.Drain([]types.Event{infoEvent, auditEvent, types.NewEventFromBytes([]byte("not json"))})
+		Expect(errs).To(HaveLen(3))
+		Expect(errs[0]).To(BeNil())
+		Expect(errs[1]).NotTo(BeNil())
+		Expect(errs[2]).NotTo(BeNil())
+		Expect(rest.Events).To(Equal([]types.Event{infoEvent}))
+	})
+
+	It("fails on invalid routes", func() {
+		_, err := router.NewSink(router.Config{Routes: []router.Route{router.Route{Field: "level"}}})
+		Expect(err).NotTo(BeNil())
+
+		_, err = router.NewSink(router.Config{Routes: []router.Route{router.Route{Sink: rest}}})
+		Expect(err).NotTo(BeNil())
+	})
+})
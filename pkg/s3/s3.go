@@ -0,0 +1,604 @@
+/*
+Package s3 provides a sink that writes events to AWS S3 as
+newline delimited objects, partitioned by key templates,
+and a source that reads them back.
+*/
+package s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/klauspost/compress/zstd"
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/awsconfig"
+	pkgjson "github.com/underscorenygren/partaj/pkg/json"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"github.com/valyala/fastjson"
+	"go.uber.org/zap"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+const (
+	//LocalEndpoint is the address of the s3 service when using localstack for testing.
+	LocalEndpoint = "http://localhost:4572"
+	//DefaultKeyTemplate partitions objects by date and hour of event time.
+	DefaultKeyTemplate = `dt={{.Time.Format "2006-01-02"}}/hour={{.Time.Format "15"}}/`
+	//DefaultMaxObjectBytes is the uncompressed size at which objects are uploaded.
+	DefaultMaxObjectBytes = 64 * 1024 * 1024
+	//DefaultFlushInterval is the max age of an object before it's uploaded.
+	DefaultFlushInterval = 5 * time.Minute
+	//DefaultMaxRetries is how many times objects that failed to upload are retried.
+	DefaultMaxRetries = 3
+	//DefaultMaxFailedObjects is how many objects that failed to upload are kept for retry.
+	DefaultMaxFailedObjects = 16
+)
+
+//Compression is the compression format of objects.
+type Compression int
+
+const (
+	//CompressionNone writes uncompressed objects.
+	CompressionNone Compression = iota
+	//CompressionGzip writes gzip compressed objects, with a .gz extension.
+	CompressionGzip
+	//CompressionZstd writes zstd compressed objects, with a .zst extension.
+	CompressionZstd
+)
+
+//KeyFn is the function signature for choosing the partition of an event.
+//Returns the key prefix of the object the event is written to.
+type KeyFn func(e *types.Event, t time.Time) (string, error)
+
+//TimestampFn is the function signature for reading the time of an event.
+type TimestampFn func(*types.Event) (time.Time, error)
+
+/*
+KeyData is the data key templates are executed with.
+
+	dt={{.Time.Format "2006-01-02"}}/type={{.Field "type"}}/
+*/
+type KeyData struct {
+	Time  time.Time //time of the event
+	event *types.Event
+	value *fastjson.Value
+}
+
+//Config is the input arguments to NewSink.
+type Config struct {
+	Bucket           string             //name of the bucket to write to
+	Prefix           string             //prepended to all keys
+	KeyTemplate      string             //text/template for partitions, executed with KeyData. Defaults to DefaultKeyTemplate
+	KeyFn            KeyFn              //chooses partitions, overrides KeyTemplate
+	TimestampFn      TimestampFn        //time of events, defaults to the time they are drained
+	Compression      Compression        //compression of objects, defaults to CompressionNone
+	MaxObjectBytes   int                //uncompressed size at which objects are uploaded, defaults to DefaultMaxObjectBytes
+	FlushInterval    time.Duration      //max age of objects before upload, defaults to DefaultFlushInterval
+	PartSize         int64              //multipart upload part size, defaults to s3manager.DefaultUploadPartSize
+	MaxRetries       int                //retries of objects that failed to upload, defaults to DefaultMaxRetries
+	MaxFailedObjects int                //objects kept for retry, the oldest is dropped when full. Defaults to DefaultMaxFailedObjects
+	Local            bool               //when set to true, will configure client to make requests to the local endpoint.
+	AWS              *awsconfig.Options //aws session options, e.g. region, credentials and retries. Defaults to the environment
+}
+
+/*
+Sink implements the Sink interface, by buffering events into one
+object per partition, and uploading them when they reach MaxObjectBytes
+or become older than FlushInterval. Large objects are uploaded with
+multipart uploads.
+
+Drain fails events that can't be partitioned, and the events of the
+drained batch in objects that fail to upload. Objects that fail to upload
+are still retried on later flushes, so those events may be written twice
+if drained again. Objects are retried up to MaxRetries times, and at most
+MaxFailedObjects are kept. Objects that are given up on are logged with
+the number of events lost, and upload errors are returned by Flush and Close.
+Call Close to upload all buffered objects.
+
+Uploads don't block draining of other partitions, or concurrent flushes.
+*/
+type Sink struct {
+	Bucket   string
+	cfg      Config
+	s3       *s3.S3
+	uploader *s3manager.Uploader
+	objects  map[string]*object //objects being written, by partition
+	failed   []*object          //objects that failed to upload
+	id       string             //unique to sink, to avoid key collisions
+	seq      int64              //atomic
+	mu       sync.Mutex         //guards objects and failed
+	done     chan struct{}
+}
+
+//object is a buffered object for one partition
+type object struct {
+	partition string
+	buf       bytes.Buffer
+	w         io.WriteCloser
+	size      int
+	events    int //number of events written
+	created   time.Time
+	attempts  int //failed uploads
+}
+
+//implements interfaces
+var _ types.Sink = &Sink{}
+
+//NewClient makes an s3 client with aws sdk, using default options
+func NewClient(local bool) *s3.S3 {
+	//default options never fail
+	client, _ := NewClientWithOptions(nil, local)
+	return client
+}
+
+//NewClientWithOptions makes an s3 client with aws sdk, configured by opts
+func NewClientWithOptions(opts *awsconfig.Options, local bool) (*s3.S3, error) {
+	endpoint := ""
+	if local {
+		endpoint = LocalEndpoint
+	}
+	sess, err := opts.NewSession(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if local || (opts != nil && opts.Endpoint != "") {
+		sess = sess.Copy(aws.NewConfig().WithS3ForcePathStyle(true))
+	}
+
+	return s3.New(sess), nil
+}
+
+//NewSink creates a new s3 sink
+func NewSink(cfg Config) (*Sink, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("No bucket provided")
+	}
+
+	if cfg.KeyFn == nil {
+		tmpl := cfg.KeyTemplate
+		if tmpl == "" {
+			tmpl = DefaultKeyTemplate
+		}
+		keyFn, err := NewKeyFn(tmpl)
+		if err != nil {
+			return nil, err
+		}
+		cfg.KeyFn = keyFn
+	}
+
+	if cfg.MaxObjectBytes <= 0 {
+		cfg.MaxObjectBytes = DefaultMaxObjectBytes
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+	if cfg.PartSize <= 0 {
+		cfg.PartSize = s3manager.DefaultUploadPartSize
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
+	if cfg.MaxFailedObjects <= 0 {
+		cfg.MaxFailedObjects = DefaultMaxFailedObjects
+	}
+	if cfg.PartSize < s3manager.MinUploadPartSize {
+		return nil, fmt.Errorf("part size must be at least %d", s3manager.MinUploadPartSize)
+	}
+	if _, err := cfg.Compression.newWriter(&bytes.Buffer{}); err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	client, err := NewClientWithOptions(cfg.AWS, cfg.Local)
+	if err != nil {
+		return nil, err
+	}
+	sink := &Sink{
+		Bucket: cfg.Bucket,
+		cfg:    cfg,
+		s3:     client,
+		uploader: s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+			u.PartSize = cfg.PartSize
+		}),
+		objects: map[string]*object{},
+		failed:  []*object{},
+		id:      hex.EncodeToString(id),
+		done:    make(chan struct{}),
+	}
+
+	go sink.flushPeriodically()
+
+	return sink, nil
+}
+
+//NewKeyFn creates a KeyFn from a text/template, executed with KeyData.
+func NewKeyFn(text string) (KeyFn, error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(e *types.Event, t time.Time) (string, error) {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, &KeyData{Time: t, event: e}); err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}, nil
+}
+
+/*
+Field returns the value at the json path of a json event, for use
+in key templates. Strings are returned as is, other values as json.
+Slashes are replaced with underscores, so values can't create partitions.
+*/
+func (data *KeyData) Field(path string) (string, error) {
+	p, err := pkgjson.ParsePath(path)
+	if err != nil {
+		return "", err
+	}
+	if data.value == nil {
+		v, err := fastjson.ParseBytes(data.event.Bytes())
+		if err != nil {
+			return "", err
+		}
+		data.value = v
+	}
+
+	v, err := p.Get(data.value)
+	if err != nil {
+		return "", fmt.Errorf("no value at %s", path)
+	}
+
+	str := ""
+	if v.Type() == fastjson.TypeString {
+		str = string(v.GetStringBytes())
+	} else {
+		str = string(v.MarshalTo(nil))
+	}
+	return strings.Replace(str, "/", "_", -1), nil
+}
+
+/*
+JSONTimestamp creates a TimestampFn that reads the time of json events
+from the value at the json path. Strings are parsed with layout, which
+defaults to time.RFC3339Nano, and numbers are read as unix milliseconds.
+Times are in UTC, so partitions don't depend on the zone of events.
+Paths that fail to parse fail all events.
+*/
+func JSONTimestamp(path string, layout string) TimestampFn {
+	if layout == "" {
+		layout = time.RFC3339Nano
+	}
+	p, pathErr := pkgjson.ParsePath(path)
+
+	return func(e *types.Event) (time.Time, error) {
+		if pathErr != nil {
+			return time.Time{}, pathErr
+		}
+		v, err := fastjson.ParseBytes(e.Bytes())
+		if err != nil {
+			return time.Time{}, err
+		}
+		if v, err = p.Get(v); err != nil {
+			return time.Time{}, fmt.Errorf("no timestamp at %s", path)
+		}
+		if v.Type() == fastjson.TypeNumber {
+			ms, err := v.Int64()
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+		}
+		b, err := v.StringBytes()
+		if err != nil {
+			return time.Time{}, err
+		}
+		t, err := time.Parse(layout, string(b))
+		if err != nil {
+			return time.Time{}, err
+		}
+		return t.UTC(), nil
+	}
+}
+
+//Extension returns the file extension of the compression format.
+func (c Compression) Extension() string {
+	switch c {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+//newWriter wraps w in a compressing writer
+func (c Compression) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case CompressionNone:
+		return nopCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression %d", c)
+}
+
+//nopCloser is a WriteCloser that does nothing on close
+type nopCloser struct {
+	io.Writer
+}
+
+//Close does nothing
+func (nopCloser) Close() error {
+	return nil
+}
+
+//Drain writes events to the object of their partition, uploading objects that are full or old.
+func (sink *Sink) Drain(events []types.Event) []error {
+	logger := logging.Logger()
+	errs := make([]error, len(events))
+	failed := false
+	uploads := []*object{}
+	indexes := map[*object][]int{} //of events in objects, to fail them if uploads fail
+
+	sink.mu.Lock()
+	now := time.Now().UTC()
+	for i := range events {
+		e := &events[i]
+		ts := now
+		if sink.cfg.TimestampFn != nil {
+			var err error
+			if ts, err = sink.cfg.TimestampFn(e); err != nil {
+				logger.Debug("s3.Drain: timestamp error", zap.Int("index", i), zap.Error(err))
+				errs[i] = err
+				failed = true
+				continue
+			}
+		}
+
+		partition, err := sink.cfg.KeyFn(e, ts)
+		if err != nil {
+			logger.Debug("s3.Drain: key error", zap.Int("index", i), zap.Error(err))
+			errs[i] = err
+			failed = true
+			continue
+		}
+
+		obj, ok := sink.objects[partition]
+		if !ok {
+			if obj, err = sink.newObject(partition); err != nil {
+				errs[i] = err
+				failed = true
+				continue
+			}
+			sink.objects[partition] = obj
+		}
+
+		if err = obj.write(e.Bytes()); err != nil {
+			errs[i] = err
+			failed = true
+			continue
+		}
+		indexes[obj] = append(indexes[obj], i)
+
+		if obj.size >= sink.cfg.MaxObjectBytes {
+			delete(sink.objects, partition)
+			uploads = append(uploads, obj)
+		}
+	}
+	uploads = append(uploads, sink.takeAged()...)
+	sink.mu.Unlock()
+
+	for _, obj := range uploads {
+		if err := sink.upload(obj); err != nil {
+			for _, i := range indexes[obj] {
+				errs[i] = err
+				failed = true
+			}
+		}
+	}
+
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+//Flush uploads all buffered objects and retries failed ones, returns the last upload error if any failed.
+func (sink *Sink) Flush() error {
+	sink.mu.Lock()
+	uploads := []*object{}
+	for partition, obj := range sink.objects {
+		delete(sink.objects, partition)
+		uploads = append(uploads, obj)
+	}
+	sink.mu.Unlock()
+
+	var err error
+	for _, obj := range uploads {
+		if uploadErr := sink.upload(obj); uploadErr != nil {
+			err = uploadErr
+		}
+	}
+	if retryErr := sink.retryFailed(); retryErr != nil {
+		err = retryErr
+	}
+	return err
+}
+
+//Close stops periodic flushing and uploads all buffered objects.
+func (sink *Sink) Close() error {
+	select {
+	case <-sink.done:
+	default:
+		close(sink.done)
+	}
+	return sink.Flush()
+}
+
+//Client returns underlying s3 client
+func (sink *Sink) Client() *s3.S3 {
+	return sink.s3
+}
+
+//flushPeriodically uploads aged objects and retries failed ones until sink is closed
+func (sink *Sink) flushPeriodically() {
+	ticker := time.NewTicker(sink.cfg.FlushInterval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sink.done:
+			return
+		case <-ticker.C:
+			sink.mu.Lock()
+			aged := sink.takeAged()
+			sink.mu.Unlock()
+			for _, obj := range aged {
+				sink.upload(obj)
+			}
+			sink.retryFailed()
+		}
+	}
+}
+
+//takeAged removes objects older than flush interval, for upload. Must hold lock
+func (sink *Sink) takeAged() []*object {
+	aged := []*object{}
+	for partition, obj := range sink.objects {
+		if time.Since(obj.created) >= sink.cfg.FlushInterval {
+			delete(sink.objects, partition)
+			aged = append(aged, obj)
+		}
+	}
+	return aged
+}
+
+//retryFailed retries uploads of failed objects, returns the last upload error if any failed
+func (sink *Sink) retryFailed() error {
+	sink.mu.Lock()
+	failed := sink.failed
+	sink.failed = []*object{}
+	sink.mu.Unlock()
+
+	var err error
+	for _, obj := range failed {
+		if uploadErr := sink.put(obj); uploadErr != nil {
+			err = uploadErr
+			sink.keepFailed(obj, uploadErr)
+		}
+	}
+	return err
+}
+
+//keepFailed keeps an object that failed to upload for retry,
+//dropping it if out of retries, or the oldest failed object if full
+func (sink *Sink) keepFailed(obj *object, err error) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	obj.attempts++
+	if obj.attempts > sink.cfg.MaxRetries {
+		obj.drop("s3 object dropped after retries", err)
+		return
+	}
+	if len(sink.failed) >= sink.cfg.MaxFailedObjects {
+		sink.failed[0].drop("s3 object dropped, too many failed objects", err)
+		sink.failed = sink.failed[1:]
+	}
+	sink.failed = append(sink.failed, obj)
+}
+
+//newObject creates a new object for partition
+func (sink *Sink) newObject(partition string) (*object, error) {
+	obj := &object{
+		partition: partition,
+		created:   time.Now(),
+	}
+	w, err := sink.cfg.Compression.newWriter(&obj.buf)
+	if err != nil {
+		return nil, err
+	}
+	obj.w = w
+	return obj, nil
+}
+
+//write writes one event line to object
+func (obj *object) write(b []byte) error {
+	if _, err := obj.w.Write(b); err != nil {
+		return err
+	}
+	if _, err := obj.w.Write([]byte("\n")); err != nil {
+		return err
+	}
+	obj.size += len(b) + 1
+	obj.events++
+	return nil
+}
+
+//drop logs that the events of an object are lost
+func (obj *object) drop(msg string, err error) {
+	logging.Logger().Error(msg,
+		zap.String("partition", obj.partition),
+		zap.Int("events", obj.events),
+		zap.Error(err))
+}
+
+//upload finishes object and uploads it, keeping it for retry if the upload fails
+func (sink *Sink) upload(obj *object) error {
+	if err := obj.w.Close(); err != nil {
+		obj.drop("s3 object compression failed", err)
+		return err
+	}
+	err := sink.put(obj)
+	if err != nil {
+		sink.keepFailed(obj, err)
+	}
+	return err
+}
+
+//put uploads a finished object
+func (sink *Sink) put(obj *object) error {
+	logger := logging.Logger()
+	key := fmt.Sprintf("%s%s%s-%s-%s.ndjson%s",
+		sink.cfg.Prefix,
+		obj.partition,
+		strconv.FormatInt(obj.created.UnixNano(), 10),
+		sink.id,
+		strconv.FormatInt(atomic.AddInt64(&sink.seq, 1), 10),
+		sink.cfg.Compression.Extension())
+
+	logger.Debug("s3.upload: uploading",
+		zap.String("bucket", sink.Bucket),
+		zap.String("key", key),
+		zap.Int("size", obj.buf.Len()))
+
+	_, err := sink.uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(sink.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(obj.buf.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	if err != nil {
+		logger.Error("s3 upload failed", zap.String("key", key), zap.Error(err))
+	}
+	return err
+}
@@ -0,0 +1,341 @@
+package s3_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"compress/gzip"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/underscorenygren/partaj/internal"
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/awsconfig"
+	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/underscorenygren/partaj/pkg/s3"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+//examples on how to use s3
+func Example() {}
+
+func localStackRunning() bool {
+	_, err := http.Get(s3.LocalEndpoint)
+	return err == nil
+}
+
+var _ = Describe("S3 keys", func() {
+
+	ts := time.Date(2026, 10, 17, 13, 5, 0, 0, time.UTC)
+
+	It("partitions by event time by default", func() {
+		keyFn, err := s3.NewKeyFn(s3.DefaultKeyTemplate)
+		Expect(err).To(BeNil())
+		e := types.NewEventFromBytes([]byte("one"))
+		Expect(keyFn(&e, ts)).To(Equal("dt=2026-10-17/hour=13/"))
+	})
+
+	It("partitions by json fields", func() {
+		keyFn, err := s3.NewKeyFn(`type={{.Field "meta.type"}}/n={{.Field "n"}}/`)
+		Expect(err).To(BeNil())
+		e := types.NewEventFromBytes([]byte(`{"meta":{"type":"a/b"},"n":3}`))
+		Expect(keyFn(&e, ts)).To(Equal("type=a_b/n=3/"))
+	})
+
+	It("partitions by json paths with escaped keys", func() {
+		keyFn, err := s3.NewKeyFn(`app={{.Field "labels[\"k8s.io/app\"]"}}/`)
+		Expect(err).To(BeNil())
+		e := types.NewEventFromBytes([]byte(`{"labels":{"k8s.io/app":"web"}}`))
+		Expect(keyFn(&e, ts)).To(Equal("app=web/"))
+	})
+
+	It("fails on missing fields", func() {
+		keyFn, err := s3.NewKeyFn(`{{.Field "missing"}}/`)
+		Expect(err).To(BeNil())
+		e := types.NewEventFromBytes([]byte(`{}`))
+		_, err = keyFn(&e, ts)
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("fails on bad templates", func() {
+		_, err := s3.NewKeyFn(`{{.Nope`)
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("reads timestamps from json", func() {
+		fn := s3.JSONTimestamp("ts", "")
+		e := types.NewEventFromBytes([]byte(`{"ts":"2026-10-17T13:05:00Z"}`))
+		Expect(fn(&e)).To(Equal(ts))
+
+		e = types.NewEventFromBytes([]byte(`{"ts":"2026-10-17T15:05:00+02:00"}`))
+		Expect(fn(&e)).To(Equal(ts))
+
+		e = types.NewEventFromBytes([]byte(`{"ts":1792242300000}`))
+		Expect(fn(&e)).To(Equal(ts))
+
+		e = types.NewEventFromBytes([]byte(`{}`))
+		_, err := fn(&e)
+		Expect(err).NotTo(BeNil())
+	})
+})
+
+var _ = Describe("S3 Sink failures", func() {
+
+	logging.ConfigureDevelopment(GinkgoWriter)
+
+	It("fails events of objects that fail to upload", func() {
+		uploads := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			uploads++
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer server.Close()
+
+		sink, err := s3.NewSink(s3.Config{
+			Bucket:         "test-bucket",
+			MaxObjectBytes: 8,
+			MaxRetries:     1,
+			AWS: &awsconfig.Options{
+				Endpoint:    server.URL,
+				Region:      "us-east-1",
+				Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+				MaxRetries:  aws.Int(0),
+			},
+		})
+		Expect(err).To(BeNil())
+
+		errs := sink.Drain(internal.StringsToEvents([]string{"one", "two", "three"}))
+		Expect(errs).To(HaveLen(3))
+		Expect(errs[0]).NotTo(BeNil())
+		Expect(errs[1]).NotTo(BeNil())
+		Expect(errs[2]).To(BeNil())
+		Expect(uploads).To(Equal(1))
+
+		//the full object is retried once, and the remaining one uploaded and retried
+		Expect(sink.Close()).NotTo(BeNil())
+		Expect(uploads).To(Equal(4))
+		Expect(sink.Flush()).To(BeNil())
+		Expect(uploads).To(Equal(4))
+	})
+})
+
+var _ = Describe("S3 Sink", func() {
+
+	logger := logging.ConfigureDevelopment(GinkgoWriter)
+	bucket := "test-bucket"
+	var sink *s3.Sink
+
+	listKeys := func() []string {
+		output, err := sink.Client().ListObjectsV2(&awss3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+		})
+		Expect(err).To(BeNil())
+		keys := []string{}
+		for _, obj := range output.Contents {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+		return keys
+	}
+
+	getObject := func(key string) []byte {
+		output, err := sink.Client().GetObject(&awss3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		Expect(err).To(BeNil())
+		defer output.Body.Close()
+		b, err := ioutil.ReadAll(output.Body)
+		Expect(err).To(BeNil())
+		return b
+	}
+
+	newSink := func(cfg s3.Config) *s3.Sink {
+		cfg.Bucket = bucket
+		cfg.Local = true
+		s, err := s3.NewSink(cfg)
+		Expect(err).To(BeNil())
+		return s
+	}
+
+	BeforeEach(func() {
+		if !localStackRunning() {
+			logger.Debug("localstack not running")
+			Skip("localstack isn't running")
+		} else {
+			sink = newSink(s3.Config{})
+			_, err := sink.Client().CreateBucket(&awss3.CreateBucketInput{
+				Bucket: aws.String(bucket),
+			})
+			Expect(err).To(BeNil())
+		}
+	})
+
+	AfterEach(func() {
+		if localStackRunning() {
+			cli := sink.Client()
+			for _, key := range listKeys() {
+				cli.DeleteObject(&awss3.DeleteObjectInput{
+					Bucket: aws.String(bucket),
+					Key:    aws.String(key),
+				})
+			}
+			cli.DeleteBucket(&awss3.DeleteBucketInput{
+				Bucket: aws.String(bucket),
+			})
+		}
+	})
+
+	It("writes partitioned objects on close", func() {
+		sink = newSink(s3.Config{
+			Prefix:      "events/",
+			KeyTemplate: `type={{.Field "type"}}/`,
+		})
+		events := internal.StringsToEvents([]string{`{"type":"a"}`, `{"type":"b"}`, `{"type":"a","n":1}`})
+		Expect(sink.Drain(events)).To(BeNil())
+		Expect(listKeys()).To(BeEmpty())
+		Expect(sink.Close()).To(BeNil())
+
+		keys := listKeys()
+		Expect(keys).To(HaveLen(2))
+		for _, key := range keys {
+			Expect(strings.HasSuffix(key, ".ndjson")).To(BeTrue())
+			if strings.HasPrefix(key, "events/type=a/") {
+				Expect(string(getObject(key))).To(Equal("{\"type\":\"a\"}\n{\"type\":\"a\",\"n\":1}\n"))
+			} else {
+				Expect(key).To(HavePrefix("events/type=b/"))
+				Expect(string(getObject(key))).To(Equal("{\"type\":\"b\"}\n"))
+			}
+		}
+	})
+
+	It("uploads objects when full", func() {
+		sink = newSink(s3.Config{
+			MaxObjectBytes: 8,
+			Compression:    s3.CompressionGzip,
+		})
+		Expect(sink.Drain(internal.StringsToEvents([]string{"one", "two", "three"}))).To(BeNil())
+
+		keys := listKeys()
+		Expect(keys).To(HaveLen(1))
+		Expect(keys[0]).To(HaveSuffix(".ndjson.gz"))
+
+		r, err := gzip.NewReader(bytes.NewReader(getObject(keys[0])))
+		Expect(err).To(BeNil())
+		b, err := ioutil.ReadAll(r)
+		Expect(err).To(BeNil())
+		Expect(string(b)).To(Equal("one\ntwo\n"))
+
+		Expect(sink.Close()).To(BeNil())
+		Expect(listKeys()).To(HaveLen(2))
+	})
+
+	It("fails events that can't be partitioned", func() {
+		sink = newSink(s3.Config{
+			KeyTemplate: `{{.Field "type"}}/`,
+		})
+		errs := sink.Drain(internal.StringsToEvents([]string{`{"type":"a"}`, `not json`}))
+		Expect(errs).To(HaveLen(2))
+		Expect(errs[0]).To(BeNil())
+		Expect(errs[1]).NotTo(BeNil())
+		Expect(sink.Close()).To(BeNil())
+		Expect(listKeys()).To(HaveLen(1))
+	})
+
+	drawAll := func(source *s3.Source) []string {
+		read := []string{}
+		for {
+			e, err := source.DrawOne()
+			if err == errors.ErrS3End {
+				return read
+			}
+			Expect(err).To(BeNil())
+			read = append(read, e.String())
+		}
+	}
+
+	It("reads back compressed objects in key order", func() {
+		for _, c := range []s3.Compression{s3.CompressionNone, s3.CompressionGzip, s3.CompressionZstd} {
+			sink = newSink(s3.Config{
+				KeyTemplate: `{{.Field "n"}}/`,
+				Compression: c,
+			})
+			Expect(sink.Drain(internal.StringsToEvents([]string{`{"n":2}`, `{"n":1}`, `{"n":1,"x":true}`}))).To(BeNil())
+			Expect(sink.Close()).To(BeNil())
+
+			source, err := s3.NewSource(s3.SourceConfig{
+				Bucket: bucket,
+				Local:  true,
+			})
+			Expect(err).To(BeNil())
+			Expect(drawAll(source)).To(Equal([]string{`{"n":1}`, `{"n":1,"x":true}`, `{"n":2}`}))
+			Expect(source.LastCompleted()).To(HavePrefix("2/"))
+			Expect(source.Close()).To(BeNil())
+
+			for _, key := range listKeys() {
+				sink.Client().DeleteObject(&awss3.DeleteObjectInput{
+					Bucket: aws.String(bucket),
+					Key:    aws.String(key),
+				})
+			}
+		}
+	})
+
+	It("reads within key bounds and resumes after last completed", func() {
+		sink = newSink(s3.Config{
+			KeyTemplate: `{{.Field "n"}}/`,
+		})
+		Expect(sink.Drain(internal.StringsToEvents([]string{`{"n":1}`, `{"n":2}`, `{"n":3}`}))).To(BeNil())
+		Expect(sink.Close()).To(BeNil())
+
+		source, err := s3.NewSource(s3.SourceConfig{
+			Bucket:  bucket,
+			EndKey:  "3/",
+			MaxKeys: aws.Int64(1),
+			Local:   true,
+		})
+		Expect(err).To(BeNil())
+		e, err := source.DrawOne()
+		Expect(err).To(BeNil())
+		Expect(e.String()).To(Equal(`{"n":1}`))
+		Expect(source.Close()).To(BeNil())
+
+		//first object is only completed once the next is drawn
+		Expect(source.LastCompleted()).To(Equal(""))
+
+		source, err = s3.NewSource(s3.SourceConfig{
+			Bucket:     bucket,
+			StartAfter: listKeys()[0],
+			Local:      true,
+		})
+		Expect(err).To(BeNil())
+		Expect(drawAll(source)).To(Equal([]string{`{"n":2}`, `{"n":3}`}))
+	})
+})
+
+var _ = Describe("S3 Source", func() {
+
+	It("validates bounds", func() {
+		_, err := s3.NewSource(s3.SourceConfig{})
+		Expect(err).NotTo(BeNil())
+
+		_, err = s3.NewSource(s3.SourceConfig{
+			Bucket:     "bucket",
+			StartAfter: "b",
+			EndKey:     "a",
+		})
+		Expect(err).NotTo(BeNil())
+
+		_, err = s3.NewSource(s3.SourceConfig{
+			Bucket:    "bucket",
+			StartTime: time.Now(),
+			EndTime:   time.Now().Add(-time.Hour),
+		})
+		Expect(err).NotTo(BeNil())
+	})
+})
@@ -0,0 +1,267 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/klauspost/compress/zstd"
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/awsconfig"
+	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/underscorenygren/partaj/pkg/stream"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+//SourceConfig is the input arguments to NewSource.
+type SourceConfig struct {
+	Bucket           string               //name of the bucket to read from
+	Prefix           string               //only read objects with keys starting with prefix
+	StartAfter       string               //only read objects with keys after this, e.g. LastCompleted() of an earlier source
+	EndKey           string               //only read objects with keys before this
+	StartTime        time.Time            //only read objects last modified at or after this
+	EndTime          time.Time            //only read objects last modified before this
+	MaxKeys          *int64               //max objects per list call
+	ConfigureScanner func(*bufio.Scanner) //configures framing of each object, e.g. buffer size or split function
+	Local            bool                 //when set to true, will configure client to make requests to the local endpoint.
+	AWS              *awsconfig.Options   //aws session options, e.g. region, credentials and retries. Defaults to the environment
+}
+
+/*
+Source implements the Source interface, by reading objects under a prefix
+in key order, one event per line.
+
+Gzip and zstd compressed objects are detected and decompressed.
+Objects are framed by a stream.Source, so they are split the same way
+as any other stream.
+
+Returns ErrS3End when all objects are read.
+*/
+type Source struct {
+	cfg               SourceConfig
+	s3                *s3.S3
+	keys              []*s3.Object //listed objects not yet read
+	continuationToken *string
+	listed            bool //true when all objects are listed
+	key               string
+	body              io.ReadCloser
+	decompressed      io.ReadCloser
+	stream            *stream.Source
+	lastCompleted     string
+}
+
+//implements interfaces
+var _ types.Source = &Source{}
+
+//NewSource creates a new s3 source
+func NewSource(cfg SourceConfig) (*Source, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("No bucket provided")
+	}
+	if cfg.EndKey != "" && cfg.EndKey <= cfg.StartAfter {
+		return nil, fmt.Errorf("end key must be after start key")
+	}
+	if !cfg.EndTime.IsZero() && !cfg.EndTime.After(cfg.StartTime) {
+		return nil, fmt.Errorf("end time must be after start time")
+	}
+
+	client, err := NewClientWithOptions(cfg.AWS, cfg.Local)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Source{
+		cfg:           cfg,
+		s3:            client,
+		lastCompleted: cfg.StartAfter,
+	}, nil
+}
+
+//Client returns underlying s3 client
+func (source *Source) Client() *s3.S3 {
+	return source.s3
+}
+
+/*
+LastCompleted returns the key of the last object that was read to the end.
+Use it as StartAfter to resume reading from the next object.
+*/
+func (source *Source) LastCompleted() string {
+	return source.lastCompleted
+}
+
+//DrawOne reads one event, opening the next object when the current one is read.
+func (source *Source) DrawOne() (*types.Event, error) {
+	for {
+		if source.stream != nil {
+			e, err := source.stream.DrawOne()
+			if err == nil {
+				//scanner reuses its buffer
+				evt := types.NewEventFromBytes(append([]byte(nil), e.Bytes()...))
+				return &evt, nil
+			}
+			if err != errors.ErrStreamEnd {
+				return nil, err
+			}
+			if err = source.closeObject(); err != nil {
+				return nil, err
+			}
+			source.lastCompleted = source.key
+		}
+
+		obj, err := source.nextObject()
+		if err != nil {
+			return nil, err
+		}
+		if err = source.openObject(obj); err != nil {
+			return nil, err
+		}
+	}
+}
+
+//Close closes the object being read
+func (source *Source) Close() error {
+	return source.closeObject()
+}
+
+//nextObject returns the next object within bounds, listing more if needed
+func (source *Source) nextObject() (*s3.Object, error) {
+	for {
+		for len(source.keys) > 0 {
+			obj := source.keys[0]
+			source.keys = source.keys[1:]
+
+			if source.cfg.EndKey != "" && aws.StringValue(obj.Key) >= source.cfg.EndKey {
+				source.keys = nil
+				source.listed = true
+				break
+			}
+			if source.inTimeBounds(aws.TimeValue(obj.LastModified)) {
+				return obj, nil
+			}
+		}
+
+		if source.listed {
+			return nil, errors.ErrS3End
+		}
+		if err := source.list(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+//inTimeBounds true iff t is within configured time bounds
+func (source *Source) inTimeBounds(t time.Time) bool {
+	if !source.cfg.StartTime.IsZero() && t.Before(source.cfg.StartTime) {
+		return false
+	}
+	if !source.cfg.EndTime.IsZero() && !t.Before(source.cfg.EndTime) {
+		return false
+	}
+	return true
+}
+
+//list lists the next page of objects
+func (source *Source) list() error {
+	logger := logging.Logger()
+
+	input := &s3.ListObjectsV2Input{
+		Bucket:            aws.String(source.cfg.Bucket),
+		ContinuationToken: source.continuationToken,
+		MaxKeys:           source.cfg.MaxKeys,
+	}
+	if source.cfg.Prefix != "" {
+		input.Prefix = aws.String(source.cfg.Prefix)
+	}
+	if source.cfg.StartAfter != "" {
+		input.StartAfter = aws.String(source.cfg.StartAfter)
+	}
+
+	output, err := source.s3.ListObjectsV2(input)
+	if err != nil {
+		logger.Debug("s3.Source: list failed", zap.Error(err))
+		return err
+	}
+
+	source.keys = output.Contents
+	source.continuationToken = output.NextContinuationToken
+	source.listed = !aws.BoolValue(output.IsTruncated)
+
+	logger.Debug("s3.Source: listed",
+		zap.Int("n", len(output.Contents)),
+		zap.Bool("listed", source.listed))
+
+	return nil
+}
+
+//openObject starts reading obj
+func (source *Source) openObject(obj *s3.Object) error {
+	key := aws.StringValue(obj.Key)
+	logging.Logger().Debug("s3.Source: opening", zap.String("key", key))
+
+	output, err := source.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(source.cfg.Bucket),
+		Key:    obj.Key,
+	})
+	if err != nil {
+		return err
+	}
+
+	decompressed, err := decompress(output.Body)
+	if err != nil {
+		output.Body.Close()
+		return err
+	}
+
+	source.key = key
+	source.body = output.Body
+	source.decompressed = decompressed
+	source.stream = stream.NewSource(decompressed)
+	if source.cfg.ConfigureScanner != nil {
+		source.cfg.ConfigureScanner(source.stream.Scanner)
+	}
+	return nil
+}
+
+//closeObject closes the object being read, if any
+func (source *Source) closeObject() error {
+	if source.stream == nil {
+		return nil
+	}
+	source.stream = nil
+	err := source.decompressed.Close()
+	if bodyErr := source.body.Close(); err == nil {
+		err = bodyErr
+	}
+	return err
+}
+
+//decompress wraps r in a decompressing reader if it's gzip or zstd compressed
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	//errors surface on first read
+	head, _ := buffered.Peek(len(zstdMagic))
+
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(head, zstdMagic):
+		d, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(buffered), nil
+}
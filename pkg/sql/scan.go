@@ -0,0 +1,148 @@
+package sql
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"github.com/valyala/fastjson"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//ScanConfig input to NewJSONScanFn()
+type ScanConfig struct {
+	Rename     map[string]string //maps column names to keys in the event, unmapped columns keep their name
+	Separator  string            //when set, keys are split on Separator into nested objects, e.g. "." makes "user.id" into {"user":{"id":...}}
+	TimeFormat string            //format of time values, defaults to time.RFC3339Nano
+}
+
+//JSONScanFn implements ScanFn by turning any row into a json object event,
+//keyed by column name.
+var JSONScanFn = NewJSONScanFn(ScanConfig{})
+
+/*
+NewJSONScanFn creates a ScanFn that turns any row into a json object event,
+using rows.ColumnTypes() to determine how values are encoded.
+
+NULLs are written as null, numeric and boolean values as json numbers and booleans,
+time values as strings formatted by TimeFormat, and text as strings.
+Binary columns (BLOB, BYTEA, BINARY) are base64 encoded, and DECIMAL/NUMERIC
+values the driver returns as bytes are written as numbers.
+Rows with NaN or infinite floats fail, since json can't represent them.
+
+Keys are written in column order.
+*/
+func NewJSONScanFn(cfg ScanConfig) ScanFn {
+	if cfg.TimeFormat == "" {
+		cfg.TimeFormat = time.RFC3339Nano
+	}
+
+	return func(rows *sql.Rows) (*types.Event, error) {
+		columnTypes, err := rows.ColumnTypes()
+		if err != nil {
+			return nil, err
+		}
+
+		values := make([]interface{}, len(columnTypes))
+		dest := make([]interface{}, len(columnTypes))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		arena := &fastjson.Arena{}
+		obj := arena.NewObject()
+		for i, columnType := range columnTypes {
+			key := columnType.Name()
+			if renamed, ok := cfg.Rename[key]; ok {
+				key = renamed
+			}
+			v, err := toValue(arena, columnType, values[i], cfg.TimeFormat)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %v", columnType.Name(), err)
+			}
+			if err = set(arena, obj, key, cfg.Separator, v); err != nil {
+				return nil, err
+			}
+		}
+
+		e := types.NewEventFromBytes(obj.MarshalTo(nil))
+		return &e, nil
+	}
+}
+
+//toValue converts a scanned value to a json value
+func toValue(arena *fastjson.Arena, columnType *sql.ColumnType, value interface{}, timeFormat string) (*fastjson.Value, error) {
+	switch v := value.(type) {
+	case nil:
+		return arena.NewNull(), nil
+	case bool:
+		if v {
+			return arena.NewTrue(), nil
+		}
+		return arena.NewFalse(), nil
+	case int64:
+		return arena.NewNumberString(strconv.FormatInt(v, 10)), nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%v isn't a valid json number", v)
+		}
+		return arena.NewNumberFloat64(v), nil
+	case string:
+		return arena.NewString(v), nil
+	case time.Time:
+		return arena.NewString(v.Format(timeFormat)), nil
+	case []byte:
+		dbType := strings.ToUpper(columnType.DatabaseTypeName())
+		switch {
+		case isBinary(dbType):
+			return arena.NewString(base64.StdEncoding.EncodeToString(v)), nil
+		case isNumeric(dbType):
+			return arena.NewNumberString(string(v)), nil
+		default:
+			return arena.NewString(string(v)), nil
+		}
+	default:
+		return arena.NewString(fmt.Sprint(v)), nil
+	}
+}
+
+//isBinary true iff database type holds raw bytes
+func isBinary(dbType string) bool {
+	return strings.Contains(dbType, "BLOB") ||
+		strings.Contains(dbType, "BINARY") ||
+		dbType == "BYTEA"
+}
+
+//isNumeric true iff database type is a number that drivers return as bytes
+func isNumeric(dbType string) bool {
+	return strings.HasPrefix(dbType, "DECIMAL") ||
+		strings.HasPrefix(dbType, "NUMERIC")
+}
+
+//set sets value at key, nesting objects if separator is present in key
+func set(arena *fastjson.Arena, obj *fastjson.Value, key string, separator string, v *fastjson.Value) error {
+	if separator == "" {
+		obj.Set(key, v)
+		return nil
+	}
+
+	parts := strings.Split(key, separator)
+	for _, part := range parts[:len(parts)-1] {
+		child := obj.Get(part)
+		if child == nil {
+			child = arena.NewObject()
+			obj.Set(part, child)
+		} else if child.Type() != fastjson.TypeObject {
+			return fmt.Errorf("key %s conflicts with non-object value at %s", key, part)
+		}
+		obj = child
+	}
+	obj.Set(parts[len(parts)-1], v)
+	return nil
+}
@@ -1,30 +1,125 @@
+/*
+Package sql provides a source that reads events from a sql database,
+and a sink that writes events to a table.
+*/
 package sql
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"github.com/underscorenygren/partaj/internal/logging"
 	"github.com/underscorenygren/partaj/pkg/errors"
 	"github.com/underscorenygren/partaj/pkg/types"
 	"go.uber.org/zap"
+	"strings"
+	"sync"
+	"time"
 )
 
 //ScanFn  method signature that defines how a row is processed
 type ScanFn func(*sql.Rows) (*types.Event, error)
 
+//ColumnFn method signature that maps an event to the column values of one row.
+//Values must be in the same order as SinkConfig.Columns.
+type ColumnFn func(*types.Event) ([]interface{}, error)
+
+//PlaceholderFn method signature that returns the bind parameter for the n:th (1-indexed) value.
+type PlaceholderFn func(n int) string
+
+//ConflictMode defines how Sink handles rows that conflict with existing rows.
+type ConflictMode int
+
+const (
+	//ConflictNone performs plain inserts, conflicting rows fail.
+	ConflictNone ConflictMode = iota
+	//ConflictIgnore skips conflicting rows using ON CONFLICT DO NOTHING.
+	ConflictIgnore
+	//ConflictUpdate upserts conflicting rows using ON CONFLICT DO UPDATE.
+	ConflictUpdate
+)
+
+//DefaultMaxParams is the max number of bind parameters in a single statement.
+//Matches the default limit of sqlite.
+const DefaultMaxParams = 999
+
+//QuestionPlaceholder implements PlaceholderFn with ? parameters, used by sqlite and mysql.
+func QuestionPlaceholder(n int) string {
+	return "?"
+}
+
+//DollarPlaceholder implements PlaceholderFn with $n parameters, used by postgres.
+func DollarPlaceholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
 //SourceConfig input to NewSource()
 type SourceConfig struct {
 	DB     *sql.DB
-	ScanFn ScanFn
+	ScanFn ScanFn //defaults to JSONScanFn
 	Stmt   string
+	Args   []interface{} //bind arguments for Stmt
+
+	//Placeholder is the bind parameter style used for paging arguments, defaults to QuestionPlaceholder.
+	Placeholder PlaceholderFn
+	//Context is the parent context of all queries, defaults to context.Background().
+	Context context.Context
+	//Timeout when > 0 is the max duration of each query, including reading its rows.
+	Timeout time.Duration
+	//PageSize when > 0 reads Stmt in pages of PageSize rows, by appending LIMIT to Stmt.
+	//If WatermarkColumn is set, pages by keyset using the watermark, otherwise appends OFFSET as well.
+	PageSize int
+
+	//PollInterval enables polling mode when > 0. Instead of returning ErrSQLEnd
+	//when rows run out, Stmt is re-run after waiting PollInterval, reading only rows
+	//past the watermark. Requires WatermarkColumn, so rows aren't re-read on every poll.
+	PollInterval time.Duration
+	//WatermarkColumn is the name of a result column that is tracked as a high-water-mark,
+	//such as an auto-increment id or an updated_at timestamp. When set, the
+	//watermark is bound as a query parameter after Args, e.g. "SELECT * FROM t WHERE id > ? ORDER BY id".
+	WatermarkColumn string
+	//Watermark is the initial watermark value, required when WatermarkColumn is set.
+	//Use a value from Source.Watermark() to resume from a checkpoint.
+	Watermark interface{}
 }
 
 //Source implements source interface for sql
 type Source struct {
-	rows *sql.Rows
-	cfg  SourceConfig
+	rows      *sql.Rows
+	cancel    context.CancelFunc //cancels context of current rows
+	cfg       SourceConfig
+	mark      int   //index of watermark column in rows, -1 until found
+	offset    int64 //rows read in previous pages
+	nPage     int   //rows read in current page
+	watermark interface{}
+	mu        sync.Mutex
+	done      chan struct{}
 }
 
+//SinkConfig input to NewSink()
+type SinkConfig struct {
+	DB              *sql.DB
+	Table           string        //table to insert rows into
+	Columns         []string      //columns to insert, in the order returned by ColumnFn
+	ColumnFn        ColumnFn      //maps events to rows
+	Conflict        ConflictMode  //how conflicting rows are handled, defaults to ConflictNone
+	ConflictColumns []string      //conflict target, required for ConflictUpdate
+	UpdateColumns   []string      //columns set on ConflictUpdate, defaults to Columns not in ConflictColumns
+	Placeholder     PlaceholderFn //bind parameter style, defaults to QuestionPlaceholder
+	MaxParams       int           //max bind parameters per insert statement, defaults to DefaultMaxParams
+}
+
+//Sink implements sink interface for sql
+type Sink struct {
+	cfg      SinkConfig
+	batch    int
+	conflict string
+}
+
+//implements interfaces
+var _ types.Sink = &Sink{}
+var _ types.Source = &Source{}
+
 //NewSource craetes a new source that reads events from sql
 func NewSource(conf SourceConfig) (*Source, error) {
 	if conf.DB == nil {
@@ -32,41 +127,425 @@ func NewSource(conf SourceConfig) (*Source, error) {
 	}
 
 	if conf.ScanFn == nil {
-		return nil, fmt.Errorf("no scan fn provided")
+		conf.ScanFn = JSONScanFn
+	}
+
+	if conf.WatermarkColumn != "" && conf.Watermark == nil {
+		return nil, fmt.Errorf("no initial watermark provided")
+	}
+
+	if conf.PollInterval > 0 && conf.WatermarkColumn == "" {
+		return nil, fmt.Errorf("polling requires a watermark column")
+	}
+
+	if conf.Placeholder == nil {
+		conf.Placeholder = QuestionPlaceholder
+	}
+
+	if conf.Context == nil {
+		conf.Context = context.Background()
 	}
 
 	return &Source{
-		cfg:  conf,
-		rows: nil,
+		cfg:       conf,
+		rows:      nil,
+		mark:      -1,
+		watermark: conf.Watermark,
+		done:      make(chan struct{}),
+	}, nil
+}
+
+//NewSink creates a new sink that inserts events into a table
+func NewSink(conf SinkConfig) (*Sink, error) {
+	if conf.DB == nil {
+		return nil, fmt.Errorf("no db provided")
+	}
+
+	if conf.Table == "" {
+		return nil, fmt.Errorf("no table provided")
+	}
+
+	if len(conf.Columns) == 0 {
+		return nil, fmt.Errorf("no columns provided")
+	}
+
+	if conf.ColumnFn == nil {
+		return nil, fmt.Errorf("no column fn provided")
+	}
+
+	if conf.Placeholder == nil {
+		conf.Placeholder = QuestionPlaceholder
+	}
+
+	if conf.MaxParams <= 0 {
+		conf.MaxParams = DefaultMaxParams
+	}
+
+	batch := conf.MaxParams / len(conf.Columns)
+	if batch < 1 {
+		return nil, fmt.Errorf("max params %d less than number of columns", conf.MaxParams)
+	}
+
+	conflict := ""
+	switch conf.Conflict {
+	case ConflictNone:
+	case ConflictIgnore:
+		conflict = " ON CONFLICT"
+		if len(conf.ConflictColumns) > 0 {
+			conflict += fmt.Sprintf(" (%s)", strings.Join(conf.ConflictColumns, ", "))
+		}
+		conflict += " DO NOTHING"
+	case ConflictUpdate:
+		if len(conf.ConflictColumns) == 0 {
+			return nil, fmt.Errorf("conflict columns required for upserts")
+		}
+		update := conf.UpdateColumns
+		if len(update) == 0 {
+			update = subtract(conf.Columns, conf.ConflictColumns)
+		}
+		if len(update) == 0 {
+			return nil, fmt.Errorf("no columns to update on conflict")
+		}
+		sets := []string{}
+		for _, col := range update {
+			sets = append(sets, fmt.Sprintf("%s = excluded.%s", col, col))
+		}
+		conflict = fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s",
+			strings.Join(conf.ConflictColumns, ", "),
+			strings.Join(sets, ", "))
+	default:
+		return nil, fmt.Errorf("unknown conflict mode %d", conf.Conflict)
+	}
+
+	return &Sink{
+		cfg:      conf,
+		batch:    batch,
+		conflict: conflict,
 	}, nil
 }
 
-//DrawOne reads one event from DB, potentially running query
+//DrawOne reads one event from DB, potentially running query.
+//
+//In paging mode, queries the next page when the current one is exhausted.
+//In polling mode, blocks until new rows are available or the source is closed.
 func (source *Source) DrawOne() (*types.Event, error) {
 	logger := logging.Logger()
 
-	if source.rows == nil {
-		stmt := source.cfg.Stmt
-		logger.Debug("querying", zap.String("q", stmt))
-		rows, err := source.cfg.DB.Query(stmt)
+	for {
+		if source.rows == nil {
+			if err := source.query(); err != nil {
+				return nil, err
+			}
+		}
+
+		if source.rows.Next() {
+			source.nPage++
+			break
+		}
+
+		err := source.rows.Err()
+		source.closeRows()
 		if err != nil {
 			return nil, err
 		}
-		source.rows = rows
+
+		//a full page means there might be more rows
+		full := source.cfg.PageSize > 0 && source.nPage >= source.cfg.PageSize
+		source.offset += int64(source.nPage)
+		source.nPage = 0
+		if full {
+			logger.Debug("sql.DrawOne: next page", zap.Int64("offset", source.offset))
+			continue
+		}
+
+		if source.cfg.PollInterval <= 0 {
+			return nil, errors.ErrSQLEnd
+		}
+
+		logger.Debug("sql.DrawOne: waiting to poll", zap.Duration("interval", source.cfg.PollInterval))
+		select {
+		case <-source.done:
+			return nil, errors.ErrSourceClosed
+		case <-time.After(source.cfg.PollInterval):
+		}
+	}
+
+	e, err := source.cfg.ScanFn(source.rows)
+	if err != nil {
+		return nil, err
 	}
 
-	if !source.rows.Next() {
-		return nil, errors.ErrSQLEnd
+	if source.cfg.WatermarkColumn != "" {
+		if err = source.advance(); err != nil {
+			return nil, err
+		}
 	}
 
-	return source.cfg.ScanFn(source.rows)
+	return e, nil
+}
+
+//Watermark returns the high-water-mark of the last drawn row,
+//or the initial watermark if no rows have been drawn.
+//Safe to call concurrently with DrawOne, e.g. for checkpointing.
+func (source *Source) Watermark() interface{} {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	return source.watermark
 }
 
-//Close closes db connection ,and any rows used
+//query runs the configured statement, binding arguments, watermark and page if configured
+func (source *Source) query() error {
+	stmt := source.cfg.Stmt
+	args := append([]interface{}{}, source.cfg.Args...)
+	if source.cfg.WatermarkColumn != "" {
+		args = append(args, source.Watermark())
+	}
+	if source.cfg.PageSize > 0 {
+		args = append(args, source.cfg.PageSize)
+		stmt = fmt.Sprintf("%s LIMIT %s", stmt, source.cfg.Placeholder(len(args)))
+		if source.cfg.WatermarkColumn == "" {
+			args = append(args, source.offset)
+			stmt = fmt.Sprintf("%s OFFSET %s", stmt, source.cfg.Placeholder(len(args)))
+		}
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if source.cfg.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(source.cfg.Context, source.cfg.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(source.cfg.Context)
+	}
+
+	logging.Logger().Debug("querying", zap.String("q", stmt), zap.Any("args", args))
+	rows, err := source.cfg.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		cancel()
+		return err
+	}
+	source.rows = rows
+	source.cancel = cancel
+	return nil
+}
+
+//closeRows closes current rows and releases their context
+func (source *Source) closeRows() error {
+	if source.rows == nil {
+		return nil
+	}
+	err := source.rows.Close()
+	source.cancel()
+	source.rows = nil
+	source.cancel = nil
+	return err
+}
+
+//advance reads the watermark column from the current row
+func (source *Source) advance() error {
+	cols, err := source.rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	if source.mark < 0 {
+		for i, col := range cols {
+			if col == source.cfg.WatermarkColumn {
+				source.mark = i
+			}
+		}
+		if source.mark < 0 {
+			return fmt.Errorf("watermark column %s not in result", source.cfg.WatermarkColumn)
+		}
+	}
+
+	values := make([]interface{}, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err = source.rows.Scan(dest...); err != nil {
+		return err
+	}
+
+	mark := values[source.mark]
+	if b, ok := mark.([]byte); ok {
+		mark = string(b)
+	}
+
+	source.mu.Lock()
+	source.watermark = mark
+	source.mu.Unlock()
+
+	return nil
+}
+
+//Close closes any rows used, and the db connection
 func (source *Source) Close() error {
-	if source.rows != nil {
-		return source.rows.Close()
+	select {
+	case <-source.done:
+	default:
+		close(source.done)
+	}
+	err := source.closeRows()
+	if dbErr := source.cfg.DB.Close(); err == nil {
+		err = dbErr
+	}
+	return err
+}
+
+//Drain inserts events as rows, using multi-row inserts inside a single transaction.
+//
+//If the batch insert fails, rows are retried one at a time so that
+//only the failing rows are reported, at their corresponding index.
+func (sink *Sink) Drain(events []types.Event) []error {
+	logger := logging.Logger()
+	errs := make([]error, len(events))
+	failed := false
+
+	rows := [][]interface{}{}
+	indices := []int{}
+	for i := range events {
+		values, err := sink.cfg.ColumnFn(&events[i])
+		if err == nil && len(values) != len(sink.cfg.Columns) {
+			err = fmt.Errorf("expected %d values, got %d", len(sink.cfg.Columns), len(values))
+		}
+		if err != nil {
+			logger.Debug("sql.Drain: column error", zap.Int("i", i), zap.Error(err))
+			errs[i] = err
+			failed = true
+			continue
+		}
+		rows = append(rows, values)
+		indices = append(indices, i)
+	}
+
+	if len(rows) > 0 {
+		logger.Debug("sql.Drain: inserting batch",
+			zap.String("table", sink.cfg.Table),
+			zap.Int("n", len(rows)))
+		if err := sink.insertBatch(rows); err != nil {
+			logger.Debug("sql.Drain: batch failed, inserting one by one", zap.Error(err))
+			for j, err := range sink.insertEach(rows) {
+				if err != nil {
+					errs[indices[j]] = err
+					failed = true
+				}
+			}
+		}
+	}
+
+	if failed {
+		return errs
 	}
-	source.cfg.DB.Close()
 	return nil
 }
+
+//insertBatch inserts all rows in one transaction, chunked by max params
+func (sink *Sink) insertBatch(rows [][]interface{}) error {
+	tx, err := sink.cfg.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(rows); start += sink.batch {
+		end := start + sink.batch
+		if end > len(rows) {
+			end = len(rows)
+		}
+		if err = sink.exec(tx, rows[start:end]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+//insertEach inserts rows one at a time inside one transaction, using savepoints
+//so that failing rows don't abort the transaction
+func (sink *Sink) insertEach(rows [][]interface{}) []error {
+	errs := make([]error, len(rows))
+
+	tx, err := sink.cfg.DB.Begin()
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	for i, row := range rows {
+		if _, err = tx.Exec("SAVEPOINT partaj_row"); err != nil {
+			errs[i] = err
+			continue
+		}
+		if err = sink.exec(tx, [][]interface{}{row}); err != nil {
+			errs[i] = err
+			tx.Exec("ROLLBACK TO SAVEPOINT partaj_row")
+		}
+		tx.Exec("RELEASE SAVEPOINT partaj_row")
+	}
+
+	if err = tx.Commit(); err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+
+	return errs
+}
+
+//exec runs one multi-row insert statement
+func (sink *Sink) exec(tx *sql.Tx, rows [][]interface{}) error {
+	stmt, args := sink.statement(rows)
+	logging.Logger().Debug("sql.exec", zap.String("q", stmt), zap.Int("nRows", len(rows)))
+	_, err := tx.Exec(stmt, args...)
+	return err
+}
+
+//statement builds insert statement and arguments for rows
+func (sink *Sink) statement(rows [][]interface{}) (string, []interface{}) {
+	var b strings.Builder
+	args := []interface{}{}
+
+	fmt.Fprintf(&b, "INSERT INTO %s (%s) VALUES ",
+		sink.cfg.Table,
+		strings.Join(sink.cfg.Columns, ", "))
+
+	for i, row := range rows {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("(")
+		for j, value := range row {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+			args = append(args, value)
+			b.WriteString(sink.cfg.Placeholder(len(args)))
+		}
+		b.WriteString(")")
+	}
+	b.WriteString(sink.conflict)
+
+	return b.String(), args
+}
+
+//subtract returns strings in a not present in b
+func subtract(a []string, b []string) []string {
+	res := []string{}
+	for _, s := range a {
+		found := false
+		for _, other := range b {
+			if s == other {
+				found = true
+			}
+		}
+		if !found {
+			res = append(res, s)
+		}
+	}
+	return res
+}
@@ -4,14 +4,20 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"context"
 	gosql "database/sql"
 	"encoding/json"
+	"fmt"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/underscorenygren/partaj/internal"
 	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/buffer"
 	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/underscorenygren/partaj/pkg/failsink"
 	"github.com/underscorenygren/partaj/pkg/sql"
 	"github.com/underscorenygren/partaj/pkg/types"
 	"go.uber.org/zap"
+	"time"
 )
 
 //Used to display test code in godoc
@@ -91,3 +97,426 @@ var _ = Describe("SQL", func() {
 		close(done)
 	})
 })
+
+type sinkRow struct {
+	ID   int     `json:"id"`
+	Name *string `json:"name"`
+}
+
+//columns maps json events to sink rows
+func columns(e *types.Event) ([]interface{}, error) {
+	row := sinkRow{}
+	if err := json.Unmarshal(e.Bytes(), &row); err != nil {
+		return nil, err
+	}
+	return []interface{}{row.ID, row.Name}, nil
+}
+
+var _ = Describe("SQL Sink", func() {
+
+	dsn := "file:sink.db?cache=shared&mode=memory"
+	var db *gosql.DB
+
+	read := func() map[int]string {
+		res := map[int]string{}
+		rows, err := db.Query("SELECT id, name FROM sink_table")
+		Expect(err).To(BeNil())
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			var name string
+			Expect(rows.Scan(&id, &name)).To(BeNil())
+			res[id] = name
+		}
+		return res
+	}
+
+	BeforeEach(func() {
+		var err error
+		db, err = gosql.Open("sqlite3", dsn)
+		Expect(err).To(BeNil())
+		_, err = db.Exec("CREATE TABLE sink_table (id INTEGER PRIMARY KEY, name TEXT NOT NULL)")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		_, err := db.Exec("DROP TABLE sink_table")
+		Expect(err).To(BeNil())
+		Expect(db.Close()).To(BeNil())
+	})
+
+	It("inserts events in batches", func() {
+		sink, err := sql.NewSink(sql.SinkConfig{
+			DB:        db,
+			Table:     "sink_table",
+			Columns:   []string{"id", "name"},
+			ColumnFn:  columns,
+			MaxParams: 4,
+		})
+		Expect(err).To(BeNil())
+
+		errs := sink.Drain(internal.StringsToEvents([]string{
+			`{"id": 1, "name": "one"}`,
+			`{"id": 2, "name": "two"}`,
+			`{"id": 3, "name": "three"}`,
+		}))
+		Expect(errs).To(BeNil())
+		Expect(read()).To(Equal(map[int]string{1: "one", 2: "two", 3: "three"}))
+	})
+
+	It("upserts conflicting rows", func() {
+		sink, err := sql.NewSink(sql.SinkConfig{
+			DB:              db,
+			Table:           "sink_table",
+			Columns:         []string{"id", "name"},
+			ColumnFn:        columns,
+			Conflict:        sql.ConflictUpdate,
+			ConflictColumns: []string{"id"},
+		})
+		Expect(err).To(BeNil())
+
+		Expect(sink.Drain(internal.StringsToEvents([]string{
+			`{"id": 1, "name": "one"}`,
+		}))).To(BeNil())
+		Expect(sink.Drain(internal.StringsToEvents([]string{
+			`{"id": 1, "name": "uno"}`,
+			`{"id": 2, "name": "dos"}`,
+		}))).To(BeNil())
+		Expect(read()).To(Equal(map[int]string{1: "uno", 2: "dos"}))
+	})
+
+	It("ignores conflicting rows", func() {
+		sink, err := sql.NewSink(sql.SinkConfig{
+			DB:       db,
+			Table:    "sink_table",
+			Columns:  []string{"id", "name"},
+			ColumnFn: columns,
+			Conflict: sql.ConflictIgnore,
+		})
+		Expect(err).To(BeNil())
+
+		Expect(sink.Drain(internal.StringsToEvents([]string{
+			`{"id": 1, "name": "one"}`,
+			`{"id": 1, "name": "uno"}`,
+		}))).To(BeNil())
+		Expect(read()).To(Equal(map[int]string{1: "one"}))
+	})
+
+	It("returns errors for failing rows, and routes them with failsink", func() {
+		sink, err := sql.NewSink(sql.SinkConfig{
+			DB:       db,
+			Table:    "sink_table",
+			Columns:  []string{"id", "name"},
+			ColumnFn: columns,
+		})
+		Expect(err).To(BeNil())
+
+		events := internal.StringsToEvents([]string{
+			`{"id": 1, "name": "one"}`,
+			`{"id": 2}`,
+			`not json`,
+			`{"id": 3, "name": "three"}`,
+		})
+
+		errs := sink.Drain(events)
+		Expect(len(errs)).To(Equal(len(events)))
+		Expect(errs[0]).To(BeNil())
+		Expect(errs[1]).ToNot(BeNil())
+		Expect(errs[2]).ToNot(BeNil())
+		Expect(errs[3]).To(BeNil())
+		Expect(read()).To(Equal(map[int]string{1: "one", 3: "three"}))
+
+		buf := buffer.NewSink()
+		fs, err := failsink.NewSink(sink, buf)
+		Expect(err).To(BeNil())
+		Expect(fs.Drain(internal.StringsToEvents([]string{
+			`{"id": 4, "name": "four"}`,
+			`{"id": 1, "name": "duplicate"}`,
+		}))).To(BeNil())
+		Expect(buf.Events).To(Equal(internal.StringsToEvents([]string{
+			`{"id": 1, "name": "duplicate"}`,
+		})))
+		Expect(read()).To(Equal(map[int]string{1: "one", 3: "three", 4: "four"}))
+	})
+})
+
+var _ = Describe("SQL Polling", func() {
+
+	stmt := "SELECT * FROM poll_table WHERE id > ? ORDER BY id"
+	nDB := 0
+	var db *gosql.DB
+	var source *sql.Source
+
+	drawID := func() int {
+		row := Row{}
+		e, err := source.DrawOne()
+		Expect(err).To(BeNil())
+		Expect(json.Unmarshal(e.Bytes(), &row)).To(BeNil())
+		return row.ID
+	}
+
+	BeforeEach(func() {
+		var err error
+		nDB++
+		db, err = gosql.Open("sqlite3", fmt.Sprintf("file:poll%d.db?cache=shared&mode=memory", nDB))
+		Expect(err).To(BeNil())
+		_, err = db.Exec("CREATE TABLE poll_table (id INTEGER PRIMARY KEY)")
+		Expect(err).To(BeNil())
+		_, err = db.Exec("INSERT INTO poll_table VALUES (1), (2)")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		if source != nil {
+			source.Close()
+			source = nil
+		}
+		Expect(db.Close()).To(BeNil())
+	})
+
+	It("polls for new rows past the watermark", func(done Done) {
+		var err error
+		source, err = sql.NewSource(sql.SourceConfig{
+			DB:              db,
+			ScanFn:          scanner,
+			Stmt:            stmt,
+			PollInterval:    10 * time.Millisecond,
+			WatermarkColumn: "id",
+			Watermark:       0,
+		})
+		Expect(err).To(BeNil())
+
+		Expect(drawID()).To(Equal(1))
+		Expect(drawID()).To(Equal(2))
+		Expect(source.Watermark()).To(Equal(int64(2)))
+
+		go func() {
+			defer GinkgoRecover()
+			time.Sleep(30 * time.Millisecond)
+			_, err := db.Exec("INSERT INTO poll_table VALUES (3)")
+			Expect(err).To(BeNil())
+		}()
+
+		Expect(drawID()).To(Equal(3))
+		Expect(source.Watermark()).To(Equal(int64(3)))
+
+		close(done)
+	})
+
+	It("resumes from a watermark", func() {
+		var err error
+		source, err = sql.NewSource(sql.SourceConfig{
+			DB:              db,
+			ScanFn:          scanner,
+			Stmt:            stmt,
+			WatermarkColumn: "id",
+			Watermark:       int64(1),
+		})
+		Expect(err).To(BeNil())
+
+		Expect(drawID()).To(Equal(2))
+		_, err = source.DrawOne()
+		Expect(err).To(Equal(errors.ErrSQLEnd))
+	})
+
+	It("requires an initial watermark", func() {
+		_, err := sql.NewSource(sql.SourceConfig{
+			DB:              db,
+			ScanFn:          scanner,
+			Stmt:            stmt,
+			WatermarkColumn: "id",
+		})
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("requires a watermark column to poll", func() {
+		_, err := sql.NewSource(sql.SourceConfig{
+			DB:           db,
+			ScanFn:       scanner,
+			Stmt:         stmt,
+			PollInterval: 10 * time.Millisecond,
+		})
+		Expect(err).ToNot(BeNil())
+	})
+})
+
+var _ = Describe("SQL JSON Scanning", func() {
+
+	dsn := "file:scan.db?cache=shared&mode=memory"
+	var db *gosql.DB
+
+	BeforeEach(func() {
+		var err error
+		db, err = gosql.Open("sqlite3", dsn)
+		Expect(err).To(BeNil())
+		_, err = db.Exec(`CREATE TABLE scan_table (
+			id INTEGER PRIMARY KEY,
+			name TEXT,
+			score REAL,
+			data BLOB,
+			created DATETIME,
+			user_id INTEGER)`)
+		Expect(err).To(BeNil())
+		_, err = db.Exec("INSERT INTO scan_table VALUES (?, ?, ?, ?, ?, ?)",
+			1, `say "hi"`, 1.5, []byte{0, 1}, time.Date(2026, 10, 17, 13, 0, 0, 0, time.UTC), 7)
+		Expect(err).To(BeNil())
+		_, err = db.Exec("INSERT INTO scan_table (id) VALUES (2)")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(db.Close()).To(BeNil())
+	})
+
+	draw := func(scanFn sql.ScanFn) []string {
+		source, err := sql.NewSource(sql.SourceConfig{
+			DB:     db,
+			ScanFn: scanFn,
+			Stmt:   "SELECT * FROM scan_table ORDER BY id",
+		})
+		Expect(err).To(BeNil())
+
+		res := []string{}
+		for {
+			e, err := source.DrawOne()
+			if err == errors.ErrSQLEnd {
+				break
+			}
+			Expect(err).To(BeNil())
+			res = append(res, e.String())
+		}
+		return res
+	}
+
+	It("scans rows into json objects", func() {
+		Expect(draw(sql.JSONScanFn)).To(Equal([]string{
+			`{"id":1,"name":"say \"hi\"","score":1.5,"data":"AAE=","created":"2026-10-17T13:00:00Z","user_id":7}`,
+			`{"id":2,"name":null,"score":null,"data":null,"created":null,"user_id":null}`,
+		}))
+	})
+
+	It("fails rows with infinite floats", func() {
+		_, err := db.Exec("INSERT INTO scan_table (id, score) VALUES (3, 9e999)")
+		Expect(err).To(BeNil())
+
+		source, err := sql.NewSource(sql.SourceConfig{
+			DB:   db,
+			Stmt: "SELECT * FROM scan_table WHERE id = 3",
+		})
+		Expect(err).To(BeNil())
+		defer source.Close()
+
+		_, err = source.DrawOne()
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("renames and nests columns", func() {
+		scanFn := sql.NewJSONScanFn(sql.ScanConfig{
+			Rename: map[string]string{
+				"user_id": "user.id",
+				"name":    "user.name",
+				"created": "@timestamp",
+			},
+			Separator:  ".",
+			TimeFormat: "2006-01-02",
+		})
+		Expect(draw(scanFn)[0]).To(Equal(
+			`{"id":1,"user":{"name":"say \"hi\"","id":7},"score":1.5,"data":"AAE=","@timestamp":"2026-10-17"}`,
+		))
+	})
+})
+
+var _ = Describe("SQL Queries", func() {
+
+	dsn := "file:query.db?cache=shared&mode=memory"
+	var db *gosql.DB
+
+	drawAll := func(source *sql.Source) []int {
+		ids := []int{}
+		for {
+			e, err := source.DrawOne()
+			if err == errors.ErrSQLEnd {
+				return ids
+			}
+			Expect(err).To(BeNil())
+			row := Row{}
+			Expect(json.Unmarshal(e.Bytes(), &row)).To(BeNil())
+			ids = append(ids, row.ID)
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		db, err = gosql.Open("sqlite3", dsn)
+		Expect(err).To(BeNil())
+		_, err = db.Exec("CREATE TABLE query_table (id INTEGER PRIMARY KEY)")
+		Expect(err).To(BeNil())
+		_, err = db.Exec("INSERT INTO query_table VALUES (1), (2), (3), (4), (5)")
+		Expect(err).To(BeNil())
+	})
+
+	It("binds query arguments", func() {
+		source, err := sql.NewSource(sql.SourceConfig{
+			DB:   db,
+			Stmt: "SELECT id FROM query_table WHERE id BETWEEN ? AND ? ORDER BY id",
+			Args: []interface{}{2, 4},
+		})
+		Expect(err).To(BeNil())
+		Expect(drawAll(source)).To(Equal([]int{2, 3, 4}))
+		Expect(source.Close()).To(BeNil())
+	})
+
+	It("pages by offset", func() {
+		source, err := sql.NewSource(sql.SourceConfig{
+			DB:       db,
+			Stmt:     "SELECT id FROM query_table WHERE id > ? ORDER BY id",
+			Args:     []interface{}{1},
+			PageSize: 2,
+		})
+		Expect(err).To(BeNil())
+		Expect(drawAll(source)).To(Equal([]int{2, 3, 4, 5}))
+		Expect(source.Close()).To(BeNil())
+	})
+
+	It("pages by keyset", func() {
+		source, err := sql.NewSource(sql.SourceConfig{
+			DB:              db,
+			Stmt:            "SELECT id FROM query_table WHERE id > ? ORDER BY id",
+			WatermarkColumn: "id",
+			Watermark:       0,
+			PageSize:        2,
+		})
+		Expect(err).To(BeNil())
+		Expect(drawAll(source)).To(Equal([]int{1, 2, 3, 4, 5}))
+		Expect(source.Watermark()).To(Equal(int64(5)))
+		Expect(source.Close()).To(BeNil())
+	})
+
+	It("queries with context", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		source, err := sql.NewSource(sql.SourceConfig{
+			DB:      db,
+			Stmt:    "SELECT id FROM query_table",
+			Context: ctx,
+			Timeout: time.Second,
+		})
+		Expect(err).To(BeNil())
+		_, err = source.DrawOne()
+		Expect(err).To(Equal(context.Canceled))
+		Expect(source.Close()).To(BeNil())
+	})
+
+	It("closes rows and db", func() {
+		source, err := sql.NewSource(sql.SourceConfig{
+			DB:   db,
+			Stmt: "SELECT id FROM query_table ORDER BY id",
+		})
+		Expect(err).To(BeNil())
+		_, err = source.DrawOne()
+		Expect(err).To(BeNil())
+
+		Expect(source.Close()).To(BeNil())
+		Expect(db.Ping()).ToNot(BeNil())
+	})
+})
@@ -0,0 +1,551 @@
+/*
+Package sqs provides a source that consumes events from an AWS SQS queue,
+and a sink that sends events to one.
+*/
+package sqs
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/awsconfig"
+	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"go.uber.org/zap"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//LocalEndpoint is the address of the sqs service when using localstack for testing.
+	LocalEndpoint = "http://localhost:4576"
+	//MaxBatchEntries is the max number of entries in one batch call.
+	MaxBatchEntries = 10
+	//MaxBatchBytes is the max size of one SendMessageBatch call.
+	MaxBatchBytes = 256 * 1024
+	//MaxMessageBytes is the max size of one message.
+	MaxMessageBytes = 256 * 1024
+	//DefaultWaitTime is how long receive calls long poll for messages, which is also the max.
+	DefaultWaitTime = 20 * time.Second
+	//DefaultVisibilityTimeout is how long received messages are hidden from other consumers,
+	//before their visibility is extended.
+	DefaultVisibilityTimeout = 30 * time.Second
+)
+
+//GroupIDFn is the function signature for choosing the message group id of an event, for FIFO queues.
+type GroupIDFn func(*types.Event) (string, error)
+
+//Sink implements Sink interface for sending events to an SQS queue.
+type Sink struct {
+	QueueURL  string
+	groupIDFn GroupIDFn
+	sqs       *sqs.SQS
+}
+
+//Config is the input arguments to NewSink.
+type Config struct {
+	QueueURL  string             //url of the queue
+	QueueName string             //name of the queue, used to look up url if QueueURL isn't set
+	GroupIDFn GroupIDFn          //sets message group ids, required for FIFO queues
+	Local     bool               //when set to true, will configure client to make requests to the local endpoint.
+	AWS       *awsconfig.Options //aws session options, e.g. region, credentials and retries. Defaults to the environment
+}
+
+/*
+Source implements Source interface for consuming an SQS queue with long polling.
+
+Messages are deleted from the queue only after they are acknowledged.
+Drawing an event acknowledges the previously drawn one, since stages only
+draw again once the previous event has been drained successfully. Call Ack
+to acknowledge the last drawn event directly.
+
+While messages are received but not yet deleted, their visibility timeout
+is extended in the background, so they aren't delivered to other consumers.
+On Close, acknowledged messages are deleted and the rest are made visible again.
+*/
+type Source struct {
+	QueueURL string
+	cfg      SourceConfig
+	sqs      *sqs.SQS
+	buffered []*sqs.Message //received, not yet drawn
+	drawn    *sqs.Message   //drawn, not yet acknowledged
+	acked    []*sqs.Message //acknowledged, not yet deleted
+	mu       sync.Mutex     //guards messages, for extending visibility
+	done     chan struct{}
+	ctx      context.Context //cancelled on close, to stop receiving
+	cancel   context.CancelFunc
+}
+
+//SourceConfig is the input arguments to NewSource.
+type SourceConfig struct {
+	QueueURL          string             //url of the queue
+	QueueName         string             //name of the queue, used to look up url if QueueURL isn't set
+	MaxMessages       int64              //max messages per receive call, defaults to MaxBatchEntries
+	WaitTime          time.Duration      //long polling time of receive calls, defaults to DefaultWaitTime
+	VisibilityTimeout time.Duration      //visibility timeout of received messages, defaults to DefaultVisibilityTimeout
+	Local             bool               //when set to true, will configure client to make requests to the local endpoint.
+	AWS               *awsconfig.Options //aws session options, e.g. region, credentials and retries. Defaults to the environment
+}
+
+//implements interfaces
+var _ types.Sink = &Sink{}
+var _ types.Source = &Source{}
+
+//NewClient makes an sqs client with aws sdk, using default options
+func NewClient(local bool) *sqs.SQS {
+	//default options never fail
+	client, _ := NewClientWithOptions(nil, local)
+	return client
+}
+
+//NewClientWithOptions makes an sqs client with aws sdk, configured by opts
+func NewClientWithOptions(opts *awsconfig.Options, local bool) (*sqs.SQS, error) {
+	endpoint := ""
+	if local {
+		endpoint = LocalEndpoint
+	}
+	sess, err := opts.NewSession(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return sqs.New(sess), nil
+}
+
+//queueURL returns url, or looks up url of named queue
+func queueURL(client *sqs.SQS, url string, name string) (string, error) {
+	if url != "" {
+		return url, nil
+	}
+	if name == "" {
+		return "", fmt.Errorf("No queue url or name provided")
+	}
+	output, err := client.GetQueueUrl(&sqs.GetQueueUrlInput{
+		QueueName: aws.String(name),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(output.QueueUrl), nil
+}
+
+//NewSink constructs an sqs Sink.
+func NewSink(cfg Config) (*Sink, error) {
+	client, err := NewClientWithOptions(cfg.AWS, cfg.Local)
+	if err != nil {
+		return nil, err
+	}
+	url, err := queueURL(client, cfg.QueueURL, cfg.QueueName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sink{
+		QueueURL:  url,
+		groupIDFn: cfg.GroupIDFn,
+		sqs:       client,
+	}, nil
+}
+
+//NewSource constructs an sqs Source.
+func NewSource(cfg SourceConfig) (*Source, error) {
+	if cfg.MaxMessages <= 0 {
+		cfg.MaxMessages = MaxBatchEntries
+	}
+	if cfg.MaxMessages > MaxBatchEntries {
+		return nil, fmt.Errorf("max messages can't exceed %d", MaxBatchEntries)
+	}
+	if cfg.WaitTime <= 0 {
+		cfg.WaitTime = DefaultWaitTime
+	}
+	if cfg.WaitTime > DefaultWaitTime {
+		return nil, fmt.Errorf("wait time can't exceed %s", DefaultWaitTime)
+	}
+	if cfg.VisibilityTimeout <= 0 {
+		cfg.VisibilityTimeout = DefaultVisibilityTimeout
+	}
+	if cfg.VisibilityTimeout < 2*time.Second {
+		return nil, fmt.Errorf("visibility timeout must be at least 2s")
+	}
+
+	client, err := NewClientWithOptions(cfg.AWS, cfg.Local)
+	if err != nil {
+		return nil, err
+	}
+	url, err := queueURL(client, cfg.QueueURL, cfg.QueueName)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	source := &Source{
+		QueueURL: url,
+		cfg:      cfg,
+		sqs:      client,
+		buffered: []*sqs.Message{},
+		acked:    []*sqs.Message{},
+		done:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	go source.extendPeriodically()
+
+	return source, nil
+}
+
+// ** SINK ** //
+
+//Client returns the underlying AWS SQS Client
+func (sink *Sink) Client() *sqs.SQS {
+	return sink.sqs
+}
+
+//Drain sends events to the queue in batches, and returns errors at the indices of failed events.
+func (sink *Sink) Drain(events []types.Event) []error {
+	logger := logging.Logger()
+	errs := make([]error, len(events))
+	failed := false
+
+	entries := []*sqs.SendMessageBatchRequestEntry{}
+	indices := []int{}
+	size := 0
+
+	send := func() {
+		if len(entries) == 0 {
+			return
+		}
+		for j, err := range sink.sendBatch(entries) {
+			if err != nil {
+				errs[indices[j]] = err
+				failed = true
+			}
+		}
+		entries = []*sqs.SendMessageBatchRequestEntry{}
+		indices = []int{}
+		size = 0
+	}
+
+	for i := range events {
+		var err error
+		n := len(events[i].Bytes())
+		if n == 0 {
+			err = fmt.Errorf("empty message")
+		} else if n > MaxMessageBytes {
+			err = fmt.Errorf("message of %d bytes exceeds max of %d", n, MaxMessageBytes)
+		}
+		entry := &sqs.SendMessageBatchRequestEntry{
+			MessageBody: aws.String(events[i].String()),
+		}
+		if err == nil && sink.groupIDFn != nil {
+			var groupID string
+			if groupID, err = sink.groupIDFn(&events[i]); err == nil {
+				entry.MessageGroupId = aws.String(groupID)
+			}
+		}
+		if err != nil {
+			logger.Debug("sqs.Drain: invalid message", zap.Int("index", i), zap.Error(err))
+			errs[i] = err
+			failed = true
+			continue
+		}
+
+		if len(entries) == MaxBatchEntries || size+n > MaxBatchBytes {
+			send()
+		}
+		entry.Id = aws.String(strconv.Itoa(len(entries)))
+		entries = append(entries, entry)
+		indices = append(indices, i)
+		size += n
+	}
+	send()
+
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+//sendBatch sends one batch of messages, and returns errors at entry indices
+func (sink *Sink) sendBatch(entries []*sqs.SendMessageBatchRequestEntry) []error {
+	logger := logging.Logger()
+	errs := make([]error, len(entries))
+
+	logger.Debug("sqs.Drain: sending batch",
+		zap.Int("n", len(entries)),
+		zap.String("queue", sink.QueueURL))
+	res, err := sink.sqs.SendMessageBatch(&sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(sink.QueueURL),
+		Entries:  entries,
+	})
+
+	//send error means all failed
+	if err != nil {
+		logger.Debug("sqs.Drain: send error", zap.Error(err))
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	for _, entry := range res.Failed {
+		i, err := strconv.Atoi(aws.StringValue(entry.Id))
+		if err != nil || i < 0 || i >= len(errs) {
+			continue
+		}
+		code := aws.StringValue(entry.Code)
+		msg := aws.StringValue(entry.Message)
+		logger.Debug("sqs.Drain: entry error",
+			zap.Int("index", i),
+			zap.String("code", code),
+			zap.String("msg", msg))
+		errs[i] = fmt.Errorf("[%s]:%s", code, msg)
+	}
+
+	return errs
+}
+
+// ** SOURCE ** //
+
+//Client returns the underlying AWS SQS Client
+func (source *Source) Client() *sqs.SQS {
+	return source.sqs
+}
+
+//DrawOne acknowledges the last drawn event, and draws the next one, long polling until one is available.
+func (source *Source) DrawOne() (*types.Event, error) {
+	logger := logging.Logger()
+
+	source.mu.Lock()
+	source.ack()
+	if len(source.acked) >= MaxBatchEntries {
+		source.deleteAcked()
+	}
+	source.mu.Unlock()
+
+	for {
+		source.mu.Lock()
+		if source.isClosed() {
+			source.mu.Unlock()
+			return nil, errors.ErrSourceClosed
+		}
+		if len(source.buffered) > 0 {
+			msg := source.buffered[0]
+			source.buffered = source.buffered[1:]
+			source.drawn = msg
+			source.mu.Unlock()
+
+			evt := types.NewEventFromBytes([]byte(aws.StringValue(msg.Body)))
+			return &evt, nil
+		}
+		//don't hold acknowledged messages through a long poll
+		source.deleteAcked()
+		source.mu.Unlock()
+
+		output, err := source.sqs.ReceiveMessageWithContext(source.ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(source.QueueURL),
+			MaxNumberOfMessages: aws.Int64(source.cfg.MaxMessages),
+			WaitTimeSeconds:     aws.Int64(int64(source.cfg.WaitTime / time.Second)),
+			VisibilityTimeout:   aws.Int64(source.visibilitySeconds()),
+		})
+		if err != nil {
+			if source.ctx.Err() != nil {
+				return nil, errors.ErrSourceClosed
+			}
+			logger.Debug("sqs.Source: receive failed", zap.Error(err))
+			return nil, err
+		}
+		logger.Debug("sqs.Source: received", zap.Int("n", len(output.Messages)))
+
+		source.mu.Lock()
+		if source.isClosed() {
+			//Close already released buffered messages, so release these too
+			source.changeVisibility(output.Messages, 0)
+			source.mu.Unlock()
+			return nil, errors.ErrSourceClosed
+		}
+		source.buffered = append(source.buffered, output.Messages...)
+		source.mu.Unlock()
+	}
+}
+
+//Ack acknowledges the last drawn event, deleting it from the queue.
+func (source *Source) Ack() error {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	source.ack()
+	return source.deleteAcked()
+}
+
+/*
+Close stops extending visibility, deletes acknowledged messages, and
+makes all other received messages visible again.
+Any DrawOne waiting to receive is cancelled and returns ErrSourceClosed,
+and messages it received are made visible again.
+*/
+func (source *Source) Close() error {
+	select {
+	case <-source.done:
+		return nil
+	default:
+		close(source.done)
+	}
+	source.cancel()
+
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	err := source.deleteAcked()
+	release := source.buffered
+	if source.drawn != nil {
+		release = append(release, source.drawn)
+	}
+	source.buffered = []*sqs.Message{}
+	source.drawn = nil
+	if releaseErr := source.changeVisibility(release, 0); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+//isClosed true iff Close has been called
+func (source *Source) isClosed() bool {
+	select {
+	case <-source.done:
+		return true
+	default:
+		return false
+	}
+}
+
+//ack moves the drawn message to acknowledged
+func (source *Source) ack() {
+	if source.drawn != nil {
+		source.acked = append(source.acked, source.drawn)
+		source.drawn = nil
+	}
+}
+
+//visibilitySeconds is the visibility timeout in seconds
+func (source *Source) visibilitySeconds() int64 {
+	return int64(source.cfg.VisibilityTimeout / time.Second)
+}
+
+//deleteAcked deletes acknowledged messages from the queue.
+//Messages that fail to delete are kept for retry.
+func (source *Source) deleteAcked() error {
+	logger := logging.Logger()
+	var err error
+	failed := []*sqs.Message{}
+
+	for start := 0; start < len(source.acked); start += MaxBatchEntries {
+		batch := source.acked[start:min(start+MaxBatchEntries, len(source.acked))]
+		entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(batch))
+		for i, msg := range batch {
+			entries[i] = &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: msg.ReceiptHandle,
+			}
+		}
+
+		output, deleteErr := source.sqs.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(source.QueueURL),
+			Entries:  entries,
+		})
+		if deleteErr != nil {
+			logger.Debug("sqs.Source: delete failed", zap.Error(deleteErr))
+			err = deleteErr
+			failed = append(failed, batch...)
+			continue
+		}
+		for _, entry := range output.Failed {
+			i, convErr := strconv.Atoi(aws.StringValue(entry.Id))
+			if convErr != nil || i < 0 || i >= len(batch) {
+				continue
+			}
+			logger.Debug("sqs.Source: delete entry failed",
+				zap.String("code", aws.StringValue(entry.Code)),
+				zap.String("msg", aws.StringValue(entry.Message)))
+			err = fmt.Errorf("[%s]:%s", aws.StringValue(entry.Code), aws.StringValue(entry.Message))
+			//receipt handles that are invalid can never be deleted
+			if !aws.BoolValue(entry.SenderFault) {
+				failed = append(failed, batch[i])
+			}
+		}
+	}
+
+	source.acked = failed
+	return err
+}
+
+//changeVisibility sets visibility timeout of messages
+func (source *Source) changeVisibility(msgs []*sqs.Message, seconds int64) error {
+	logger := logging.Logger()
+	var err error
+
+	for start := 0; start < len(msgs); start += MaxBatchEntries {
+		batch := msgs[start:min(start+MaxBatchEntries, len(msgs))]
+		entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, len(batch))
+		for i, msg := range batch {
+			entries[i] = &sqs.ChangeMessageVisibilityBatchRequestEntry{
+				Id:                aws.String(strconv.Itoa(i)),
+				ReceiptHandle:     msg.ReceiptHandle,
+				VisibilityTimeout: aws.Int64(seconds),
+			}
+		}
+
+		output, changeErr := source.sqs.ChangeMessageVisibilityBatch(&sqs.ChangeMessageVisibilityBatchInput{
+			QueueUrl: aws.String(source.QueueURL),
+			Entries:  entries,
+		})
+		if changeErr != nil {
+			logger.Debug("sqs.Source: change visibility failed", zap.Error(changeErr))
+			err = changeErr
+			continue
+		}
+		for _, entry := range output.Failed {
+			logger.Debug("sqs.Source: change visibility entry failed",
+				zap.String("code", aws.StringValue(entry.Code)),
+				zap.String("msg", aws.StringValue(entry.Message)))
+		}
+	}
+
+	return err
+}
+
+//extendPeriodically extends visibility of in flight messages until source is closed
+func (source *Source) extendPeriodically() {
+	ticker := time.NewTicker(source.cfg.VisibilityTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-source.done:
+			return
+		case <-ticker.C:
+			source.mu.Lock()
+			inFlight := append([]*sqs.Message{}, source.buffered...)
+			inFlight = append(inFlight, source.acked...)
+			if source.drawn != nil {
+				inFlight = append(inFlight, source.drawn)
+			}
+			source.mu.Unlock()
+
+			if len(inFlight) > 0 {
+				logging.Logger().Debug("sqs.Source: extending visibility", zap.Int("n", len(inFlight)))
+				source.changeVisibility(inFlight, source.visibilitySeconds())
+			}
+		}
+	}
+}
+
+//min returns the smaller of a and b
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
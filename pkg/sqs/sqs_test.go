@@ -0,0 +1,197 @@
+package sqs_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	awssqs "github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/underscorenygren/partaj/internal"
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/awsconfig"
+	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/underscorenygren/partaj/pkg/sqs"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+//examples on how to use sqs
+func Example() {}
+
+func localStackRunning() bool {
+	_, err := http.Get(sqs.LocalEndpoint)
+	return err == nil
+}
+
+var _ = Describe("SQS", func() {
+
+	logger := logging.ConfigureDevelopment(GinkgoWriter)
+	queueName := "test-queue"
+	var sink *sqs.Sink
+
+	newSource := func() *sqs.Source {
+		source, err := sqs.NewSource(sqs.SourceConfig{
+			QueueName:         queueName,
+			WaitTime:          time.Second,
+			VisibilityTimeout: 2 * time.Second,
+			Local:             true,
+		})
+		Expect(err).To(BeNil())
+		return source
+	}
+
+	nMessages := func() string {
+		output, err := sink.Client().GetQueueAttributes(&awssqs.GetQueueAttributesInput{
+			QueueUrl: aws.String(sink.QueueURL),
+			AttributeNames: aws.StringSlice([]string{
+				awssqs.QueueAttributeNameApproximateNumberOfMessages,
+				awssqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+			}),
+		})
+		Expect(err).To(BeNil())
+		attrs := aws.StringValueMap(output.Attributes)
+		return attrs[awssqs.QueueAttributeNameApproximateNumberOfMessages] + "/" +
+			attrs[awssqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible]
+	}
+
+	BeforeEach(func() {
+		if !localStackRunning() {
+			logger.Debug("localstack not running")
+			Skip("localstack isn't running")
+		} else {
+			_, err := sqs.NewClient(true).CreateQueue(&awssqs.CreateQueueInput{
+				QueueName: aws.String(queueName),
+			})
+			Expect(err).To(BeNil())
+			sink, err = sqs.NewSink(sqs.Config{
+				QueueName: queueName,
+				Local:     true,
+			})
+			Expect(err).To(BeNil())
+		}
+	})
+
+	AfterEach(func() {
+		if localStackRunning() {
+			sink.Client().DeleteQueue(&awssqs.DeleteQueueInput{
+				QueueUrl: aws.String(sink.QueueURL),
+			})
+		}
+	})
+
+	It("reads and writes to sqs", func() {
+		events := internal.StringsToEvents([]string{"one", "two", "three"})
+		Expect(sink.Drain(events)).To(BeNil())
+
+		source := newSource()
+		read := []string{}
+		for range events {
+			evt, err := source.DrawOne()
+			Expect(err).To(BeNil())
+			read = append(read, evt.String())
+		}
+		Expect(read).To(ConsistOf("one", "two", "three"))
+		Expect(source.Ack()).To(BeNil())
+		Expect(source.Close()).To(BeNil())
+		Expect(nMessages()).To(Equal("0/0"))
+	})
+
+	It("keeps unacknowledged messages in flight, and releases them on close", func() {
+		Expect(sink.Drain(internal.StringsToEvents([]string{"one"}))).To(BeNil())
+
+		source := newSource()
+		evt, err := source.DrawOne()
+		Expect(err).To(BeNil())
+		Expect(evt.String()).To(Equal("one"))
+
+		//visibility is extended past the timeout
+		time.Sleep(3 * time.Second)
+		Expect(nMessages()).To(Equal("0/1"))
+
+		Expect(source.Close()).To(BeNil())
+		Expect(nMessages()).To(Equal("1/0"))
+
+		source = newSource()
+		evt, err = source.DrawOne()
+		Expect(err).To(BeNil())
+		Expect(evt.String()).To(Equal("one"))
+		Expect(source.Ack()).To(BeNil())
+		Expect(source.Close()).To(BeNil())
+	})
+
+	It("maps per entry errors", func() {
+		events := []types.Event{
+			types.NewEventFromBytes([]byte("ok")),
+			types.NewEventFromBytes([]byte{}),
+			types.NewEventFromBytes([]byte(strings.Repeat("a", sqs.MaxMessageBytes+1))),
+		}
+		errs := sink.Drain(events)
+		Expect(errs).To(HaveLen(3))
+		Expect(errs[0]).To(BeNil())
+		Expect(errs[1]).NotTo(BeNil())
+		Expect(errs[2]).NotTo(BeNil())
+	})
+})
+
+var _ = Describe("SQS config", func() {
+
+	It("validates source config", func() {
+		_, err := sqs.NewSource(sqs.SourceConfig{QueueURL: "url", MaxMessages: 11})
+		Expect(err).NotTo(BeNil())
+
+		_, err = sqs.NewSource(sqs.SourceConfig{QueueURL: "url", WaitTime: time.Minute})
+		Expect(err).NotTo(BeNil())
+
+		_, err = sqs.NewSource(sqs.SourceConfig{QueueURL: "url", VisibilityTimeout: time.Second})
+		Expect(err).NotTo(BeNil())
+
+		_, err = sqs.NewSink(sqs.Config{})
+		Expect(err).NotTo(BeNil())
+	})
+})
+
+var _ = Describe("SQS close", func() {
+
+	logging.ConfigureDevelopment(GinkgoWriter)
+
+	It("cancels waiting receives", func() {
+		//long polls until the request is cancelled, or the test ends
+		stop := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-stop:
+			}
+		}))
+		defer server.Close()
+		defer close(stop)
+
+		source, err := sqs.NewSource(sqs.SourceConfig{
+			QueueURL: server.URL + "/queue",
+			AWS: &awsconfig.Options{
+				Endpoint:    server.URL,
+				Region:      "us-east-1",
+				Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+				MaxRetries:  aws.Int(0),
+			},
+		})
+		Expect(err).To(BeNil())
+
+		drawn := make(chan error)
+		go func() {
+			_, err := source.DrawOne()
+			drawn <- err
+		}()
+
+		Consistently(drawn, 100*time.Millisecond).ShouldNot(Receive())
+		Expect(source.Close()).To(BeNil())
+		Eventually(drawn).Should(Receive(Equal(errors.ErrSourceClosed)))
+
+		_, err = source.DrawOne()
+		Expect(err).To(Equal(errors.ErrSourceClosed))
+	})
+})
@@ -0,0 +1,217 @@
+/*
+Package tee is a sink that drains the same events to
+several sinks concurrently, e.g. to firehose and to a
+local file for debugging.
+
+Each branch has a failure policy. Errors of required branches
+are returned from Drain, while errors of best-effort branches
+are logged and counted. Slow best-effort branches can be
+isolated with a bounded queue, so they don't hold up the others.
+*/
+package tee
+
+import (
+	"fmt"
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/underscorenygren/partaj/pkg/types"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+)
+
+//Policy is how failures of a branch are handled.
+type Policy int
+
+const (
+	//Required branches return their errors from Drain.
+	Required Policy = iota
+	//BestEffort branches log and count their errors.
+	BestEffort
+)
+
+//Branch is a sink events are teed to.
+type Branch struct {
+	Name      string     //identifies the branch in logs
+	Sink      types.Sink //where events are drained
+	Policy    Policy     //defaults to Required
+	QueueSize int        //when > 0, batches are queued and drained in the background. Only for BestEffort branches
+}
+
+/*
+Sink implements the Sink interface, by draining every batch to
+all branches concurrently, and waiting for the unqueued ones.
+
+Queued branches drop batches when their queue is full.
+Call Close to drain queued batches.
+*/
+type Sink struct {
+	branches []*branch
+	wg       sync.WaitGroup //waits for queued branches
+	mu       sync.RWMutex   //held for reading by Drain, and for writing by Close
+	closed   bool
+}
+
+//branch is a running Branch
+type branch struct {
+	Branch
+	queue    chan []types.Event
+	failures int64 //events that failed or were dropped
+}
+
+//implements interfaces
+var _ types.Sink = &Sink{}
+
+//NewSink creates a Sink teeing to branches, starting queues of queued branches.
+func NewSink(branches ...Branch) (*Sink, error) {
+	if len(branches) == 0 {
+		return nil, fmt.Errorf("tee needs at least one branch")
+	}
+
+	sink := &Sink{}
+	for i, b := range branches {
+		if b.Sink == nil {
+			return nil, errors.ErrNilSink
+		}
+		if b.Policy != Required && b.Policy != BestEffort {
+			return nil, fmt.Errorf("branch %d (%s) has invalid policy %d", i, b.Name, b.Policy)
+		}
+		if b.QueueSize > 0 && b.Policy == Required {
+			return nil, fmt.Errorf("branch %d (%s) is required, and can't be queued", i, b.Name)
+		}
+		sink.branches = append(sink.branches, &branch{Branch: b})
+	}
+
+	for _, b := range sink.branches {
+		if b.QueueSize > 0 {
+			b.queue = make(chan []types.Event, b.QueueSize)
+			sink.wg.Add(1)
+			go sink.consume(b)
+		}
+	}
+
+	return sink, nil
+}
+
+//Drain drains events to all branches. Returns errors of required branches,
+//at the index of the failed event, and ErrSinkClosed for all events after Close.
+func (sink *Sink) Drain(events []types.Event) []error {
+	logger := logging.Logger()
+
+	sink.mu.RLock()
+	defer sink.mu.RUnlock()
+
+	if sink.closed {
+		errs := make([]error, len(events))
+		for i := range errs {
+			errs[i] = errors.ErrSinkClosed
+		}
+		return errs
+	}
+
+	results := make([][]error, len(sink.branches))
+	var wg sync.WaitGroup
+	for i, b := range sink.branches {
+		if b.queue != nil {
+			sink.enqueue(b, events)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, b *branch) {
+			defer wg.Done()
+			results[i] = b.drain(events)
+		}(i, b)
+	}
+	wg.Wait()
+
+	errs := make([]error, len(events))
+	failed := false
+	for i, b := range sink.branches {
+		if b.Policy != Required {
+			continue
+		}
+		for j, err := range results[i] {
+			if err != nil && j < len(errs) && errs[j] == nil {
+				logger.Debug("tee.Drain: required branch failed", zap.String("branch", b.Name), zap.Int("i", j), zap.Error(err))
+				errs[j] = err
+				failed = true
+			}
+		}
+	}
+
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+//Failures returns the number of events that best-effort branches
+//have failed or dropped, by branch index.
+func (sink *Sink) Failures() []int64 {
+	failures := make([]int64, len(sink.branches))
+	for i, b := range sink.branches {
+		failures[i] = atomic.LoadInt64(&b.failures)
+	}
+	return failures
+}
+
+//Close stops queued branches after they've drained queued batches.
+//Waits for ongoing drains, and fails drains after closing with ErrSinkClosed.
+func (sink *Sink) Close() error {
+	sink.mu.Lock()
+	if sink.closed {
+		sink.mu.Unlock()
+		return nil
+	}
+	sink.closed = true
+	for _, b := range sink.branches {
+		if b.queue != nil {
+			close(b.queue)
+		}
+	}
+	sink.mu.Unlock()
+
+	sink.wg.Wait()
+	return nil
+}
+
+//enqueue queues a copy of events for a queued branch, dropping them if the queue is full
+func (sink *Sink) enqueue(b *branch, events []types.Event) {
+	cpy := make([]types.Event, len(events))
+	copy(cpy, events)
+	select {
+	case b.queue <- cpy:
+	default:
+		logging.Logger().Warn("tee.Drain: queue full, dropping events", zap.String("branch", b.Name), zap.Int("n", len(events)))
+		atomic.AddInt64(&b.failures, int64(len(events)))
+	}
+}
+
+//consume drains queued batches until the queue is closed
+func (sink *Sink) consume(b *branch) {
+	defer sink.wg.Done()
+	for events := range b.queue {
+		b.drain(events)
+	}
+}
+
+//drain drains to the branch's sink, logging and counting failures of best-effort branches
+func (b *branch) drain(events []types.Event) []error {
+	errs := b.Sink.Drain(events)
+	if errs == nil || b.Policy != BestEffort {
+		return errs
+	}
+	n := 0
+	for _, err := range errs {
+		if err != nil {
+			if n == 0 {
+				logging.Logger().Warn("tee.Drain: best-effort branch failed", zap.String("branch", b.Name), zap.Error(err))
+			}
+			n++
+		}
+	}
+	if n > 0 {
+		atomic.AddInt64(&b.failures, int64(n))
+	}
+	return errs
+}
@@ -0,0 +1,13 @@
+package tee_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestTee(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Tee Suite")
+}
@@ -0,0 +1,136 @@
+package tee_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"fmt"
+	"github.com/underscorenygren/partaj/internal/logging"
+	"github.com/underscorenygren/partaj/pkg/buffer"
+	"github.com/underscorenygren/partaj/pkg/errors"
+	"github.com/underscorenygren/partaj/pkg/tee"
+	"github.com/underscorenygren/partaj/pkg/types"
+)
+
+//Example is just used to show the specs in godoc
+func Example() {}
+
+//errSink fails every event it receives
+type errSink struct{}
+
+func (sink errSink) Drain(events []types.Event) []error {
+	errs := make([]error, len(events))
+	for i := range events {
+		errs[i] = fmt.Errorf("failed %d", i)
+	}
+	return errs
+}
+
+//nilsSink succeeds with a slice of nil errors
+type nilsSink struct{}
+
+func (sink nilsSink) Drain(events []types.Event) []error {
+	return make([]error, len(events))
+}
+
+//blockSink blocks draining until released
+type blockSink struct {
+	buffer  *buffer.Sink
+	release chan struct{}
+}
+
+func (sink *blockSink) Drain(events []types.Event) []error {
+	<-sink.release
+	return sink.buffer.Drain(events)
+}
+
+var _ = Describe("Tee", func() {
+
+	logging.ConfigureDevelopment(GinkgoWriter)
+
+	events := []types.Event{
+		types.NewEventFromBytes([]byte("a")),
+		types.NewEventFromBytes([]byte("b")),
+	}
+
+	It("drains events to all branches", func() {
+		first, second := buffer.NewSink(), buffer.NewSink()
+		sink, err := tee.NewSink(tee.Branch{Sink: first}, tee.Branch{Sink: second})
+		Expect(err).To(BeNil())
+
+		Expect(sink.Drain(events)).To(BeNil())
+		Expect(first.Events).To(Equal(events))
+		Expect(second.Events).To(Equal(events))
+	})
+
+	It("returns errors of required branches only", func() {
+		buf := buffer.NewSink()
+		sink, err := tee.NewSink(
+			tee.Branch{Sink: buf},
+			tee.Branch{Name: "debug", Sink: errSink{}, Policy: tee.BestEffort})
+		Expect(err).To(BeNil())
+
+		Expect(sink.Drain(events)).To(BeNil())
+		Expect(buf.Events).To(Equal(events))
+		Expect(sink.Failures()).To(Equal([]int64{0, 2}))
+
+		sink, err = tee.NewSink(tee.Branch{Sink: errSink{}}, tee.Branch{Sink: buf})
+		Expect(err).To(BeNil())
+		errs := sink.Drain(events)
+		Expect(errs).To(HaveLen(2))
+		Expect(errs[0]).NotTo(BeNil())
+		Expect(errs[1]).NotTo(BeNil())
+	})
+
+	It("returns nil when required branches return no errors", func() {
+		sink, err := tee.NewSink(tee.Branch{Sink: nilsSink{}}, tee.Branch{Sink: buffer.NewSink()})
+		Expect(err).To(BeNil())
+		Expect(sink.Drain(events)).To(BeNil())
+	})
+
+	It("isolates queued branches", func(done Done) {
+		buf := buffer.NewSink()
+		slow := &blockSink{buffer: buffer.NewSink(), release: make(chan struct{})}
+		sink, err := tee.NewSink(
+			tee.Branch{Sink: buf},
+			tee.Branch{Name: "slow", Sink: slow, Policy: tee.BestEffort, QueueSize: 1})
+		Expect(err).To(BeNil())
+
+		//slow branch blocks, so at least one of three batches is dropped
+		Expect(sink.Drain(events)).To(BeNil())
+		Expect(sink.Drain(events)).To(BeNil())
+		Expect(sink.Drain(events)).To(BeNil())
+		Expect(buf.Events).To(HaveLen(6))
+		Expect(sink.Failures()[1]).To(BeNumerically(">=", 2))
+
+		close(slow.release)
+		Expect(sink.Close()).To(BeNil())
+		Expect(len(slow.buffer.Events) + int(sink.Failures()[1])).To(Equal(6))
+
+		close(done)
+	})
+
+	It("fails draining after close", func() {
+		buf := buffer.NewSink()
+		sink, err := tee.NewSink(
+			tee.Branch{Sink: buf},
+			tee.Branch{Sink: buffer.NewSink(), Policy: tee.BestEffort, QueueSize: 1})
+		Expect(err).To(BeNil())
+
+		Expect(sink.Close()).To(BeNil())
+		Expect(sink.Close()).To(BeNil())
+		Expect(sink.Drain(events)).To(Equal([]error{errors.ErrSinkClosed, errors.ErrSinkClosed}))
+		Expect(buf.Events).To(BeEmpty())
+	})
+
+	It("fails on invalid branches", func() {
+		_, err := tee.NewSink()
+		Expect(err).NotTo(BeNil())
+
+		_, err = tee.NewSink(tee.Branch{})
+		Expect(err).NotTo(BeNil())
+
+		_, err = tee.NewSink(tee.Branch{Sink: buffer.NewSink(), QueueSize: 1})
+		Expect(err).NotTo(BeNil())
+	})
+})